@@ -0,0 +1,311 @@
+package commands
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry is a line of the audit log. Hash is the SHA-256 of the entry without it, which includes the
+// hash of the previous entry, so that changing, inserting or removing an entry breaks the chain.
+type auditEntry struct {
+	Time           time.Time             `json:"time"`
+	Record         jsonRecord            `json:"record"`
+	Decision       string                `json:"decision"`
+	Reason         string                `json:"reason,omitempty"`
+	ApprovedAmount float64               `json:"approved_amount,omitempty"`
+	RulesVersion   string                `json:"rules_version"`
+	Usage          map[string]auditUsage `json:"usage"`
+	PreviousHash   string                `json:"previous_hash"`
+	Hash           string                `json:"hash,omitempty"`
+}
+
+type auditUsage struct {
+	Total float64 `json:"total"`
+	Count uint    `json:"count"`
+}
+
+// auditSink appends entries to a JSON lines file, which is renamed with the time as suffix once it
+// reaches the maximum size. The hash chain continues across the rotated files.
+type auditSink struct {
+	mutex        sync.Mutex
+	filename     string
+	maxSize      int64
+	file         afero.File
+	size         int64
+	previousHash string
+	now          func() time.Time
+}
+
+var (
+	auditLogFile string
+	auditMaxSize int64
+	auditLog     *auditSink
+
+	auditCommand = &cobra.Command{
+		Use:   "audit",
+		Short: "Check the audit log",
+	}
+
+	auditVerifyCommand = &cobra.Command{
+		Use:   "verify <file>...",
+		Short: "Verify the hash chain of the audit log",
+		Long:  `Checks the hash of every entry of the audit log files, given from the oldest to the current one.`,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fs = afero.NewOsFs()
+
+			count, err := verifyAuditLog(args)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "Verified %d audit entries\n", count)
+
+			return nil
+		},
+	}
+)
+
+func init() {
+	auditCommand.AddCommand(auditVerifyCommand)
+
+	rootCmd.AddCommand(auditCommand)
+}
+
+// openAuditLog starts auditing the decisions to the file, unless it is empty.
+func openAuditLog(filename string, maxSizeMegabytes int64) error {
+	if filename == "" {
+		return nil
+	}
+
+	sink, err := newAuditSink(filename, maxSizeMegabytes*1024*1024)
+	if err != nil {
+		return err
+	}
+
+	auditLog = sink
+
+	return nil
+}
+
+func closeAuditLog() {
+	if auditLog != nil {
+		auditLog.Close()
+		auditLog = nil
+	}
+}
+
+// auditDecision appends the decision on the record to the audit log, when auditing. The load is already
+// saved, so a failure is logged and counted rather than failing the load.
+func auditDecision(record Record, response Response) {
+	if auditLog == nil {
+		return
+	}
+
+	err := auditLog.Write(auditEntry{
+		Record:         newJsonRecord(newTransaction(record)),
+		Decision:       response.Status,
+		Reason:         response.Reason,
+		ApprovedAmount: response.ApprovedAmount,
+		RulesVersion:   response.RulesVersion,
+		Usage:          auditUsageOf(response.Usage),
+	})
+
+	if err != nil {
+		auditFailures.Inc()
+		logger.WithError(err).WithField("load", record.ID).Error("failed to audit decision")
+	}
+}
+
+// newAuditSink opens the audit log file, continuing the hash chain of its last entry.
+func newAuditSink(filename string, maxSize int64) (*auditSink, error) {
+	sink := &auditSink{filename: filename, maxSize: maxSize, now: time.Now}
+
+	if fileExists(filename) {
+		last, err := lastAuditEntry(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		if last != nil {
+			sink.previousHash = last.Hash
+		}
+	}
+
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (s *auditSink) open() error {
+	file, err := fs.OpenFile(s.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+// Write sets the time and the hashes of the entry and appends it.
+func (s *auditSink) Write(entry auditEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry.Time = s.now().UTC()
+	entry.PreviousHash = s.previousHash
+	entry.Hash = hashAuditEntry(entry)
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(entry.Time); err != nil {
+			return err
+		}
+	}
+
+	written, err := s.file.Write(line)
+	s.size += int64(written)
+
+	if err != nil {
+		return err
+	}
+
+	s.previousHash = entry.Hash
+
+	return nil
+}
+
+func (s *auditSink) rotate(now time.Time) error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if err := fs.Rename(s.filename, s.filename+"."+now.Format("20060102T150405.000000000")); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *auditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.file.Close()
+}
+
+func hashAuditEntry(entry auditEntry) string {
+	entry.Hash = ""
+
+	bytes, _ := json.Marshal(entry)
+	sum := sha256.Sum256(bytes)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func lastAuditEntry(filename string) (*auditEntry, error) {
+	var last *auditEntry
+
+	err := readAuditEntries(filename, func(line int, entry auditEntry) error {
+		last = &entry
+		return nil
+	})
+
+	return last, err
+}
+
+func readAuditEntries(filename string, fn func(line int, entry auditEntry) error) error {
+	file, err := fs.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line++
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry auditEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("%s line %d: %v", filename, line, err)
+		}
+
+		if err := fn(line, entry); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// verifyAuditLog checks the hash chain of the audit log files, from the oldest to the current one,
+// and returns the number of entries.
+func verifyAuditLog(filenames []string) (int, error) {
+	count := 0
+	previousHash := ""
+
+	for _, filename := range filenames {
+		err := readAuditEntries(filename, func(line int, entry auditEntry) error {
+			if count > 0 && entry.PreviousHash != previousHash {
+				return fmt.Errorf("%s line %d: previous hash does not match the previous entry", filename, line)
+			}
+
+			if hashAuditEntry(entry) != entry.Hash {
+				return fmt.Errorf("%s line %d: hash does not match the entry", filename, line)
+			}
+
+			previousHash = entry.Hash
+			count++
+
+			return nil
+		})
+
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// auditUsageOf returns the usage snapshot of the audit entries, by window kind.
+func auditUsageOf(usage map[string]db.Usage) map[string]auditUsage {
+	snapshot := make(map[string]auditUsage)
+	for kind, windowUsage := range usage {
+		snapshot[kind] = auditUsage{Total: windowUsage.Total, Count: windowUsage.Count}
+	}
+
+	return snapshot
+}
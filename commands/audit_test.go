@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func processAuditedRecords(t *testing.T, count int) {
+	records := generateRecords(count)
+
+	for _, record := range records {
+		_, err := processRecord(record)
+		assert.Nil(t, err)
+	}
+}
+
+func TestAuditLog_Decisions_ShouldFormVerifiableChain(t *testing.T) {
+	setup()
+
+	assert.Nil(t, openAuditLog("audit.log", 100))
+	processAuditedRecords(t, 3)
+	closeAuditLog()
+
+	// Reopening continues the chain of the last entry.
+	assert.Nil(t, openAuditLog("audit.log", 100))
+	processAuditedRecords(t, 1)
+	closeAuditLog()
+
+	count, err := verifyAuditLog([]string{"audit.log"})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, count)
+
+	var entries []auditEntry
+	readAuditEntries("audit.log", func(line int, entry auditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+
+	assert.Equal(t, "", entries[0].PreviousHash)
+	assert.Equal(t, entries[2].Hash, entries[3].PreviousHash)
+	assert.Equal(t, "accepted", entries[0].Decision)
+	assert.Equal(t, currentRules().Version, entries[0].RulesVersion)
+	assert.Equal(t, "1", entries[0].Record.ID)
+	assert.Equal(t, auditUsage{Total: 0, Count: 0}, entries[0].Usage["day"])
+}
+
+func TestAuditLog_TamperedEntry_ShouldFailVerification(t *testing.T) {
+	setup()
+
+	assert.Nil(t, openAuditLog("audit.log", 100))
+	processAuditedRecords(t, 3)
+	closeAuditLog()
+
+	text, _ := afero.ReadFile(fs, "audit.log")
+	afero.WriteFile(fs, "audit.log", []byte(strings.Replace(string(text), "\"accepted\"", "\"declined\"", 1)), 0600)
+
+	_, err := verifyAuditLog([]string{"audit.log"})
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "audit.log line 1"))
+}
+
+func TestAuditLog_MaxSize_ShouldRotateAndKeepChain(t *testing.T) {
+	setup()
+
+	sink, err := newAuditSink("audit.log", 1)
+	assert.Nil(t, err)
+
+	auditLog = sink
+	processAuditedRecords(t, 3)
+	closeAuditLog()
+
+	files, _ := afero.Glob(fs, "audit.log.*")
+	assert.Equal(t, 2, len(files))
+
+	count, err := verifyAuditLog(append(files, "audit.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestAuditLog_FailedWrite_ShouldCountAndKeepLoad(t *testing.T) {
+	setup()
+
+	assert.Nil(t, openAuditLog("audit.log", 100))
+	defer closeAuditLog()
+
+	auditLog.file.Close()
+	failures := testutil.ToFloat64(auditFailures)
+
+	record := generateRecords(1)[0]
+	response, err := processRecord(record)
+
+	assert.Nil(t, err)
+	assert.True(t, response.Accepted)
+	assert.Equal(t, failures+1, testutil.ToFloat64(auditFailures))
+
+	transaction, err := store.FindByLoadID(record.CustomerID, record.ID)
+	assert.Nil(t, err)
+	assert.NotNil(t, transaction)
+}
@@ -2,23 +2,68 @@ package commands
 
 import (
 	"bufio"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dragosv/velocity/db"
 	guuid "github.com/google/uuid"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
 
-func openTestDatabase() {
-	id := guuid.New()
-	//
-	testDatabase, err := openDatabase("sqlite3", "file:"+id.String()+"?mode=memory")
+var testDirectory string
+
+func TestMain(m *testing.M) {
+	var err error
+
+	testDirectory, err = ioutil.TempDir("", "velocity")
 	if err != nil {
-		panic("failed to connect database")
+		panic(err)
 	}
 
-	database = testDatabase
+	code := m.Run()
+
+	os.RemoveAll(testDirectory)
+	os.Exit(code)
+}
+
+// openTestDatabase opens the store selected by VELOCITY_TEST_DIALECT, an in-memory SQLite database by default.
+func openTestDatabase() {
+	id := guuid.New()
+
+	switch os.Getenv("VELOCITY_TEST_DIALECT") {
+	case "bolt":
+		testStore, err := db.OpenBoltStore(filepath.Join(testDirectory, id.String()+".db"))
+		if err != nil {
+			panic("failed to open store")
+		}
+
+		store = testStore
+	case "redis":
+		server, err := miniredis.Run()
+		if err != nil {
+			panic("failed to start redis")
+		}
+
+		testStore, err := db.OpenRedisStore("redis://" + server.Addr())
+		if err != nil {
+			panic("failed to open store")
+		}
+
+		store = testStore
+	default:
+		testDatabase, err := openDatabase("sqlite3", "file:"+id.String()+"?mode=memory")
+		if err != nil {
+			panic("failed to connect database")
+		}
+
+		store = db.NewGormStore(testDatabase)
+	}
 }
 
 func createTestMapFs() {
@@ -46,7 +91,7 @@ func TestRunRootCommand_One_ShouldOutputExpected(t *testing.T) {
 	outputText, error := readAllText(destination)
 
 	assert.Nil(t, error)
-	assert.Equal(t, "{\"id\":\"15887\",\"customer_id\":\"528\",\"accepted\":true}", outputText)
+	assert.Equal(t, "{\"id\":\"15887\",\"customer_id\":\"528\",\"accepted\":true,\"status\":\"accepted\"}", outputText)
 }
 
 func TestRunRootCommand_Multiple_ShouldOutputExpected(t *testing.T) {
@@ -62,7 +107,7 @@ func TestRunRootCommand_Multiple_ShouldOutputExpected(t *testing.T) {
 	outputText, error := readAllText(destination)
 
 	assert.Nil(t, error)
-	assert.Equal(t, "{\"id\":\"16174\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"5092\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"28835\",\"customer_id\":\"766\",\"accepted\":false}\n{\"id\":\"10362\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"16934\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"31916\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"11526\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"10150\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"4824\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"20731\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"25624\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"29071\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"4316\",\"customer_id\":\"766\",\"accepted\":false}\n{\"id\":\"5648\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"1827\",\"customer_id\":\"766\",\"accepted\":false}\n{\"id\":\"31671\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"25458\",\"customer_id\":\"766\",\"accepted\":true}\n{\"id\":\"163\",\"customer_id\":\"766\",\"accepted\":false}", outputText)
+	assert.Equal(t, "{\"id\":\"16174\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"5092\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"28835\",\"customer_id\":\"766\",\"accepted\":false,\"status\":\"declined\",\"reason\":\"daily_amount\"}\n{\"id\":\"10362\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"16934\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"31916\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"11526\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"10150\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"4824\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"20731\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"25624\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"29071\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"4316\",\"customer_id\":\"766\",\"accepted\":false,\"status\":\"declined\",\"reason\":\"daily_amount\"}\n{\"id\":\"5648\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"1827\",\"customer_id\":\"766\",\"accepted\":false,\"status\":\"declined\",\"reason\":\"daily_amount\"}\n{\"id\":\"31671\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"25458\",\"customer_id\":\"766\",\"accepted\":true,\"status\":\"accepted\"}\n{\"id\":\"163\",\"customer_id\":\"766\",\"accepted\":false,\"status\":\"declined\",\"reason\":\"daily_amount\"}", outputText)
 }
 
 func readAllText(filename string) (text string, err error) {
@@ -390,3 +435,139 @@ func TestProcessRecords_HigherThan20000PerWeek_ShouldDecline(t *testing.T) {
 	assert.Equal(t, uint(1), responses[4].CustomerID)
 	assert.False(t, responses[4].Accepted)
 }
+
+func TestProcessRecord_Concurrent_ShouldNotExceedLimits(t *testing.T) {
+	directory, err := ioutil.TempDir("", "velocity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	testDatabase, err := openDatabase("sqlite3", "file:"+filepath.Join(directory, "velocity.sqlite"))
+	assert.Nil(t, err)
+	defer testDatabase.Close()
+
+	store = db.NewGormStore(testDatabase)
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 324359102, time.UTC)
+
+	var waitGroup sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+
+		go func(id uint) {
+			defer waitGroup.Done()
+
+			response, err := processRecord(Record{
+				ID:         id,
+				CustomerID: 1,
+				LoadAmount: 1000,
+				Time:       startDate,
+			})
+
+			assert.Nil(t, err)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if response.Accepted {
+				accepted++
+			}
+		}(uint(i + 1))
+	}
+
+	waitGroup.Wait()
+
+	assert.Equal(t, 3, accepted)
+}
+
+func generateRecords(count int) []Record {
+	records := make([]Record, count)
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 324359102, time.UTC)
+
+	for i := 0; i < count; i++ {
+		records[i] = Record{
+			ID:         uint(i + 1),
+			CustomerID: uint(i%50 + 1),
+			LoadAmount: float64(i%7+1) * 500,
+			Time:       startDate.Add(time.Duration(i) * 17 * time.Minute),
+		}
+	}
+
+	return records
+}
+
+func TestProcessRecords_Batched_ShouldMatchUnbatched(t *testing.T) {
+	records := generateRecords(500)
+
+	setup()
+	expected, err := processRecords(records)
+	assert.Nil(t, err)
+
+	setup()
+	batchSize = 64
+	defer func() { batchSize = 1 }()
+
+	actual, err := processRecords(records)
+	assert.Nil(t, err)
+
+	assert.Equal(t, expected, actual)
+}
+
+func benchmarkProcessRecords(b *testing.B, size int) {
+	directory, err := ioutil.TempDir("", "velocity")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	records := generateRecords(1000)
+
+	batchSize = size
+	defer func() { batchSize = 1 }()
+
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+
+		testDatabase, err := openDatabase("sqlite3", "file:"+filepath.Join(directory, guuid.New().String()+".sqlite"))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		testDatabase.LogMode(false)
+		store = db.NewGormStore(testDatabase)
+
+		b.StartTimer()
+
+		if _, err := processRecords(records); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		testDatabase.Close()
+	}
+}
+
+func BenchmarkProcessRecords_Autocommit(b *testing.B) {
+	benchmarkProcessRecords(b, 1)
+}
+
+func BenchmarkProcessRecords_Batch1000(b *testing.B) {
+	benchmarkProcessRecords(b, 1000)
+}
+
+func TestProcessRecords_MemoryStore_ShouldMatchDatabase(t *testing.T) {
+	records := generateRecords(500)
+
+	setup()
+	expected, err := processRecords(records)
+	assert.Nil(t, err)
+
+	store = db.NewMemoryStore()
+
+	actual, err := processRecords(records)
+	assert.Nil(t, err)
+
+	assert.Equal(t, expected, actual)
+}
@@ -0,0 +1,196 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const envPrefix = "VELOCITY"
+
+var (
+	// config resolves every option from its flag, its VELOCITY_ environment variable, the config file,
+	// then the default of its flag.
+	config = newConfig()
+
+	// configOptions are the flags of the options, by configuration key.
+	configOptions = make(map[string]*pflag.Flag)
+
+	envKeyReplacer = strings.NewReplacer(".", "_", "-", "_")
+
+	configCommand = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+		// The configuration is neither applied nor checked, as the commands inspect the configuration in use,
+		// which may be the invalid one.
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+	}
+
+	configShowCommand = &cobra.Command{
+		Use:   "show",
+		Short: "Print the effective configuration",
+		Long:  `Prints the value of every option and where it comes from: a flag, an environment variable, the config file or the default.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runConfigShow(config, cmd.OutOrStdout())
+		},
+	}
+)
+
+func init() {
+	configCommand.AddCommand(configShowCommand)
+
+	rootCmd.AddCommand(configCommand)
+}
+
+// bindConfig makes the flag resolvable from the configuration key.
+func bindConfig(key string, flag *pflag.Flag) {
+	configOptions[key] = flag
+	config.BindPFlag(key, flag)
+}
+
+// bindFlagsConfig makes every flag of the set resolvable from its name with the prefix.
+func bindFlagsConfig(prefix string, flags *pflag.FlagSet) {
+	flags.VisitAll(func(flag *pflag.Flag) {
+		bindConfig(prefix+flag.Name, flag)
+	})
+}
+
+// bindCommandConfig makes every local flag of the command resolvable from a key prefixed with the command name.
+func bindCommandConfig(cmd *cobra.Command) {
+	bindFlagsConfig(cmd.Name()+".", cmd.LocalNonPersistentFlags())
+}
+
+func newConfig() *viper.Viper {
+	v := viper.New()
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(envKeyReplacer)
+	v.AutomaticEnv()
+
+	return v
+}
+
+// envName returns the environment variable of the configuration key.
+func envName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(envKeyReplacer.Replace(key))
+}
+
+// readConfig reads the config file, YAML or TOML, or .velocity.yaml or .velocity.toml in the home or the
+// current directory when there is no filename. Only an explicit file is required to exist.
+func readConfig(v *viper.Viper, filename string) error {
+	if filename != "" {
+		v.SetConfigFile(filename)
+	} else {
+		home, err := homedir.Dir()
+		if err != nil {
+			return err
+		}
+
+		v.AddConfigPath(home)
+		v.AddConfigPath(".")
+		v.SetConfigName(".velocity")
+	}
+
+	err := v.ReadInConfig()
+
+	if _, notFound := err.(viper.ConfigFileNotFoundError); notFound && filename == "" {
+		return nil
+	}
+
+	return err
+}
+
+// applyConfig sets the flags of the command that were not given on the command line to their configured values.
+// Only the flags of the command are set, as the flags of different commands may share a variable.
+func applyConfig(v *viper.Viper, cmd *cobra.Command) error {
+	var errs []string
+
+	for key, flag := range configOptions {
+		if flag.Changed || cmd.Flags().Lookup(flag.Name) != flag {
+			continue
+		}
+
+		if err := flag.Value.Set(configValue(v, key)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New("invalid configuration: " + strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// configValue returns the value of the key, or the default of its flag when it is not configured.
+// The current value of the flag is not used, as it holds the previously applied configuration.
+func configValue(v *viper.Viper, key string) string {
+	flag := configOptions[key]
+
+	if flag.Changed {
+		return flag.Value.String()
+	}
+
+	if !v.IsSet(key) {
+		return flag.DefValue
+	}
+
+	return v.GetString(key)
+}
+
+// configOrigin returns where the value of the key comes from.
+func configOrigin(v *viper.Viper, fileValues *viper.Viper, key string) string {
+	if flag := configOptions[key]; flag.Changed {
+		return "flag --" + flag.Name
+	}
+
+	if _, found := os.LookupEnv(envName(key)); found {
+		return "env " + envName(key)
+	}
+
+	if fileValues.IsSet(key) {
+		return "file " + v.ConfigFileUsed()
+	}
+
+	return "default"
+}
+
+func runConfigShow(v *viper.Viper, writer io.Writer) error {
+	// The values of the file alone tell which keys it sets, as the flags are set in v.
+	fileValues := viper.New()
+
+	if v.ConfigFileUsed() != "" {
+		fileValues.SetConfigFile(v.ConfigFileUsed())
+
+		if err := fileValues.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(configOptions))
+	for key := range configOptions {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(table, "KEY\tVALUE\tORIGIN")
+
+	for _, key := range keys {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", key, configValue(v, key), configOrigin(v, fileValues, key))
+	}
+
+	return table.Flush()
+}
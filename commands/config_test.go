@@ -0,0 +1,116 @@
+package commands
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, name string, text string) string {
+	filename := filepath.Join(testDirectory, name)
+	assert.Nil(t, ioutil.WriteFile(filename, []byte(text), 0644))
+
+	return filename
+}
+
+func TestApplyConfig_FileAndEnv_ShouldSetFlagsNotGiven(t *testing.T) {
+	defer func(savedLimits Limits, savedDialect string, savedSource string) {
+		limits = savedLimits
+		databaseDialect = savedDialect
+		source = savedSource
+	}(limits, databaseDialect, source)
+
+	filename := writeTestConfig(t, "velocity.yaml", "source: loads.txt\ndialect: postgres\nlimits:\n  daily-amount: 1000\n  daily-count: 5\n")
+
+	os.Setenv("VELOCITY_DIALECT", "bolt")
+	defer os.Unsetenv("VELOCITY_DIALECT")
+
+	v := newConfig()
+
+	assert.Nil(t, readConfig(v, filename))
+	assert.Nil(t, rootCmd.ParseFlags([]string{}))
+	assert.Nil(t, applyConfig(v, rootCmd))
+
+	assert.Equal(t, "loads.txt", source)
+	assert.Equal(t, "bolt", databaseDialect)
+	assert.Equal(t, Limits{DailyAmount: 1000, DailyCount: 5, WeeklyAmount: 20000, DailyAmountAction: actionDecline, DailyCountAction: actionDecline, WeeklyAmountAction: actionDecline}, limits)
+}
+
+func TestApplyConfig_TomlFile_ShouldSetNestedOptions(t *testing.T) {
+	defer func(savedLimits Limits) {
+		limits = savedLimits
+	}(limits)
+
+	filename := writeTestConfig(t, "velocity.toml", "[limits]\nweekly-amount = 15000\n")
+
+	v := newConfig()
+
+	assert.Nil(t, readConfig(v, filename))
+	assert.Nil(t, rootCmd.ParseFlags([]string{}))
+	assert.Nil(t, applyConfig(v, rootCmd))
+
+	assert.Equal(t, 15000.0, limits.WeeklyAmount)
+}
+
+func TestApplyConfig_InvalidValue_ShouldFail(t *testing.T) {
+	defer func(savedLimits Limits) {
+		limits = savedLimits
+	}(limits)
+
+	os.Setenv("VELOCITY_LIMITS_DAILY_COUNT", "three")
+	defer os.Unsetenv("VELOCITY_LIMITS_DAILY_COUNT")
+
+	assert.Nil(t, rootCmd.ParseFlags([]string{}))
+
+	err := applyConfig(newConfig(), rootCmd)
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "limits.daily-count")
+}
+
+func TestReadConfig_MissingExplicitFile_ShouldFail(t *testing.T) {
+	assert.NotNil(t, readConfig(newConfig(), filepath.Join(testDirectory, "missing.yaml")))
+}
+
+func TestRunConfigShow_ShouldPrintValuesWithOrigins(t *testing.T) {
+	filename := writeTestConfig(t, "show.yaml", "limits:\n  daily-amount: 1000\nserve:\n  listen: \":9090\"\n")
+
+	os.Setenv("VELOCITY_DIALECT", "bolt")
+	defer os.Unsetenv("VELOCITY_DIALECT")
+
+	v := newConfig()
+	assert.Nil(t, readConfig(v, filename))
+
+	var output bytes.Buffer
+
+	assert.Nil(t, runConfigShow(v, &output))
+
+	text := output.String()
+
+	assert.Regexp(t, regexp.MustCompile(`(?m)^limits\.daily-amount +1000 +file `+regexp.QuoteMeta(filename)+`$`), text)
+	assert.Regexp(t, regexp.MustCompile(`(?m)^serve\.listen +:9090 +file `), text)
+	assert.Regexp(t, regexp.MustCompile(`(?m)^dialect +bolt +env VELOCITY_DIALECT$`), text)
+	assert.Regexp(t, regexp.MustCompile(`(?m)^limits\.weekly-amount +20000 +default$`), text)
+}
+
+func TestRootCommand_ConfigShowWithInvalidLimits_ShouldNotCheckLimits(t *testing.T) {
+	os.Setenv("VELOCITY_LIMITS_DAILY_AMOUNT", "-1")
+	defer os.Unsetenv("VELOCITY_LIMITS_DAILY_AMOUNT")
+
+	var output bytes.Buffer
+
+	rootCmd.SetOut(&output)
+	rootCmd.SetArgs([]string{"config", "show"})
+
+	defer func() {
+		rootCmd.SetOut(nil)
+		rootCmd.SetArgs(nil)
+	}()
+
+	assert.Nil(t, rootCmd.Execute())
+	assert.Regexp(t, regexp.MustCompile(`(?m)^limits\.daily-amount +-1 +env VELOCITY_LIMITS_DAILY_AMOUNT$`), output.String())
+}
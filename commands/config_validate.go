@@ -0,0 +1,363 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pelletier/go-toml"
+	"github.com/spf13/afero"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// windowKinds are the kinds of usage windows limits can be set for.
+var windowKinds = []string{"daily", "weekly"}
+
+// windowLimitKey matches the keys of the limits of a window kind and their actions, such as limits.daily-amount.
+var windowLimitKey = regexp.MustCompile(`^limits\.([a-z]+)-(amount|count)(-action)?$`)
+
+var configValidateCommand = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Check a config file",
+	Long: `Checks the keys, the types of the values, the limits and the custom rules of the config file, by default
+the one in use, and reports every problem with its line and column.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fs = afero.NewOsFs()
+
+		filename := config.ConfigFileUsed()
+		if len(args) > 0 {
+			filename = args[0]
+		}
+
+		if filename == "" {
+			return errors.New("no config file to validate")
+		}
+
+		cmd.SilenceUsage = true
+
+		return runConfigValidate(filename, os.Stdout)
+	},
+}
+
+func init() {
+	configCommand.AddCommand(configValidateCommand)
+}
+
+// configEntry is a value of the config file, with the position of its key.
+type configEntry struct {
+	Key    string
+	Value  interface{}
+	Line   int
+	Column int
+}
+
+// positionedProblem is a problem of the config file at a position.
+type positionedProblem struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func runConfigValidate(filename string, report io.Writer) error {
+	problems, err := validateConfigFile(filename)
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintf(report, "%s:%d:%d: %s\n", filename, problem.Line, problem.Column, problem.Message)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems in %s", len(problems), filename)
+	}
+
+	fmt.Fprintf(report, "%s is valid\n", filename)
+
+	return nil
+}
+
+// validateConfigFile returns the problems of the config file, sorted by position. The limits are checked
+// with the values of the file, and the defaults of the limits it does not set, and the expressions of
+// the custom rules are compiled.
+func validateConfigFile(filename string) ([]positionedProblem, error) {
+	entries, err := readConfigEntries(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []positionedProblem
+
+	values := make(map[string]string)
+	positions := make(map[string]configEntry)
+
+	// The rules given as tables, by name, to check that they have a condition.
+	ruleTables := make(map[string]configEntry)
+	ruleConditions := make(map[string]bool)
+
+	// The rules are compiled for the dialect of the file, or the one of the flags.
+	dialect := databaseDialect
+	for _, entry := range entries {
+		if entry.Key == "dialect" {
+			dialect = cast.ToString(entry.Value)
+		}
+	}
+
+	for _, entry := range entries {
+		if name, field := splitRuleKey(entry.Key); strings.HasPrefix(entry.Key, "rules.") && field != "" {
+			if _, found := ruleTables[name]; !found {
+				ruleTables[name] = entry
+			}
+
+			ruleConditions[name] = ruleConditions[name] || field == "when"
+		}
+
+		message, value := checkConfigEntry(entry, dialect)
+		if message != "" {
+			problems = append(problems, positionedProblem{entry.Line, entry.Column, message})
+			continue
+		}
+
+		values[entry.Key] = value
+		positions[entry.Key] = entry
+	}
+
+	for name, entry := range ruleTables {
+		if !ruleConditions[name] {
+			problems = append(problems, positionedProblem{entry.Line, entry.Column, "rules." + name + ": missing when, the condition of the rule"})
+		}
+	}
+
+	limits, err := parseLimits(func(key string) string {
+		if value, found := values[key]; found {
+			return value
+		}
+
+		return configOptions[key].DefValue
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, problem := range validateLimits(limits) {
+		// Problems of limits left to their defaults are reported at the start of the file.
+		position := positions[problem.Key]
+		if position.Line == 0 {
+			position.Line, position.Column = 1, 1
+		}
+
+		problems = append(problems, positionedProblem{position.Line, position.Column, problem.String()})
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+
+		return problems[i].Column < problems[j].Column
+	})
+
+	return problems, nil
+}
+
+// checkConfigEntry returns the problem of the entry, or the value of the entry as a flag value.
+func checkConfigEntry(entry configEntry, dialect string) (problem string, value string) {
+	if strings.HasPrefix(entry.Key, "rules.") {
+		if err := checkRuleEntry(entry, dialect); err != nil {
+			return entry.Key + ": " + err.Error(), ""
+		}
+
+		return "", ""
+	}
+
+	flag, known := configOptions[entry.Key]
+	if !known {
+		if match := windowLimitKey.FindStringSubmatch(entry.Key); match != nil && !isWindowKind(match[1]) {
+			return fmt.Sprintf("%s: unknown window kind %s, expected one of %s", entry.Key, match[1], strings.Join(windowKinds, ", ")), ""
+		}
+
+		return entry.Key + ": unknown key", ""
+	}
+
+	var converted interface{}
+	var err error
+
+	switch flag.Value.Type() {
+	case "float64":
+		converted, err = cast.ToFloat64E(entry.Value)
+	case "uint":
+		var number int64
+		if number, err = cast.ToInt64E(entry.Value); err == nil && number < 0 {
+			err = errors.New("must not be negative")
+		}
+		converted = number
+	case "int", "int64":
+		converted, err = cast.ToInt64E(entry.Value)
+	case "bool":
+		converted, err = cast.ToBoolE(entry.Value)
+	case "duration":
+		converted, err = cast.ToDurationE(entry.Value)
+	default:
+		converted, err = cast.ToStringE(entry.Value)
+	}
+
+	if err != nil {
+		return fmt.Sprintf("%s: invalid %s value %v: %v", entry.Key, flag.Value.Type(), entry.Value, err), ""
+	}
+
+	return "", fmt.Sprint(converted)
+}
+
+// splitRuleKey returns the name of the rule of a key under rules, and the field of its table if any.
+func splitRuleKey(key string) (name string, field string) {
+	name = strings.TrimPrefix(key, "rules.")
+
+	if dot := strings.LastIndex(name, "."); dot >= 0 {
+		return name[:dot], name[dot+1:]
+	}
+
+	return name, ""
+}
+
+// checkRuleEntry checks a custom rule given as an expression, or a field of the table of a rule, for the
+// store of the dialect.
+func checkRuleEntry(entry configEntry, dialect string) error {
+	name, field := splitRuleKey(entry.Key)
+
+	definition := ruleDefinition{Action: actionDecline}
+
+	var err error
+
+	if field == "" {
+		definition, err = parseRuleDefinition(entry.Value)
+	} else {
+		err = parseRuleField(&definition, field, entry.Value)
+	}
+
+	if err == nil && definition.When != "" {
+		_, err = compileRule(name, definition, dialect)
+	}
+
+	return err
+}
+
+func isWindowKind(kind string) bool {
+	for _, windowKind := range windowKinds {
+		if windowKind == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readConfigEntries reads the values of the YAML or TOML config file, with their dotted lower case keys.
+func readConfigEntries(filename string) ([]configEntry, error) {
+	file, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return readYamlEntries(file)
+	case ".toml":
+		return readTomlEntries(file)
+	default:
+		return nil, fmt.Errorf("unsupported config file type %s, expected .yaml or .toml", filepath.Ext(filename))
+	}
+}
+
+func readYamlEntries(reader io.Reader) ([]configEntry, error) {
+	var document yaml.Node
+
+	if err := yaml.NewDecoder(reader).Decode(&document); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var entries []configEntry
+
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of keys", root.Line)
+	}
+
+	err := walkYamlMapping(root, "", func(entry configEntry) {
+		entries = append(entries, entry)
+	})
+
+	return entries, err
+}
+
+func walkYamlMapping(node *yaml.Node, prefix string, fn func(entry configEntry)) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		key := prefix + strings.ToLower(keyNode.Value)
+
+		if valueNode.Kind == yaml.MappingNode {
+			if err := walkYamlMapping(valueNode, key+".", fn); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		var value interface{}
+
+		if err := valueNode.Decode(&value); err != nil {
+			return fmt.Errorf("line %d: %v", valueNode.Line, err)
+		}
+
+		fn(configEntry{Key: key, Value: value, Line: keyNode.Line, Column: keyNode.Column})
+	}
+
+	return nil
+}
+
+func readTomlEntries(reader io.Reader) ([]configEntry, error) {
+	tree, err := toml.LoadReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []configEntry
+
+	walkTomlTree(tree, "", func(entry configEntry) {
+		entries = append(entries, entry)
+	})
+
+	return entries, nil
+}
+
+func walkTomlTree(tree *toml.Tree, prefix string, fn func(entry configEntry)) {
+	for _, name := range tree.Keys() {
+		key := prefix + strings.ToLower(name)
+		value := tree.GetPath([]string{name})
+
+		if subtree, isTree := value.(*toml.Tree); isTree {
+			walkTomlTree(subtree, key+".", fn)
+			continue
+		}
+
+		position := tree.GetPositionPath([]string{name})
+
+		fn(configEntry{Key: key, Value: value, Line: position.Line, Column: position.Col})
+	}
+}
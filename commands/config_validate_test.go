@@ -0,0 +1,125 @@
+package commands
+
+import (
+	"bytes"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRunConfigValidate_Valid_ShouldReportValid(t *testing.T) {
+	createTestMapFs()
+
+	afero.WriteFile(fs, "velocity.yaml", []byte("dialect: bolt\nlimits:\n  daily-amount: 1000\nserve:\n  listen: :9090\n  prune-interval: 1h\n"), 0644)
+
+	var report bytes.Buffer
+
+	err := runConfigValidate("velocity.yaml", &report)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "velocity.yaml is valid\n", report.String())
+}
+
+func TestRunConfigValidate_YamlProblems_ShouldReportAllWithPositions(t *testing.T) {
+	createTestMapFs()
+
+	afero.WriteFile(fs, "velocity.yaml", []byte("limits:\n  daily-amount: 30000\n  daily-count: 0\n  monthly-amount: 50000\nbatch-size: many\nsurprise: true\n"), 0644)
+
+	var report bytes.Buffer
+
+	err := runConfigValidate("velocity.yaml", &report)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "5 problems in velocity.yaml", err.Error())
+	assert.Equal(t, "velocity.yaml:2:3: limits.daily-amount: must not be above limits.weekly-amount\n"+
+		"velocity.yaml:3:3: limits.daily-count: must be positive\n"+
+		"velocity.yaml:4:3: limits.monthly-amount: unknown window kind monthly, expected one of daily, weekly\n"+
+		"velocity.yaml:5:1: batch-size: invalid int value many: unable to cast \"many\" of type string to int64\n"+
+		"velocity.yaml:6:1: surprise: unknown key\n", report.String())
+}
+
+func TestRunConfigValidate_TomlProblems_ShouldReportWithPositions(t *testing.T) {
+	createTestMapFs()
+
+	afero.WriteFile(fs, "velocity.toml", []byte("dialect = \"bolt\"\n\n[limits]\ndaily-count = -1\nweekly-amount = 100\n"), 0644)
+
+	var report bytes.Buffer
+
+	err := runConfigValidate("velocity.toml", &report)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "velocity.toml:1:1: limits.daily-amount: must not be above limits.weekly-amount\n"+
+		"velocity.toml:4:1: limits.daily-count: invalid uint value -1: must not be negative\n", report.String())
+}
+
+func TestRunConfigValidate_DefaultLimitsProblem_ShouldReportAtStart(t *testing.T) {
+	createTestMapFs()
+
+	afero.WriteFile(fs, "velocity.yaml", []byte("limits:\n  weekly-amount: 100\n"), 0644)
+
+	var report bytes.Buffer
+
+	err := runConfigValidate("velocity.yaml", &report)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "velocity.yaml:1:1: limits.daily-amount: must not be above limits.weekly-amount\n", report.String())
+}
+
+func TestRunConfigValidate_SyntaxError_ShouldReturnError(t *testing.T) {
+	createTestMapFs()
+
+	afero.WriteFile(fs, "velocity.yaml", []byte("limits: [\n"), 0644)
+
+	err := runConfigValidate("velocity.yaml", &bytes.Buffer{})
+
+	assert.NotNil(t, err)
+}
+
+func TestValidateLimits_Action_ShouldReportUnknown(t *testing.T) {
+	problems := validateLimits(Limits{DailyAmount: 1, DailyCount: 1, WeeklyAmount: 1, DailyAmountAction: actionDecline, DailyCountAction: actionReview, WeeklyAmountAction: "ignore"})
+
+	assert.Equal(t, []configProblem{
+		{"limits.weekly-amount-action", "unknown action ignore, expected one of decline, review or step-up"},
+	}, problems)
+}
+
+func TestRunConfigValidate_InvalidRule_ShouldReportAtRule(t *testing.T) {
+	createTestMapFs()
+
+	afero.WriteFile(fs, "velocity.yaml", []byte("rules:\n  night: hour < 6 && load_amount > 500\n  broken: count(1h) > 2 &&\n"), 0644)
+
+	var report bytes.Buffer
+
+	err := runConfigValidate("velocity.yaml", &report)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "velocity.yaml:3:3: rules.broken: column 17: unexpected end of expression\n", report.String())
+}
+
+func TestRunConfigValidate_HistoryRuleWithRedis_ShouldReportAtRule(t *testing.T) {
+	createTestMapFs()
+
+	afero.WriteFile(fs, "velocity.yaml", []byte("rules:\n  night: hour < 6 && load_amount > 500\n  new: account_age() < 7d && load_amount > 1000\n  burst: count(1h) > 2\ndialect: redis\n"), 0644)
+
+	var report bytes.Buffer
+
+	err := runConfigValidate("velocity.yaml", &report)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "velocity.yaml:3:3: rules.new: count, sum and account_age need the transaction history, which the redis dialect does not keep\n"+
+		"velocity.yaml:4:3: rules.burst: count, sum and account_age need the transaction history, which the redis dialect does not keep\n", report.String())
+}
+
+func TestRunConfigValidate_RuleTables_ShouldReportFieldsAndMissingCondition(t *testing.T) {
+	createTestMapFs()
+
+	afero.WriteFile(fs, "velocity.toml", []byte("[limits]\ndaily-count-action = \"review\"\n\n[rules.large]\nwhen = \"load_amount > 4000\"\naction = \"step-up\"\npriority = 5\n\n[rules.flag]\naction = \"flag\"\n"), 0644)
+
+	var report bytes.Buffer
+
+	err := runConfigValidate("velocity.toml", &report)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "velocity.toml:10:1: rules.flag.action: action: unknown action flag, expected one of decline, review or step-up\n"+
+		"velocity.toml:10:1: rules.flag: missing when, the condition of the rule\n", report.String())
+}
@@ -0,0 +1,166 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"github.com/spf13/cobra"
+	"io"
+	"strconv"
+	"time"
+)
+
+var (
+	customersReason  string
+	customersExpires string
+
+	customersCommand = &cobra.Command{
+		Use:   "customers",
+		Short: "Manage the blocklist and the allowlist of customers",
+		Long: `Puts customers on the blocklist, declining all their loads, or on the allowlist, accepting their loads
+without checking the limits, and removes them from those lists. A listing expires by the clock, whatever
+the time of the loads.`,
+	}
+
+	customersBlockCommand = &cobra.Command{
+		Use:   "block <customer-id>",
+		Short: "Decline every load of a customer",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withStore(func() error {
+				return runCustomersListing(db.ListBlocked, args[0], customersReason, customersExpires, time.Now(), cmd.OutOrStdout())
+			})
+		},
+	}
+
+	customersAllowCommand = &cobra.Command{
+		Use:   "allow <customer-id>",
+		Short: "Accept every load of a customer without checking the limits",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withStore(func() error {
+				return runCustomersListing(db.ListAllowed, args[0], customersReason, customersExpires, time.Now(), cmd.OutOrStdout())
+			})
+		},
+	}
+
+	customersUnblockCommand = &cobra.Command{
+		Use:   "unblock <customer-id>",
+		Short: "Remove a customer from the blocklist or the allowlist",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return withStore(func() error {
+				return runCustomersUnblock(args[0], cmd.OutOrStdout())
+			})
+		},
+	}
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{customersBlockCommand, customersAllowCommand} {
+		cmd.Flags().StringVarP(&customersReason, "reason", "", "", "Why the customer is listed, required")
+		cmd.Flags().StringVarP(&customersExpires, "expires", "", "", "When the listing expires, as a duration such as 30d or an RFC 3339 time; never by default")
+	}
+
+	customersCommand.AddCommand(customersBlockCommand)
+	customersCommand.AddCommand(customersAllowCommand)
+	customersCommand.AddCommand(customersUnblockCommand)
+
+	rootCmd.AddCommand(customersCommand)
+}
+
+// withStore runs fn with the store open.
+func withStore(fn func() error) error {
+	var err error
+
+	store, err = openStore(databaseDialect, databaseConnection)
+	if err != nil {
+		return errors.New("failed to connect database " + err.Error())
+	}
+	defer store.Close()
+
+	return fn()
+}
+
+func parseCustomerID(value string) (uint, error) {
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, errors.New("invalid customer id " + value)
+	}
+
+	return uint(id), nil
+}
+
+// parseExpiry parses an expiry given as a time, or as a duration from now.
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	if expiresAt, err := time.Parse(time.RFC3339, value); err == nil {
+		return expiresAt, nil
+	}
+
+	duration, err := parseRetention(value)
+	if err != nil || duration <= 0 {
+		return time.Time{}, fmt.Errorf("invalid expiry %s, expected a positive duration such as 30d or an RFC 3339 time", value)
+	}
+
+	return now.Add(duration), nil
+}
+
+// runCustomersListing puts the customer on the list, replacing the list it was on.
+func runCustomersListing(list string, customerID string, reason string, expires string, now time.Time, output io.Writer) error {
+	id, err := parseCustomerID(customerID)
+	if err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return errors.New("the reason of the listing is required, set it with --reason")
+	}
+
+	listing := &db.CustomerListing{CustomerID: id, List: list, Reason: reason, CreatedAt: now}
+
+	if expires != "" {
+		expiresAt, err := parseExpiry(expires, now)
+		if err != nil {
+			return err
+		}
+
+		if !expiresAt.After(now) {
+			return fmt.Errorf("expiry %s is not in the future", expires)
+		}
+
+		listing.ExpiresAt = &expiresAt
+	}
+
+	if err := store.SaveListing(listing); err != nil {
+		return err
+	}
+
+	if listing.ExpiresAt != nil {
+		fmt.Fprintf(output, "Customer %d is %s until %s\n", id, list, listing.ExpiresAt.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(output, "Customer %d is %s\n", id, list)
+	}
+
+	return nil
+}
+
+// runCustomersUnblock removes the customer from the list it is on.
+func runCustomersUnblock(customerID string, output io.Writer) error {
+	id, err := parseCustomerID(customerID)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := store.DeleteListing(id)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return fmt.Errorf("customer %d is not on the blocklist or the allowlist", id)
+	}
+
+	fmt.Fprintf(output, "Customer %d is no longer listed\n", id)
+
+	return nil
+}
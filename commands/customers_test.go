@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"bytes"
+	"github.com/dragosv/velocity/db"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRunCustomersListing_Block_ShouldDeclineUntilExpiry(t *testing.T) {
+	setup()
+
+	now := time.Now()
+
+	assert.Nil(t, runCustomersListing(db.ListBlocked, "42", "chargeback fraud", "7d", now, ioutil.Discard))
+
+	listing, err := store.FindListing(42)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "chargeback fraud", listing.Reason)
+	assert.True(t, now.AddDate(0, 0, 7).Equal(*listing.ExpiresAt))
+
+	// The expiry is compared with the clock, not with the time of the load.
+	for i, at := range []time.Time{now.Add(time.Hour), now.AddDate(0, 0, 8)} {
+		response, err := processRecord(Record{ID: uint(i + 1), CustomerID: 42, LoadAmount: 10, Time: at})
+
+		assert.Nil(t, err)
+		assert.False(t, response.Accepted)
+		assert.Equal(t, statusDeclined, response.Status)
+		assert.Equal(t, reasonBlocked, response.Reason)
+	}
+
+	assert.Nil(t, runCustomersListing(db.ListBlocked, "42", "chargeback fraud", "7d", now.AddDate(0, 0, -8), ioutil.Discard))
+
+	response, err := processRecord(Record{ID: 3, CustomerID: 42, LoadAmount: 10, Time: now.AddDate(0, 0, -2)})
+
+	assert.Nil(t, err)
+	assert.True(t, response.Accepted)
+	assert.Empty(t, response.Reason)
+}
+
+func TestRunCustomersListing_Allow_ShouldBypassLimits(t *testing.T) {
+	setup()
+
+	now := time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC)
+
+	var output bytes.Buffer
+
+	assert.Nil(t, runCustomersListing(db.ListAllowed, "7", "internal test account", "", now, &output))
+	assert.Equal(t, "Customer 7 is allowed\n", output.String())
+
+	for i := 0; i < 5; i++ {
+		response, err := processRecord(Record{ID: uint(i + 1), CustomerID: 7, LoadAmount: 4000, Time: now.Add(time.Duration(i) * time.Minute)})
+
+		assert.Nil(t, err)
+		assert.True(t, response.Accepted)
+		assert.Equal(t, reasonAllowed, response.Reason)
+	}
+
+	output.Reset()
+	assert.Nil(t, runCustomersUnblock("7", &output))
+	assert.Equal(t, "Customer 7 is no longer listed\n", output.String())
+
+	response, err := processRecord(Record{ID: 6, CustomerID: 7, LoadAmount: 4000, Time: now.Add(time.Hour)})
+
+	assert.Nil(t, err)
+	assert.False(t, response.Accepted)
+	assert.Equal(t, reasonDailyAmount, response.Reason)
+}
+
+func TestRunCustomersListing_Invalid_ShouldReturnError(t *testing.T) {
+	setup()
+
+	now := time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC)
+
+	tests := map[string][]string{
+		"invalid customer id abc":                                                           {"abc", "fraud", ""},
+		"the reason of the listing is required, set it with --reason":                       {"1", "", ""},
+		"invalid expiry soon, expected a positive duration such as 30d or an RFC 3339 time": {"1", "fraud", "soon"},
+		"expiry 2020-01-01T00:00:00Z is not in the future":                                  {"1", "fraud", "2020-01-01T00:00:00Z"},
+		"invalid expiry -1d, expected a positive duration such as 30d or an RFC 3339 time":  {"1", "fraud", "-1d"},
+	}
+
+	for expected, args := range tests {
+		err := runCustomersListing(db.ListBlocked, args[0], args[1], args[2], now, ioutil.Discard)
+
+		if assert.NotNil(t, err, expected) {
+			assert.Equal(t, expected, err.Error())
+		}
+	}
+
+	err := runCustomersUnblock("1", ioutil.Discard)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "customer 1 is not on the blocklist or the allowlist", err.Error())
+}
@@ -0,0 +1,260 @@
+package commands
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/dragosv/velocity/db"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+type exportRecord struct {
+	ID            uint      `json:"id"`
+	CustomerID    uint      `json:"customer_id"`
+	LoadAmount    float64   `json:"load_amount"`
+	Time          time.Time `json:"time"`
+	Year          uint      `json:"year"`
+	Month         uint      `json:"month"`
+	Day           uint      `json:"day"`
+	Week          uint      `json:"week"`
+	FundingSource string    `json:"funding_source,omitempty"`
+	MerchantID    string    `json:"merchant_id,omitempty"`
+}
+
+type parquetRecord struct {
+	ID            int64   `parquet:"name=id, type=INT64"`
+	CustomerID    int64   `parquet:"name=customer_id, type=INT64"`
+	LoadAmount    float64 `parquet:"name=load_amount, type=DOUBLE"`
+	Time          int64   `parquet:"name=time, type=TIMESTAMP_MILLIS"`
+	Year          int32   `parquet:"name=year, type=INT32"`
+	Month         int32   `parquet:"name=month, type=INT32"`
+	Day           int32   `parquet:"name=day, type=INT32"`
+	Week          int32   `parquet:"name=week, type=INT32"`
+	FundingSource string  `parquet:"name=funding_source, type=UTF8"`
+	MerchantID    string  `parquet:"name=merchant_id, type=UTF8"`
+}
+
+var csvHeader = []string{"id", "customer_id", "load_amount", "time", "year", "month", "day", "week", "funding_source", "merchant_id"}
+
+// exportWriter writes the exported transactions in one of the export formats.
+type exportWriter interface {
+	Write(transaction db.Transaction) error
+	Close() error
+}
+
+var (
+	exportFrom     string
+	exportTo       string
+	exportCustomer uint
+	exportFormat   string
+	exportOutput   string
+
+	exportCommand = &cobra.Command{
+		Use:   "export",
+		Short: "Export the accepted transactions",
+		Long: `Streams the accepted transactions, with their year, month, day and week buckets, as NDJSON, CSV or Parquet.
+The authorized loads are exported once they are captured, and the voided or expired ones never are.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fs = afero.NewOsFs()
+
+			filter, err := newExportFilter(exportFrom, exportTo)
+			if err != nil {
+				return err
+			}
+
+			if cmd.Flags().Changed("customer") {
+				filter.CustomerID = &exportCustomer
+			}
+
+			store, err = openStore(databaseDialect, databaseConnection)
+			if err != nil {
+				return errors.New("failed to connect database " + err.Error())
+			}
+			defer store.Close()
+
+			return runExport(filter, exportFormat, exportOutput)
+		},
+	}
+)
+
+func init() {
+	exportCommand.Flags().StringVarP(&exportFrom, "from", "", "", "Export the transactions made from this time, as RFC 3339 or YYYY-MM-DD")
+	exportCommand.Flags().StringVarP(&exportTo, "to", "", "", "Export the transactions made before this time, as RFC 3339 or YYYY-MM-DD")
+	exportCommand.Flags().UintVarP(&exportCustomer, "customer", "", 0, "Export the transactions of this customer only")
+	exportCommand.Flags().StringVarP(&exportFormat, "format", "f", "ndjson", "Export format: ndjson, csv or parquet")
+	exportCommand.Flags().StringVarP(&exportOutput, "output", "o", "-", "File to export to, - for the standard output")
+
+	bindCommandConfig(exportCommand)
+
+	rootCmd.AddCommand(exportCommand)
+}
+
+// parseTime parses a time given as RFC 3339 or as a date, which is taken as midnight UTC.
+func parseTime(value string) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+
+	return time.Parse("2006-01-02", value)
+}
+
+func newExportFilter(from string, to string) (filter db.TransactionFilter, err error) {
+	if from != "" {
+		if filter.From, err = parseTime(from); err != nil {
+			return
+		}
+	}
+
+	if to != "" {
+		if filter.To, err = parseTime(to); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func runExport(filter db.TransactionFilter, format string, output string) error {
+	var file io.Writer = os.Stdout
+
+	if output != "-" {
+		outputFile, err := fs.OpenFile(output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer outputFile.Close()
+
+		file = outputFile
+	}
+
+	exporter, err := newExportWriter(format, file)
+	if err != nil {
+		return err
+	}
+
+	// Scan leaves out the released reservations, but not the authorized loads, which may still be voided.
+	err = store.Scan(filter, func(transaction db.Transaction) error {
+		if transaction.State == db.StateAuthorized {
+			return nil
+		}
+
+		return exporter.Write(transaction)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return exporter.Close()
+}
+
+func newExportWriter(format string, file io.Writer) (exportWriter, error) {
+	switch format {
+	case "ndjson":
+		return &ndjsonExportWriter{encoder: json.NewEncoder(file)}, nil
+	case "csv":
+		csvWriter := csv.NewWriter(file)
+		if err := csvWriter.Write(csvHeader); err != nil {
+			return nil, err
+		}
+
+		return &csvExportWriter{writer: csvWriter}, nil
+	case "parquet":
+		parquetWriter, err := writer.NewParquetWriterFromWriter(file, new(parquetRecord), 1)
+		if err != nil {
+			return nil, err
+		}
+
+		// Flush a row group every 8 MB, so that large exports are not buffered in memory.
+		parquetWriter.RowGroupSize = 8 * 1024 * 1024
+
+		return &parquetExportWriter{writer: parquetWriter}, nil
+	}
+
+	return nil, errors.New("unknown export format " + format)
+}
+
+func newExportRecord(transaction db.Transaction) exportRecord {
+	return exportRecord{
+		ID:            transaction.TransactionID,
+		CustomerID:    transaction.CustomerID,
+		LoadAmount:    transaction.LoadAmount,
+		Time:          transaction.Time.UTC(),
+		Year:          transaction.Year,
+		Month:         transaction.Month,
+		Day:           transaction.Day,
+		Week:          transaction.Week,
+		FundingSource: transaction.FundingSource,
+		MerchantID:    transaction.MerchantID,
+	}
+}
+
+type ndjsonExportWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *ndjsonExportWriter) Write(transaction db.Transaction) error {
+	return w.encoder.Encode(newExportRecord(transaction))
+}
+
+func (w *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+}
+
+func (w *csvExportWriter) Write(transaction db.Transaction) error {
+	record := newExportRecord(transaction)
+
+	return w.writer.Write([]string{
+		strconv.FormatUint(uint64(record.ID), 10),
+		strconv.FormatUint(uint64(record.CustomerID), 10),
+		strconv.FormatFloat(record.LoadAmount, 'f', 2, 64),
+		record.Time.Format(time.RFC3339Nano),
+		strconv.FormatUint(uint64(record.Year), 10),
+		strconv.FormatUint(uint64(record.Month), 10),
+		strconv.FormatUint(uint64(record.Day), 10),
+		strconv.FormatUint(uint64(record.Week), 10),
+		record.FundingSource,
+		record.MerchantID,
+	})
+}
+
+func (w *csvExportWriter) Close() error {
+	w.writer.Flush()
+
+	return w.writer.Error()
+}
+
+type parquetExportWriter struct {
+	writer *writer.ParquetWriter
+}
+
+func (w *parquetExportWriter) Write(transaction db.Transaction) error {
+	record := newExportRecord(transaction)
+
+	return w.writer.Write(parquetRecord{
+		ID:            int64(record.ID),
+		CustomerID:    int64(record.CustomerID),
+		LoadAmount:    record.LoadAmount,
+		Time:          record.Time.UnixNano() / int64(time.Millisecond),
+		Year:          int32(record.Year),
+		Month:         int32(record.Month),
+		Day:           int32(record.Day),
+		Week:          int32(record.Week),
+		FundingSource: record.FundingSource,
+		MerchantID:    record.MerchantID,
+	})
+}
+
+func (w *parquetExportWriter) Close() error {
+	return w.writer.WriteStop()
+}
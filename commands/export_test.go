@@ -0,0 +1,135 @@
+package commands
+
+import (
+	"context"
+	"github.com/dragosv/velocity/db"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func setupExport(t *testing.T) {
+	setup()
+
+	if _, ok := store.(*db.RedisStore); ok {
+		t.Skip("redis does not keep the transaction history")
+	}
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	_, err := processRecords([]Record{
+		{ID: 1, CustomerID: 2, LoadAmount: 100, Time: startDate, FundingSource: "fp-9", MerchantID: "m-1"},
+		{ID: 2, CustomerID: 1, LoadAmount: 200.5, Time: startDate.AddDate(0, 0, 1), MerchantID: "m-2"},
+		{ID: 3, CustomerID: 1, LoadAmount: 300, Time: startDate.AddDate(0, 0, 2)},
+		{ID: 4, CustomerID: 1, LoadAmount: 400, Time: startDate.AddDate(0, 0, 3)},
+	})
+
+	assert.Nil(t, err)
+}
+
+func TestRunExport_Ndjson_ShouldExportSelectedTransactions(t *testing.T) {
+	setupExport(t)
+
+	filter, err := newExportFilter("2020-11-10", "2020-11-12")
+	assert.Nil(t, err)
+
+	assert.Nil(t, runExport(filter, "ndjson", destination))
+
+	outputText, err := readAllText(destination)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"id\":2,\"customer_id\":1,\"load_amount\":200.5,\"time\":\"2020-11-10T03:51:48Z\",\"year\":2020,\"month\":11,\"day\":10,\"week\":46,\"merchant_id\":\"m-2\"}\n"+
+		"{\"id\":3,\"customer_id\":1,\"load_amount\":300,\"time\":\"2020-11-11T03:51:48Z\",\"year\":2020,\"month\":11,\"day\":11,\"week\":46}", outputText)
+}
+
+func TestRunExport_CsvForCustomer_ShouldExportCustomerTransactions(t *testing.T) {
+	setupExport(t)
+
+	customerID := uint(2)
+
+	assert.Nil(t, runExport(db.TransactionFilter{CustomerID: &customerID}, "csv", destination))
+
+	outputText, err := readAllText(destination)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "id,customer_id,load_amount,time,year,month,day,week,funding_source,merchant_id\n"+
+		"1,2,100.00,2020-11-09T03:51:48Z,2020,11,9,46,fp-9,m-1", outputText)
+}
+
+func TestRunExport_CsvImported_ShouldKeepDimensions(t *testing.T) {
+	setupExport(t)
+
+	assert.Nil(t, runExport(db.TransactionFilter{}, "csv", destination))
+
+	content, err := afero.ReadFile(fs, destination)
+	assert.Nil(t, err)
+
+	openTestDatabase()
+
+	filename := source + ".csv"
+	assert.Nil(t, afero.WriteFile(fs, filename, content, 0644))
+
+	imported, _, err := runImport(filename, "")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 4, imported)
+
+	usage, err := store.SumAndCountBy(db.DimensionMerchant, "m-1", db.WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, db.Usage{Total: 100, Count: 1}, usage)
+
+	transaction, err := store.FindByLoadID(2, 1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "fp-9", transaction.FundingSource)
+}
+
+func TestRunExport_Parquet_ShouldWriteParquetFile(t *testing.T) {
+	setupExport(t)
+
+	assert.Nil(t, runExport(db.TransactionFilter{}, "parquet", destination))
+
+	content, err := afero.ReadFile(fs, destination)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "PAR1", string(content[:4]))
+	assert.Equal(t, "PAR1", string(content[len(content)-4:]))
+}
+
+func TestRunExport_Reservations_ShouldExportCapturedLoadsOnly(t *testing.T) {
+	setupExport(t)
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+	reservedUntil := time.Now().Add(time.Hour)
+
+	for i := uint(5); i <= 7; i++ {
+		response, err := processRecord(Record{ID: i, CustomerID: 3, LoadAmount: 100, Time: startDate, ReservedUntil: reservedUntil})
+
+		assert.Nil(t, err)
+		assert.True(t, response.Accepted)
+	}
+
+	_, err := finalizeReservation(context.Background(), 3, 6, db.StateSettled, time.Now())
+	assert.Nil(t, err)
+
+	_, err = finalizeReservation(context.Background(), 3, 7, db.StateVoided, time.Now())
+	assert.Nil(t, err)
+
+	customerID := uint(3)
+
+	assert.Nil(t, runExport(db.TransactionFilter{CustomerID: &customerID}, "csv", destination))
+
+	outputText, err := readAllText(destination)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "id,customer_id,load_amount,time,year,month,day,week,funding_source,merchant_id\n"+
+		"6,3,100.00,2020-11-09T03:51:48Z,2020,11,9,46,,", outputText)
+}
+
+func TestRunExport_UnknownFormat_ShouldFail(t *testing.T) {
+	setupExport(t)
+
+	assert.NotNil(t, runExport(db.TransactionFilter{}, "xml", destination))
+}
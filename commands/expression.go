@@ -0,0 +1,891 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Rule expressions are the boolean conditions of the custom rules, such as
+//
+//	load_amount > 1000 && count(1h, load_amount > 1000) >= 2
+//	load_amount > $3000 && account_age() < 7d && count(7d, load_amount > 3000) == 0
+//
+//	sum_by(platform, day) + load_amount > 1000000
+//
+// They are compiled once, with their types checked, and can only read the load and the accepted loads:
+// there are no assignments, loops or calls other than the aggregates below.
+//
+// Fields of a load: id, customer_id, load_amount, hour (0 to 23), weekday (0 for Sunday to 6), and the
+// strings funding_source and merchant_id, empty when the load does not have them.
+//
+// Aggregates over the accepted loads of the customer within a window before the load, such as 30m, 1h, 7d
+// or 2w, with an optional condition on each of those loads, whose fields then refer to that load:
+//
+//	count(window[, condition])  number of loads
+//	sum(window[, condition])    total amount
+//	account_age()               time since the first accepted load of the customer, 0 for the first load
+//
+// The accepted loads sharing a dimension with the load within its calendar day or ISO week, the windows of
+// the limits: customer, funding_source, merchant, or platform for all the loads. They are 0 when the load does
+// not have the dimension. The stores keep their usage as the loads are saved, like the usage of the limits.
+//
+//	count_by(dimension, day|week)
+//	sum_by(dimension, day|week)
+//
+// The rolling aggregates and account_age read the saved loads, which the redis dialect does not keep, so the
+// rules using them are rejected with it. Prune keeps the loads of the longest window of the rules, and refuses
+// to prune while a rule reads account_age, which needs the first load of every customer.
+
+const (
+	maxExpressionLength = 4096
+	maxExpressionDepth  = 64
+)
+
+type valueType int
+
+const (
+	numberType valueType = iota
+	boolType
+	stringType
+	durationType
+)
+
+func (t valueType) String() string {
+	switch t {
+	case numberType:
+		return "number"
+	case boolType:
+		return "boolean"
+	case stringType:
+		return "string"
+	default:
+		return "duration"
+	}
+}
+
+// ruleLoad is the load the fields of an expression refer to.
+type ruleLoad struct {
+	ID            uint
+	CustomerID    uint
+	LoadAmount    float64
+	Time          time.Time
+	FundingSource string
+	MerchantID    string
+}
+
+// expressionEnv is what an expression is evaluated against.
+type expressionEnv struct {
+	store db.TransactionStore
+	// current is the load being checked, and load the one the fields refer to.
+	current ruleLoad
+	load    ruleLoad
+}
+
+type expressionNode interface {
+	Type() valueType
+	Eval(env *expressionEnv) (interface{}, error)
+}
+
+type literalNode struct {
+	value     interface{}
+	valueType valueType
+}
+
+func (n *literalNode) Type() valueType { return n.valueType }
+
+func (n *literalNode) Eval(env *expressionEnv) (interface{}, error) { return n.value, nil }
+
+type fieldNode struct {
+	valueType valueType
+	get       func(env *expressionEnv) interface{}
+}
+
+func (n *fieldNode) Type() valueType { return n.valueType }
+
+func (n *fieldNode) Eval(env *expressionEnv) (interface{}, error) { return n.get(env), nil }
+
+// loadFields are the fields of a load.
+var loadFields = map[string]*fieldNode{
+	"id":             {numberType, func(env *expressionEnv) interface{} { return float64(env.load.ID) }},
+	"customer_id":    {numberType, func(env *expressionEnv) interface{} { return float64(env.load.CustomerID) }},
+	"load_amount":    {numberType, func(env *expressionEnv) interface{} { return env.load.LoadAmount }},
+	"hour":           {numberType, func(env *expressionEnv) interface{} { return float64(env.load.Time.Hour()) }},
+	"weekday":        {numberType, func(env *expressionEnv) interface{} { return float64(env.load.Time.Weekday()) }},
+	"funding_source": {stringType, func(env *expressionEnv) interface{} { return env.load.FundingSource }},
+	"merchant_id":    {stringType, func(env *expressionEnv) interface{} { return env.load.MerchantID }},
+}
+
+// The dimensions the loads can be aggregated by.
+const (
+	dimensionCustomer      = "customer"
+	dimensionFundingSource = db.DimensionFundingSource
+	dimensionMerchant      = db.DimensionMerchant
+	dimensionPlatform      = db.DimensionPlatform
+)
+
+var (
+	dimensions   = []string{dimensionCustomer, dimensionFundingSource, dimensionMerchant, dimensionPlatform}
+	usageWindows = []string{db.WindowDay, db.WindowWeek}
+)
+
+type unaryNode struct {
+	operator string
+	operand  expressionNode
+}
+
+func (n *unaryNode) Type() valueType { return n.operand.Type() }
+
+func (n *unaryNode) Eval(env *expressionEnv) (interface{}, error) {
+	value, err := n.operand.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.operator == "!" {
+		return !value.(bool), nil
+	}
+
+	return -value.(float64), nil
+}
+
+type binaryNode struct {
+	operator    string
+	left, right expressionNode
+	valueType   valueType
+}
+
+func (n *binaryNode) Type() valueType { return n.valueType }
+
+func (n *binaryNode) Eval(env *expressionEnv) (interface{}, error) {
+	left, err := n.left.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// The logical operators short-circuit, so that cheap conditions can spare the aggregates.
+	switch n.operator {
+	case "&&":
+		if !left.(bool) {
+			return false, nil
+		}
+
+		return n.right.Eval(env)
+	case "||":
+		if left.(bool) {
+			return true, nil
+		}
+
+		return n.right.Eval(env)
+	}
+
+	right, err := n.right.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.operator {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	case "+":
+		return left.(float64) + right.(float64), nil
+	case "-":
+		return left.(float64) - right.(float64), nil
+	case "*":
+		return left.(float64) * right.(float64), nil
+	case "/":
+		if right.(float64) == 0 {
+			return nil, errors.New("division by zero")
+		}
+
+		return left.(float64) / right.(float64), nil
+	}
+
+	return compareValues(n.operator, left, right), nil
+}
+
+// compareValues orders two numbers or two durations.
+func compareValues(operator string, left interface{}, right interface{}) bool {
+	var a, b float64
+
+	switch left := left.(type) {
+	case time.Duration:
+		a, b = float64(left), float64(right.(time.Duration))
+	default:
+		a, b = left.(float64), right.(float64)
+	}
+
+	switch operator {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	default:
+		return a >= b
+	}
+}
+
+// aggregateNode counts or sums the accepted loads of the customer within the window before the load.
+type aggregateNode struct {
+	function  string
+	window    expressionNode
+	condition expressionNode
+}
+
+func (n *aggregateNode) Type() valueType { return numberType }
+
+func (n *aggregateNode) Eval(env *expressionEnv) (interface{}, error) {
+	value, err := n.window.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	window := value.(time.Duration)
+	if window <= 0 {
+		return nil, fmt.Errorf("%s window must be positive, not %v", n.function, window)
+	}
+
+	customerID := env.current.CustomerID
+	filter := db.TransactionFilter{From: env.current.Time.Add(-window).UTC(), To: env.current.Time.UTC(), CustomerID: &customerID}
+
+	count, total := 0.0, 0.0
+
+	err = env.store.Scan(filter, func(transaction db.Transaction) error {
+		if n.condition != nil {
+			loadEnv := *env
+			loadEnv.load = ruleLoadOf(transaction)
+
+			matches, err := n.condition.Eval(&loadEnv)
+			if err != nil || !matches.(bool) {
+				return err
+			}
+		}
+
+		count++
+		total += transaction.LoadAmount
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if n.function == "count" {
+		return count, nil
+	}
+
+	return roundAmount(total), nil
+}
+
+// usageNode counts or sums the accepted loads sharing the dimension with the load, within the calendar
+// window of the load.
+type usageNode struct {
+	function  string
+	dimension string
+	kind      string
+}
+
+func (n *usageNode) Type() valueType { return numberType }
+
+func (n *usageNode) Eval(env *expressionEnv) (interface{}, error) {
+	key := db.WindowKey(n.kind, env.current.Time)
+
+	var usage db.Usage
+	var err error
+
+	switch n.dimension {
+	case dimensionCustomer:
+		usage, err = env.store.SumAndCount(env.current.CustomerID, n.kind, key)
+	case dimensionPlatform:
+		usage, err = env.store.SumAndCountBy(n.dimension, "", n.kind, key)
+	default:
+		value := env.current.FundingSource
+		if n.dimension == dimensionMerchant {
+			value = env.current.MerchantID
+		}
+
+		if value == "" {
+			return 0.0, nil
+		}
+
+		usage, err = env.store.SumAndCountBy(n.dimension, value, n.kind, key)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if n.function == "count_by" {
+		return float64(usage.Count), nil
+	}
+
+	return roundAmount(usage.Total), nil
+}
+
+// accountAgeNode is the time since the first accepted load of the customer.
+type accountAgeNode struct{}
+
+func (n *accountAgeNode) Type() valueType { return durationType }
+
+// readsHistory reports whether the expression aggregates the saved loads or reads the account age,
+// which the stores without the transaction history cannot answer.
+func readsHistory(node expressionNode) bool {
+	switch n := node.(type) {
+	case *aggregateNode, *accountAgeNode:
+		return true
+	case *unaryNode:
+		return readsHistory(n.operand)
+	case *binaryNode:
+		return readsHistory(n.left) || readsHistory(n.right)
+	}
+
+	return false
+}
+
+// historyReach returns the longest window of the aggregates of the expression, and whether the expression
+// reads the whole history of the customer: the account age, or an aggregate whose window is not a constant.
+func historyReach(node expressionNode) (longest time.Duration, whole bool) {
+	switch n := node.(type) {
+	case *accountAgeNode:
+		return 0, true
+	case *aggregateNode:
+		longest, whole = historyReach(n.window)
+
+		if window, ok := n.window.(*literalNode); ok {
+			if duration := window.value.(time.Duration); duration > longest {
+				longest = duration
+			}
+		} else {
+			whole = true
+		}
+
+		if n.condition != nil {
+			conditionLongest, conditionWhole := historyReach(n.condition)
+			if conditionLongest > longest {
+				longest = conditionLongest
+			}
+
+			whole = whole || conditionWhole
+		}
+	case *unaryNode:
+		return historyReach(n.operand)
+	case *binaryNode:
+		longest, whole = historyReach(n.left)
+
+		rightLongest, rightWhole := historyReach(n.right)
+		if rightLongest > longest {
+			longest = rightLongest
+		}
+
+		whole = whole || rightWhole
+	}
+
+	return
+}
+
+var errStopScan = errors.New("stop scan")
+
+func (n *accountAgeNode) Eval(env *expressionEnv) (interface{}, error) {
+	customerID := env.current.CustomerID
+
+	var first *time.Time
+
+	err := env.store.Scan(db.TransactionFilter{To: env.current.Time.UTC(), CustomerID: &customerID}, func(transaction db.Transaction) error {
+		first = &transaction.Time
+		return errStopScan
+	})
+
+	if err != nil && err != errStopScan {
+		return nil, err
+	}
+
+	if first == nil {
+		return time.Duration(0), nil
+	}
+
+	return env.current.Time.Sub(*first), nil
+}
+
+func ruleLoadOf(transaction db.Transaction) ruleLoad {
+	return ruleLoad{
+		ID:            transaction.TransactionID,
+		CustomerID:    transaction.CustomerID,
+		LoadAmount:    transaction.LoadAmount,
+		Time:          transaction.Time,
+		FundingSource: transaction.FundingSource,
+		MerchantID:    transaction.MerchantID,
+	}
+}
+
+// compileExpression parses the expression and checks its types, requiring a boolean condition.
+func compileExpression(source string) (expressionNode, error) {
+	if len(source) > maxExpressionLength {
+		return nil, fmt.Errorf("expression longer than %d characters", maxExpressionLength)
+	}
+
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &expressionParser{tokens: tokens}
+
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := parser.peek(); token.kind != tokenEnd {
+		return nil, token.errorf("unexpected %s", token)
+	}
+
+	if node.Type() != boolType {
+		return nil, fmt.Errorf("expression is a %s, not a condition", node.Type())
+	}
+
+	return node, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenDuration
+	tokenString
+	tokenIdentifier
+	tokenOperator
+)
+
+type expressionToken struct {
+	kind   tokenKind
+	text   string
+	value  interface{}
+	column int
+}
+
+func (t expressionToken) String() string {
+	if t.kind == tokenEnd {
+		return "end of expression"
+	}
+
+	return strconv.Quote(t.text)
+}
+
+func (t expressionToken) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", t.column, fmt.Sprintf(format, args...))
+}
+
+var (
+	expressionOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "(", ")", ","}
+
+	expressionKeywords = map[string]string{"and": "&&", "or": "||", "not": "!"}
+
+	durationUnits = map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+)
+
+func isIdentifierRune(r byte) bool {
+	return r == '_' || unicode.IsLetter(rune(r)) || unicode.IsDigit(rune(r))
+}
+
+func tokenize(source string) ([]expressionToken, error) {
+	var tokens []expressionToken
+
+	for i := 0; i < len(source); {
+		c := source[i]
+		column := i + 1
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '$' || (c >= '0' && c <= '9') || (c == '.' && i+1 < len(source) && source[i+1] >= '0' && source[i+1] <= '9'):
+			start := i
+			if c == '$' {
+				i++
+			}
+
+			digits := i
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.') {
+				i++
+			}
+
+			number, err := strconv.ParseFloat(source[digits:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("column %d: invalid number %q", column, source[start:i])
+			}
+
+			if i < len(source) && isIdentifierRune(source[i]) {
+				unit, isUnit := durationUnits[source[i]]
+				if !isUnit || c == '$' || (i+1 < len(source) && isIdentifierRune(source[i+1])) {
+					return nil, fmt.Errorf("column %d: invalid number %q, durations end with s, m, h, d or w", column, source[start:i+1])
+				}
+
+				i++
+				tokens = append(tokens, expressionToken{kind: tokenDuration, text: source[start:i], value: time.Duration(number * float64(unit)), column: column})
+
+				continue
+			}
+
+			tokens = append(tokens, expressionToken{kind: tokenNumber, text: source[start:i], value: number, column: column})
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(source[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("column %d: unterminated string", column)
+			}
+
+			text := source[i : i+end+2]
+			tokens = append(tokens, expressionToken{kind: tokenString, text: text, value: text[1 : len(text)-1], column: column})
+			i += end + 2
+		case isIdentifierRune(c):
+			start := i
+			for i < len(source) && isIdentifierRune(source[i]) {
+				i++
+			}
+
+			text := source[start:i]
+			if operator, isKeyword := expressionKeywords[strings.ToLower(text)]; isKeyword {
+				tokens = append(tokens, expressionToken{kind: tokenOperator, text: operator, column: column})
+				continue
+			}
+
+			tokens = append(tokens, expressionToken{kind: tokenIdentifier, text: text, column: column})
+		default:
+			operator := ""
+			for _, candidate := range expressionOperators {
+				if strings.HasPrefix(source[i:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+
+			if operator == "" {
+				return nil, fmt.Errorf("column %d: unexpected character %q", column, c)
+			}
+
+			tokens = append(tokens, expressionToken{kind: tokenOperator, text: operator, column: column})
+			i += len(operator)
+		}
+	}
+
+	return append(tokens, expressionToken{kind: tokenEnd, column: len(source) + 1}), nil
+}
+
+type expressionParser struct {
+	tokens   []expressionToken
+	position int
+	depth    int
+	// aggregating is set while parsing the condition of an aggregate, which cannot contain another one.
+	aggregating bool
+}
+
+func (p *expressionParser) peek() expressionToken {
+	return p.tokens[p.position]
+}
+
+func (p *expressionParser) next() expressionToken {
+	token := p.tokens[p.position]
+	if token.kind != tokenEnd {
+		p.position++
+	}
+
+	return token
+}
+
+// accept consumes the next token when it is one of the operators.
+func (p *expressionParser) accept(operators ...string) (expressionToken, bool) {
+	token := p.peek()
+	if token.kind != tokenOperator {
+		return token, false
+	}
+
+	for _, operator := range operators {
+		if token.text == operator {
+			p.position++
+			return token, true
+		}
+	}
+
+	return token, false
+}
+
+func (p *expressionParser) expect(operator string) error {
+	if token, found := p.accept(operator); !found {
+		return token.errorf("expected %q, found %s", operator, token)
+	}
+
+	return nil
+}
+
+func (p *expressionParser) parseOr() (expressionNode, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *expressionParser) parseAnd() (expressionNode, error) {
+	return p.parseLogical("&&", p.parseComparison)
+}
+
+func (p *expressionParser) parseLogical(operator string, parseOperand func() (expressionNode, error)) (expressionNode, error) {
+	left, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token, found := p.accept(operator)
+		if !found {
+			return left, nil
+		}
+
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		if left.Type() != boolType || right.Type() != boolType {
+			return nil, token.errorf("%s needs conditions, not %s and %s", operator, left.Type(), right.Type())
+		}
+
+		left = &binaryNode{operator: operator, left: left, right: right, valueType: boolType}
+	}
+}
+
+func (p *expressionParser) parseComparison() (expressionNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	token, found := p.accept("==", "!=", "<", "<=", ">", ">=")
+	if !found {
+		return left, nil
+	}
+
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	if left.Type() != right.Type() {
+		return nil, token.errorf("cannot compare a %s with a %s", left.Type(), right.Type())
+	}
+
+	if token.text != "==" && token.text != "!=" && left.Type() != numberType && left.Type() != durationType {
+		return nil, token.errorf("%s needs numbers or durations, not %s", token.text, left.Type())
+	}
+
+	return &binaryNode{operator: token.text, left: left, right: right, valueType: boolType}, nil
+}
+
+func (p *expressionParser) parseAdditive() (expressionNode, error) {
+	return p.parseArithmetic([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *expressionParser) parseMultiplicative() (expressionNode, error) {
+	return p.parseArithmetic([]string{"*", "/"}, p.parseUnary)
+}
+
+func (p *expressionParser) parseArithmetic(operators []string, parseOperand func() (expressionNode, error)) (expressionNode, error) {
+	left, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token, found := p.accept(operators...)
+		if !found {
+			return left, nil
+		}
+
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		if left.Type() != numberType || right.Type() != numberType {
+			return nil, token.errorf("%s needs numbers, not %s and %s", token.text, left.Type(), right.Type())
+		}
+
+		left = &binaryNode{operator: token.text, left: left, right: right, valueType: numberType}
+	}
+}
+
+func (p *expressionParser) parseUnary() (expressionNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	if p.depth > maxExpressionDepth {
+		return nil, p.peek().errorf("expression nested deeper than %d levels", maxExpressionDepth)
+	}
+
+	token, found := p.accept("!", "-")
+	if !found {
+		return p.parsePrimary()
+	}
+
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if token.text == "!" && operand.Type() != boolType {
+		return nil, token.errorf("! needs a condition, not a %s", operand.Type())
+	}
+
+	if token.text == "-" && operand.Type() != numberType {
+		return nil, token.errorf("- needs a number, not a %s", operand.Type())
+	}
+
+	return &unaryNode{operator: token.text, operand: operand}, nil
+}
+
+func (p *expressionParser) parsePrimary() (expressionNode, error) {
+	token := p.next()
+
+	switch token.kind {
+	case tokenNumber:
+		return &literalNode{value: token.value, valueType: numberType}, nil
+	case tokenDuration:
+		return &literalNode{value: token.value, valueType: durationType}, nil
+	case tokenString:
+		return &literalNode{value: token.value, valueType: stringType}, nil
+	case tokenIdentifier:
+		return p.parseIdentifier(token)
+	case tokenOperator:
+		if token.text == "(" {
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			return node, p.expect(")")
+		}
+	}
+
+	return nil, token.errorf("unexpected %s", token)
+}
+
+func (p *expressionParser) parseIdentifier(token expressionToken) (expressionNode, error) {
+	name := strings.ToLower(token.text)
+
+	switch name {
+	case "true", "false":
+		return &literalNode{value: name == "true", valueType: boolType}, nil
+	case "count", "sum", "count_by", "sum_by":
+		return p.parseAggregate(token, name)
+	case "account_age":
+		if p.aggregating {
+			return nil, token.errorf("account_age cannot be used in the condition of an aggregate")
+		}
+
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+
+		return &accountAgeNode{}, p.expect(")")
+	}
+
+	field, isField := loadFields[name]
+	if !isField {
+		return nil, token.errorf("unknown name %s", token.text)
+	}
+
+	return field, nil
+}
+
+func (p *expressionParser) parseAggregate(token expressionToken, function string) (expressionNode, error) {
+	if p.aggregating {
+		return nil, token.errorf("%s cannot be used in the condition of an aggregate", function)
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(function, "_by") {
+		return p.parseUsage(function)
+	}
+
+	node := &aggregateNode{function: function}
+
+	window, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if window.Type() != durationType {
+		return nil, token.errorf("the window of %s must be a duration, not a %s", function, window.Type())
+	}
+
+	node.window = window
+
+	if _, found := p.accept(","); found {
+		p.aggregating = true
+		node.condition, err = p.parseOr()
+		p.aggregating = false
+
+		if err != nil {
+			return nil, err
+		}
+
+		if node.condition.Type() != boolType {
+			return nil, token.errorf("the condition of %s must be a condition, not a %s", function, node.condition.Type())
+		}
+	}
+
+	return node, p.expect(")")
+}
+
+func (p *expressionParser) parseUsage(function string) (expressionNode, error) {
+	node := &usageNode{function: function}
+
+	dimension := p.next()
+	node.dimension = strings.ToLower(dimension.text)
+
+	if dimension.kind != tokenIdentifier || !contains(dimensions, node.dimension) {
+		return nil, dimension.errorf("the dimension of %s must be one of %s, not %s", function, strings.Join(dimensions, ", "), dimension)
+	}
+
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+
+	kind := p.next()
+	node.kind = strings.ToLower(kind.text)
+
+	if kind.kind != tokenIdentifier || !contains(usageWindows, node.kind) {
+		return nil, kind.errorf("the window of %s must be one of %s, not %s", function, strings.Join(usageWindows, ", "), kind)
+	}
+
+	return node, p.expect(")")
+}
+
+func contains(names []string, name string) bool {
+	for _, candidate := range names {
+		if candidate == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// roundAmount keeps the amounts of the expressions to the cent, as the sums of float amounts drift.
+func roundAmount(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"github.com/dragosv/velocity/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func evaluateTestExpression(t *testing.T, store db.TransactionStore, source string, load ruleLoad) bool {
+	node, err := compileExpression(source)
+	assert.Nil(t, err)
+
+	value, err := node.Eval(&expressionEnv{store: store, current: load, load: load})
+	assert.Nil(t, err)
+
+	return value.(bool)
+}
+
+func insertTestLoads(t *testing.T, store db.TransactionStore, customerID uint, start time.Time, amounts ...float64) {
+	for i, amount := range amounts {
+		transaction := newTransaction(Record{ID: uint(i + 1), CustomerID: customerID, LoadAmount: amount, Time: start.Add(time.Duration(i) * 10 * time.Minute)})
+		assert.Nil(t, store.Insert(&transaction))
+	}
+}
+
+func TestCompileExpression_Invalid_ShouldReturnErrorWithColumn(t *testing.T) {
+	tests := map[string]string{
+		"load_amount >":                          "column 14: unexpected end of expression",
+		"load_amount + 1":                        "expression is a number, not a condition",
+		"balance > 1":                            "column 1: unknown name balance",
+		"load_amount > 1h":                       "column 13: cannot compare a number with a duration",
+		"count(1000) > 1":                        "column 1: the window of count must be a duration, not a number",
+		"count(1h, count(1h) > 1) > 1":           "column 11: count cannot be used in the condition of an aggregate",
+		"load_amount > 10x":                      "column 15: invalid number \"10x\", durations end with s, m, h, d or w",
+		"load_amount > 1 && 2":                   "column 17: && needs conditions, not boolean and number",
+		"(load_amount > 1":                       "column 17: expected \")\", found end of expression",
+		"load_amount # 1":                        "column 13: unexpected character '#'",
+		"account_age() < 7d && \"a\" < \"b\"":    "column 27: < needs numbers or durations, not string",
+		"os.Exit(1)":                             "column 3: unexpected character '.'",
+		"load_amount > 1 load_amount":            "column 17: unexpected \"load_amount\"",
+		"!load_amount":                           "column 1: ! needs a condition, not a number",
+		"sum(-1h) > 0":                           "column 5: - needs a number, not a duration",
+		"count(1h, load_amount) > 1":             "column 1: the condition of count must be a condition, not a number",
+		"'unterminated == load_amount":           "column 1: unterminated string",
+		"load_amount > $1h":                      "column 15: invalid number \"$1h\", durations end with s, m, h, d or w",
+		"hour < 6 or hour > 22 and weekday == 0": "",
+		"sum_by(card, day) > 0":                  "column 8: the dimension of sum_by must be one of customer, funding_source, merchant, platform, not \"card\"",
+		"count_by(merchant day) > 0":             "column 19: expected \",\", found \"day\"",
+		"sum_by(platform, 1d) > 0":               "column 18: the window of sum_by must be one of day, week, not \"1d\"",
+		"count_by(merchant, day, hour > 1) > 0":  "column 23: expected \")\", found \",\"",
+		"merchant_id > \"m\"":                    "column 13: > needs numbers or durations, not string",
+		"merchant_id == 1":                       "column 13: cannot compare a string with a number",
+	}
+
+	for source, expected := range tests {
+		_, err := compileExpression(source)
+
+		if expected == "" {
+			assert.Nil(t, err, source)
+			continue
+		}
+
+		if assert.NotNil(t, err, source) {
+			assert.Equal(t, expected, err.Error(), source)
+		}
+	}
+}
+
+func TestCompileExpression_TooDeep_ShouldReturnError(t *testing.T) {
+	source := ""
+	for i := 0; i < 100; i++ {
+		source += "!"
+	}
+
+	_, err := compileExpression(source + "true")
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "nested deeper than 64 levels")
+}
+
+func TestEvaluateExpression_Operators_ShouldFollowPrecedence(t *testing.T) {
+	store := db.NewMemoryStore()
+	load := ruleLoad{ID: 7, CustomerID: 3, LoadAmount: 1500, Time: time.Date(2020, 11, 8, 23, 30, 0, 0, time.UTC)}
+
+	assert.True(t, evaluateTestExpression(t, store, "load_amount > 1000 and not (customer_id == 4)", load))
+	assert.True(t, evaluateTestExpression(t, store, "1 + 2 * 3 == 7 && -load_amount < 0", load))
+	assert.True(t, evaluateTestExpression(t, store, "load_amount / 2 == $750", load))
+	assert.True(t, evaluateTestExpression(t, store, "hour == 23 && weekday == 0 && id == 7", load))
+	assert.True(t, evaluateTestExpression(t, store, "false || true && true", load))
+	assert.False(t, evaluateTestExpression(t, store, "(false || true) && false", load))
+	assert.True(t, evaluateTestExpression(t, store, "90m > 1h && 1w == 7d", load))
+}
+
+func TestEvaluateExpression_Aggregates_ShouldUseHistoryOfCustomer(t *testing.T) {
+	store := db.NewMemoryStore()
+	start := time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC)
+
+	insertTestLoads(t, store, 1, start, 1200, 300, 2500, 100)
+	insertTestLoads(t, store, 2, start, 5000, 5000)
+
+	load := ruleLoad{ID: 10, CustomerID: 1, LoadAmount: 1100, Time: start.Add(50 * time.Minute)}
+
+	assert.True(t, evaluateTestExpression(t, store, "count(1h) == 4", load))
+	assert.True(t, evaluateTestExpression(t, store, "count(1h, load_amount > 1000) == 2", load))
+	assert.True(t, evaluateTestExpression(t, store, "count(30m) == 2 && count(25m) == 1", load))
+	assert.True(t, evaluateTestExpression(t, store, "sum(1h) == 4100", load))
+	assert.True(t, evaluateTestExpression(t, store, "sum(1h, load_amount < 1000) == 400", load))
+	assert.True(t, evaluateTestExpression(t, store, "account_age() == 50m", load))
+
+	newCustomer := ruleLoad{ID: 11, CustomerID: 9, LoadAmount: 4000, Time: start}
+
+	assert.True(t, evaluateTestExpression(t, store, "load_amount > $3000 && account_age() < 7d && count(7d, load_amount > 3000) == 0", newCustomer))
+}
+
+func TestEvaluateExpression_DivisionByZero_ShouldReturnError(t *testing.T) {
+	node, err := compileExpression("load_amount / 0 > 1")
+	assert.Nil(t, err)
+
+	_, err = node.Eval(&expressionEnv{store: db.NewMemoryStore()})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "division by zero", err.Error())
+}
+
+func TestEvaluateExpression_AggregatesByDimension_ShouldUseLoadsSharingDimension(t *testing.T) {
+	store := db.NewMemoryStore()
+	start := time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC)
+
+	loads := []Record{
+		{ID: 1, CustomerID: 1, LoadAmount: 100, FundingSource: "card-a", MerchantID: "m-1"},
+		{ID: 2, CustomerID: 2, LoadAmount: 200, FundingSource: "card-a", MerchantID: "m-2"},
+		{ID: 3, CustomerID: 3, LoadAmount: 400, FundingSource: "card-b", MerchantID: "m-1"},
+		{ID: 4, CustomerID: 1, LoadAmount: 800},
+	}
+
+	for i, load := range loads {
+		load.Time = start.Add(time.Duration(i) * 10 * time.Minute)
+		transaction := newTransaction(load)
+		assert.Nil(t, store.Insert(&transaction))
+	}
+
+	load := ruleLoad{ID: 10, CustomerID: 1, LoadAmount: 50, Time: start.Add(time.Hour), FundingSource: "card-a", MerchantID: "m-1"}
+
+	assert.True(t, evaluateTestExpression(t, store, "sum_by(customer, day) == sum(1d) && sum(1d) == 900", load))
+	assert.True(t, evaluateTestExpression(t, store, "sum_by(funding_source, day) == 300 && count_by(funding_source, week) == 2", load))
+	assert.True(t, evaluateTestExpression(t, store, "sum_by(merchant, day) == 500", load))
+	assert.True(t, evaluateTestExpression(t, store, "sum_by(platform, day) + load_amount == 1550 && count_by(platform, week) == 4", load))
+	assert.True(t, evaluateTestExpression(t, store, "funding_source == \"card-a\" && merchant_id != \"\"", load))
+
+	anonymous := ruleLoad{ID: 11, CustomerID: 4, LoadAmount: 50, Time: start.Add(time.Hour)}
+
+	assert.True(t, evaluateTestExpression(t, store, "count_by(merchant, day) == 0 && sum_by(funding_source, day) == 0", anonymous))
+
+	nextDay := ruleLoad{ID: 12, CustomerID: 1, LoadAmount: 50, Time: start.AddDate(0, 0, 1), MerchantID: "m-1"}
+
+	assert.True(t, evaluateTestExpression(t, store, "sum_by(merchant, day) == 0 && sum_by(merchant, week) == 500", nextDay))
+	assert.True(t, evaluateTestExpression(t, store, "count_by(platform, day) == 0 && sum_by(platform, week) == 1500", nextDay))
+}
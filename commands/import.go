@@ -0,0 +1,310 @@
+package commands
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	importFormat    string
+	importBatchSize int
+
+	importCommand = &cobra.Command{
+		Use:   "import <file>",
+		Short: "Import historical transactions",
+		Long: `Loads historical accepted transactions, as NDJSON or CSV, so that they count toward the limits.
+The rules are not evaluated, and transactions already in the database are skipped.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fs = afero.NewOsFs()
+
+			var err error
+
+			store, err = openStore(databaseDialect, databaseConnection)
+			if err != nil {
+				return errors.New("failed to connect database " + err.Error())
+			}
+			defer store.Close()
+
+			imported, duplicates, err := runImport(args[0], importFormat)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "Imported %d transactions, skipped %d duplicates\n", imported, duplicates)
+
+			return nil
+		},
+	}
+)
+
+func init() {
+	importCommand.Flags().StringVarP(&importFormat, "format", "f", "", "Import format: ndjson or csv, by default from the file extension")
+	importCommand.Flags().IntVarP(&importBatchSize, "batch-size", "", 1000, "Number of transactions to write to the database in one transaction")
+
+	bindCommandConfig(importCommand)
+
+	rootCmd.AddCommand(importCommand)
+}
+
+// recordsFormatOf returns the format of the file from its extension, ignoring a .gz suffix.
+func recordsFormatOf(filename string) string {
+	if strings.HasSuffix(strings.TrimSuffix(filename, ".gz"), ".csv") {
+		return "csv"
+	}
+
+	return "ndjson"
+}
+
+// runImport saves the transactions of the file without evaluating the rules, skipping the ones
+// already saved. It returns the number of imported and skipped transactions.
+func runImport(filename string, format string) (imported int, duplicates int, err error) {
+	if importBatchSize <= 0 {
+		return 0, 0, fmt.Errorf("invalid batch size %d, expected a positive number", importBatchSize)
+	}
+
+	if format == "" {
+		format = recordsFormatOf(filename)
+	}
+
+	next, closeRecords, err := openRecords(filename, format)
+	if err != nil {
+		return
+	}
+	defer closeRecords()
+
+	batch := make([]Record, 0, importBatchSize)
+
+	flush := func() error {
+		batchImported, batchDuplicates, err := importRecords(batch)
+		if err != nil {
+			return err
+		}
+
+		imported += batchImported
+		duplicates += batchDuplicates
+		batch = batch[:0]
+
+		return nil
+	}
+
+	for {
+		record, recordError := next()
+		if recordError == io.EOF {
+			break
+		}
+
+		if recordError != nil {
+			return imported, duplicates, recordError
+		}
+
+		batch = append(batch, record)
+
+		if len(batch) >= importBatchSize {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	err = flush()
+
+	return
+}
+
+// openRecords returns a reader of the records of the file, which is gunzipped when its name ends with .gz.
+// The reader returns io.EOF after the last record.
+func openRecords(filename string, format string) (next func() (Record, error), closeRecords func(), err error) {
+	file, err := fs.Open(filename)
+	if err != nil {
+		return
+	}
+
+	var reader io.Reader = file
+
+	closeRecords = func() {
+		file.Close()
+	}
+
+	if strings.HasSuffix(filename, ".gz") {
+		gzipReader, gzipError := gzip.NewReader(file)
+		if gzipError != nil {
+			file.Close()
+			return nil, nil, gzipError
+		}
+
+		reader = gzipReader
+
+		closeRecords = func() {
+			gzipReader.Close()
+			file.Close()
+		}
+	}
+
+	switch format {
+	case "ndjson":
+		next = ndjsonRecords(reader)
+	case "csv":
+		next, err = csvRecords(reader)
+	default:
+		err = errors.New("unknown format " + format)
+	}
+
+	if err != nil {
+		closeRecords()
+		return nil, nil, err
+	}
+
+	return
+}
+
+// importRecords saves the records that are not saved yet in one database transaction.
+func importRecords(records []Record) (imported int, duplicates int, err error) {
+	err = store.RunInTransaction(func(tx db.TransactionStore) error {
+		imported, duplicates = 0, 0
+
+		for _, record := range records {
+			existing, err := tx.FindByLoadID(record.CustomerID, record.ID)
+			if err != nil {
+				return err
+			}
+
+			if existing != nil {
+				duplicates++
+				continue
+			}
+
+			transaction := newTransaction(record)
+
+			if err := tx.Insert(&transaction); err != nil {
+				return err
+			}
+
+			imported++
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func ndjsonRecords(reader io.Reader) func() (Record, error) {
+	scanner := bufio.NewScanner(reader)
+	line := 0
+
+	return func() (Record, error) {
+		for scanner.Scan() {
+			line++
+
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+
+			record, err := parseRecord(text)
+			if err != nil {
+				return Record{}, fmt.Errorf("line %d: %v", line, err)
+			}
+
+			return record, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return Record{}, err
+		}
+
+		return Record{}, io.EOF
+	}
+}
+
+// csvRecords reads the records of a CSV file with a header naming at least the id, customer_id,
+// load_amount and time columns, and optionally the funding_source and merchant_id columns. The load
+// amount may be prefixed with $.
+func csvRecords(reader io.Reader) (func() (Record, error), error) {
+	csvReader := csv.NewReader(reader)
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	for _, name := range []string{"id", "customer_id", "load_amount", "time"} {
+		if _, found := columns[name]; !found {
+			return nil, errors.New("missing CSV column " + name)
+		}
+	}
+
+	line := 1
+
+	return func() (Record, error) {
+		fields, err := csvReader.Read()
+		if err != nil {
+			return Record{}, err
+		}
+
+		line++
+
+		record, err := parseCsvRecord(columns, fields)
+		if err != nil {
+			return Record{}, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		return record, nil
+	}, nil
+}
+
+func parseCsvRecord(columns map[string]int, fields []string) (Record, error) {
+	id, err := strconv.ParseUint(fields[columns["id"]], 10, 32)
+	if err != nil {
+		return Record{}, err
+	}
+
+	customerID, err := strconv.ParseUint(fields[columns["customer_id"]], 10, 32)
+	if err != nil {
+		return Record{}, err
+	}
+
+	loadAmount, err := strconv.ParseFloat(strings.TrimPrefix(fields[columns["load_amount"]], "$"), 64)
+	if err != nil {
+		return Record{}, err
+	}
+
+	time, err := parseTime(fields[columns["time"]])
+	if err != nil {
+		return Record{}, err
+	}
+
+	return Record{
+		ID:            uint(id),
+		CustomerID:    uint(customerID),
+		LoadAmount:    loadAmount,
+		Time:          time,
+		FundingSource: csvField(columns, fields, "funding_source"),
+		MerchantID:    csvField(columns, fields, "merchant_id"),
+	}, nil
+}
+
+// csvField returns the field of the optional column, empty when the file does not have the column.
+func csvField(columns map[string]int, fields []string, name string) string {
+	i, found := columns[name]
+	if !found || i >= len(fields) {
+		return ""
+	}
+
+	return strings.TrimSpace(fields[i])
+}
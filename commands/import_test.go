@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRunImport_Ndjson_ShouldImportAndSkipDuplicates(t *testing.T) {
+	setup()
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+	assert.Nil(t, store.Insert(&db.Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}))
+
+	afero.WriteFile(fs, source, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$100.00\",\"time\":\"2020-11-09T03:51:48Z\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$4500.00\",\"time\":\"2020-11-09T04:00:00Z\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$4500.00\",\"time\":\"2020-11-09T04:00:00Z\"}\n"+
+		"{\"id\":\"3\",\"customer_id\":\"1\",\"load_amount\":\"$6000.00\",\"time\":\"2020-11-10T04:00:00Z\"}\n"), 0644)
+
+	imported, duplicates, err := runImport(source, "ndjson")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, imported)
+	assert.Equal(t, 2, duplicates)
+
+	usage, err := store.SumAndCount(1, db.WindowDay, "2020-11-09")
+	assert.Nil(t, err)
+	assert.Equal(t, db.Usage{Total: 4600, Count: 2}, usage)
+
+	transaction, err := store.FindByLoadID(1, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2020), transaction.Year)
+	assert.Equal(t, uint(11), transaction.Month)
+	assert.Equal(t, uint(10), transaction.Day)
+	assert.Equal(t, uint(46), transaction.Week)
+
+	responses, err := processRecords([]Record{{ID: 4, CustomerID: 1, LoadAmount: 500, Time: startDate.Add(time.Hour)}})
+	assert.Nil(t, err)
+	assert.False(t, responses[0].Accepted)
+}
+
+func TestRunImport_Csv_ShouldImportByHeader(t *testing.T) {
+	setup()
+
+	filename := source + ".csv"
+
+	afero.WriteFile(fs, filename, []byte("customer_id,id,time,load_amount\n"+
+		"7,1,2020-11-09T03:51:48Z,$150.25\n"+
+		"7,2,2020-11-10,200\n"), 0644)
+
+	imported, duplicates, err := runImport(filename, "")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, imported)
+	assert.Equal(t, 0, duplicates)
+
+	usage, err := store.SumAndCount(7, db.WindowWeek, "2020-W46")
+	assert.Nil(t, err)
+	assert.Equal(t, db.Usage{Total: 350.25, Count: 2}, usage)
+}
+
+func TestRunImport_CsvDimensions_ShouldKeepFundingSourceAndMerchant(t *testing.T) {
+	setup()
+
+	filename := source + ".csv"
+
+	afero.WriteFile(fs, filename, []byte("id,customer_id,load_amount,time,funding_source,merchant_id\n"+
+		"1,7,$150.25,2020-11-09T03:51:48Z,fp-9,m-1\n"+
+		"2,7,$200.00,2020-11-10T03:51:48Z,,\n"), 0644)
+
+	imported, _, err := runImport(filename, "")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, imported)
+
+	transaction, err := store.FindByLoadID(7, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "fp-9", transaction.FundingSource)
+	assert.Equal(t, "m-1", transaction.MerchantID)
+
+	transaction, err = store.FindByLoadID(7, 2)
+	assert.Nil(t, err)
+	assert.Empty(t, transaction.FundingSource)
+	assert.Empty(t, transaction.MerchantID)
+}
+
+func TestRunImport_InvalidBatchSize_ShouldReturnError(t *testing.T) {
+	setup()
+	defer func(size int) { importBatchSize = size }(importBatchSize)
+
+	afero.WriteFile(fs, source, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$100.00\",\"time\":\"2020-11-09T03:51:48Z\"}\n"), 0644)
+
+	for _, size := range []int{0, -1} {
+		importBatchSize = size
+
+		_, _, err := runImport(source, "ndjson")
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, fmt.Sprintf("invalid batch size %d, expected a positive number", size), err.Error())
+		}
+	}
+}
+
+func TestRunImport_GzippedArchive_ShouldImport(t *testing.T) {
+	setup()
+
+	filename := source + ".ndjson.gz"
+
+	file, err := fs.Create(filename)
+	assert.Nil(t, err)
+
+	writer := gzip.NewWriter(file)
+	writer.Write([]byte("{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$100.00\",\"time\":\"2020-11-09T03:51:48Z\"}\n"))
+	writer.Close()
+	file.Close()
+
+	imported, _, err := runImport(filename, "")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, imported)
+}
+
+func TestRunImport_InvalidLine_ShouldReportLine(t *testing.T) {
+	setup()
+
+	afero.WriteFile(fs, source, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$100.00\",\"time\":\"2020-11-09T03:51:48Z\"}\n{\"id\":\"x\"}\n"), 0644)
+
+	_, _, err := runImport(source, "ndjson")
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+}
@@ -0,0 +1,44 @@
+package commands
+
+import (
+	"errors"
+	"github.com/dragosv/velocity/db"
+	"github.com/sirupsen/logrus"
+	"os"
+)
+
+var (
+	logLevel  string
+	logFormat string
+
+	// logger is the logger of the diagnostics of every command, written to the standard error so that
+	// it never mixes with the output of the commands.
+	logger = logrus.New()
+)
+
+func init() {
+	logger.SetOutput(os.Stderr)
+
+	db.SetLogger(logger)
+}
+
+// configureLogger sets the level and the format, text or json, of the logger.
+func configureLogger(level string, format string) error {
+	parsedLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.New("unknown log format " + format)
+	}
+
+	logger.SetLevel(parsedLevel)
+
+	return nil
+}
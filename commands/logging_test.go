@@ -0,0 +1,36 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConfigureLogger_JsonFormat_ShouldWriteJsonEntries(t *testing.T) {
+	defer configureLogger("info", "text")
+
+	var output bytes.Buffer
+
+	original := logger.Out
+	logger.SetOutput(&output)
+	defer logger.SetOutput(original)
+
+	assert.Nil(t, configureLogger("debug", "json"))
+	assert.Equal(t, logrus.DebugLevel, logger.GetLevel())
+
+	logger.WithField("count", 2).Debug("pruned transactions")
+
+	var entry map[string]interface{}
+
+	assert.Nil(t, json.Unmarshal(output.Bytes(), &entry))
+	assert.Equal(t, "pruned transactions", entry["msg"])
+	assert.Equal(t, "debug", entry["level"])
+	assert.Equal(t, 2.0, entry["count"])
+}
+
+func TestConfigureLogger_InvalidOptions_ShouldFail(t *testing.T) {
+	assert.NotNil(t, configureLogger("verbose", "text"))
+	assert.NotNil(t, configureLogger("info", "xml"))
+}
@@ -0,0 +1,235 @@
+package commands
+
+import (
+	"context"
+	"github.com/dragosv/velocity/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"time"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	loadsEvaluated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "velocity_loads_evaluated_total",
+		Help: "Number of loads evaluated.",
+	})
+
+	loadDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "velocity_load_decisions_total",
+		Help: "Number of loads accepted or declined, by the limit that declined them.",
+	}, []string{"decision", "reason"})
+
+	parseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "velocity_parse_errors_total",
+		Help: "Number of loads that could not be parsed.",
+	})
+
+	evaluationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "velocity_evaluation_duration_seconds",
+		Help:    "Time taken to evaluate a load, including its database transaction.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+
+	rulesInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "velocity_rules_info",
+		Help: "Version of the active rule set, as the version label of the only series.",
+	}, []string{"version"})
+
+	ruleReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "velocity_rule_reloads_total",
+		Help: "Number of reloads of the rule set, by result.",
+	}, []string{"result"})
+
+	reservationsFinalized = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "velocity_reservations_finalized_total",
+		Help: "Number of reservations captured, voided or expired, by their final state.",
+	}, []string{"state"})
+
+	usageCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "velocity_usage_cache_hits_total",
+		Help: "Number of reads of the usage of a window answered by the usage already read for the load.",
+	})
+
+	usageCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "velocity_usage_cache_misses_total",
+		Help: "Number of reads of the usage of a window queried from the store.",
+	})
+
+	auditFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "velocity_audit_failures_total",
+		Help: "Number of decisions that could not be written to the audit log.",
+	})
+
+	storeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "velocity_store_operation_duration_seconds",
+		Help:    "Time taken by the operations of the transaction store.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"operation"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(loadsEvaluated, loadDecisions, parseErrors, evaluationDuration, rulesInfo, ruleReloads, reservationsFinalized, usageCacheHits, usageCacheMisses, auditFailures, storeDuration)
+	metricsRegistry.MustRegister(prometheus.NewGoCollector())
+	metricsRegistry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// observeDecision counts the decision of an evaluated load and how long the evaluation took.
+func observeDecision(response Response, duration time.Duration) {
+	loadsEvaluated.Inc()
+	loadDecisions.WithLabelValues(response.Status, response.Reason).Inc()
+	evaluationDuration.Observe(duration.Seconds())
+}
+
+// writeMetricsTextfile writes the metrics in the Prometheus text format, for the node exporter textfile
+// collector. The file is replaced atomically so that the collector never reads a partial file.
+func writeMetricsTextfile(filename string) error {
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		return err
+	}
+
+	temporary := filename + ".tmp"
+
+	file, err := fs.Create(temporary)
+	if err != nil {
+		return err
+	}
+
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(file, family); err != nil {
+			file.Close()
+			fs.Remove(temporary)
+			return err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		fs.Remove(temporary)
+		return err
+	}
+
+	return fs.Rename(temporary, filename)
+}
+
+// instrumentedStore is a TransactionStore measuring the duration of the operations of another store,
+// and tracing them as children of the span of its context.
+type instrumentedStore struct {
+	store db.TransactionStore
+	ctx   context.Context
+}
+
+func newInstrumentedStore(store db.TransactionStore) *instrumentedStore {
+	return &instrumentedStore{store: store, ctx: context.Background()}
+}
+
+// storeWithContext returns the store tracing its operations as children of the span of the context.
+func storeWithContext(ctx context.Context, store db.TransactionStore) db.TransactionStore {
+	if instrumented, ok := store.(*instrumentedStore); ok {
+		store = instrumented.store
+	}
+
+	return &instrumentedStore{store: store, ctx: ctx}
+}
+
+// startOperation starts the span of an operation, and returns the function ending it and measuring its duration.
+func (s *instrumentedStore) startOperation(operation string) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := startSpan(s.ctx, "store."+operation)
+
+	return ctx, func(err error) {
+		storeDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}
+}
+
+func (s *instrumentedStore) RunInTransaction(fn func(store db.TransactionStore) error) (err error) {
+	ctx, end := s.startOperation("transaction")
+	defer func() { end(err) }()
+
+	return s.store.RunInTransaction(func(tx db.TransactionStore) error {
+		return fn(&instrumentedStore{store: tx, ctx: ctx})
+	})
+}
+
+func (s *instrumentedStore) SumAndCount(customerID uint, kind string, key string) (usage db.Usage, err error) {
+	_, end := s.startOperation("sum_and_count")
+	defer func() { end(err) }()
+
+	return s.store.SumAndCount(customerID, kind, key)
+}
+
+func (s *instrumentedStore) SumAndCountBy(dimension string, value string, kind string, key string) (usage db.Usage, err error) {
+	_, end := s.startOperation("sum_and_count_by")
+	defer func() { end(err) }()
+
+	return s.store.SumAndCountBy(dimension, value, kind, key)
+}
+
+func (s *instrumentedStore) Insert(transaction *db.Transaction) (err error) {
+	_, end := s.startOperation("insert")
+	defer func() { end(err) }()
+
+	return s.store.Insert(transaction)
+}
+
+func (s *instrumentedStore) FindByLoadID(customerID uint, loadID uint) (transaction *db.Transaction, err error) {
+	_, end := s.startOperation("find_by_load_id")
+	defer func() { end(err) }()
+
+	return s.store.FindByLoadID(customerID, loadID)
+}
+
+func (s *instrumentedStore) Scan(filter db.TransactionFilter, fn func(transaction db.Transaction) error) (err error) {
+	_, end := s.startOperation("scan")
+	defer func() { end(err) }()
+
+	return s.store.Scan(filter, fn)
+}
+
+func (s *instrumentedStore) Prune(before time.Time, hard bool, archive db.PruneArchive) (count int, err error) {
+	_, end := s.startOperation("prune")
+	defer func() { end(err) }()
+
+	return s.store.Prune(before, hard, archive)
+}
+
+func (s *instrumentedStore) SetState(transaction *db.Transaction, state string) (err error) {
+	_, end := s.startOperation("set_state")
+	defer func() { end(err) }()
+
+	return s.store.SetState(transaction, state)
+}
+
+func (s *instrumentedStore) ScanExpired(at time.Time, fn func(transaction db.Transaction) error) (err error) {
+	_, end := s.startOperation("scan_expired")
+	defer func() { end(err) }()
+
+	return s.store.ScanExpired(at, fn)
+}
+
+func (s *instrumentedStore) FindListing(customerID uint) (listing *db.CustomerListing, err error) {
+	_, end := s.startOperation("find_listing")
+	defer func() { end(err) }()
+
+	return s.store.FindListing(customerID)
+}
+
+func (s *instrumentedStore) SaveListing(listing *db.CustomerListing) (err error) {
+	_, end := s.startOperation("save_listing")
+	defer func() { end(err) }()
+
+	return s.store.SaveListing(listing)
+}
+
+func (s *instrumentedStore) DeleteListing(customerID uint) (deleted bool, err error) {
+	_, end := s.startOperation("delete_listing")
+	defer func() { end(err) }()
+
+	return s.store.DeleteListing(customerID)
+}
+
+func (s *instrumentedStore) Close() error {
+	return s.store.Close()
+}
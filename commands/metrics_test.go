@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProcessRecord_Decisions_ShouldCountByReason(t *testing.T) {
+	setup()
+
+	evaluated := testutil.ToFloat64(loadsEvaluated)
+	accepted := testutil.ToFloat64(loadDecisions.WithLabelValues("accepted", ""))
+	declined := testutil.ToFloat64(loadDecisions.WithLabelValues("declined", reasonDailyAmount))
+
+	records := generateRecords(1)
+	records[0].LoadAmount = 4000
+
+	_, err := processRecord(records[0])
+	assert.Nil(t, err)
+
+	records[0].ID++
+
+	response, err := processRecord(records[0])
+	assert.Nil(t, err)
+	assert.Equal(t, reasonDailyAmount, response.Reason)
+
+	assert.Equal(t, evaluated+2, testutil.ToFloat64(loadsEvaluated))
+	assert.Equal(t, accepted+1, testutil.ToFloat64(loadDecisions.WithLabelValues("accepted", "")))
+	assert.Equal(t, declined+1, testutil.ToFloat64(loadDecisions.WithLabelValues("declined", reasonDailyAmount)))
+}
+
+func TestProcessRecord_UsageReads_ShouldCountCacheHitsAndMisses(t *testing.T) {
+	setup()
+
+	hits := testutil.ToFloat64(usageCacheHits)
+	misses := testutil.ToFloat64(usageCacheMisses)
+
+	response, err := processRecord(generateRecords(1)[0])
+	assert.Nil(t, err)
+	assert.True(t, response.Accepted)
+
+	// The daily amount and count share the usage of the day, and the weekly amount reads the week.
+	assert.Equal(t, hits+1, testutil.ToFloat64(usageCacheHits))
+	assert.Equal(t, misses+2, testutil.ToFloat64(usageCacheMisses))
+
+	recorder := httptest.NewRecorder()
+	newServeHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Contains(t, recorder.Body.String(), "# TYPE velocity_usage_cache_hits_total counter")
+	assert.Contains(t, recorder.Body.String(), "# TYPE velocity_usage_cache_misses_total counter")
+}
+
+func TestServe_Metrics_ShouldExposeParseErrors(t *testing.T) {
+	setup()
+
+	handler := newServeHandler()
+
+	postLoad(handler, "{\"id\":\"x\"}")
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, strings.Contains(recorder.Body.String(), "velocity_parse_errors_total"))
+	assert.True(t, strings.Contains(recorder.Body.String(), "velocity_evaluation_duration_seconds_bucket"))
+}
+
+func TestWriteMetricsTextfile_ShouldWriteTextFormat(t *testing.T) {
+	setup()
+
+	err := writeMetricsTextfile("velocity.prom")
+	assert.Nil(t, err)
+
+	text, err := afero.ReadFile(fs, "velocity.prom")
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(text), "# TYPE velocity_loads_evaluated_total counter"))
+
+	exists, _ := afero.Exists(fs, "velocity.prom.tmp")
+	assert.False(t, exists)
+}
@@ -0,0 +1,157 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/cobra"
+	"io"
+	"time"
+)
+
+var migrateCommand = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage the database schema",
+	Long:  `Applies, reverts and lists the versioned migrations of the database schema.`,
+}
+
+var migrateUpCommand = &cobra.Command{
+	Use:   "up",
+	Short: "Apply the pending migrations",
+	Long:  `Applies, in order, every migration that is not yet applied to the database.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := connectDatabase()
+		if err != nil {
+			return err
+		}
+		defer database.Close()
+
+		return runMigrateUp(database, cmd.OutOrStdout())
+	},
+}
+
+var migrateTarget uint
+
+var migrateDownCommand = &cobra.Command{
+	Use:   "down",
+	Short: "Revert the last applied migration",
+	Long: `Reverts the most recently applied migration of the database, or with --target every applied migration
+above the target version.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := connectDatabase()
+		if err != nil {
+			return err
+		}
+		defer database.Close()
+
+		if cmd.Flags().Changed("target") {
+			return runMigrateDownTo(database, migrateTarget, cmd.OutOrStdout())
+		}
+
+		return runMigrateDown(database, cmd.OutOrStdout())
+	},
+}
+
+var migrateStatusCommand = &cobra.Command{
+	Use:   "status",
+	Short: "List the migrations and whether they are applied",
+	Long:  `Lists every known migration of the database schema and when it was applied.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := connectDatabase()
+		if err != nil {
+			return err
+		}
+		defer database.Close()
+
+		return runMigrateStatus(database, cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	migrateDownCommand.Flags().UintVarP(&migrateTarget, "target", "", 0, "Version to revert the schema to, 0 to revert every migration")
+
+	migrateCommand.AddCommand(migrateUpCommand)
+	migrateCommand.AddCommand(migrateDownCommand)
+	migrateCommand.AddCommand(migrateStatusCommand)
+
+	rootCmd.AddCommand(migrateCommand)
+}
+
+func connectDatabase() (*gorm.DB, error) {
+	database, err := db.ConnectDatabase(databaseDialect, databaseConnection)
+	if err != nil {
+		return nil, errors.New("failed to connect database " + err.Error())
+	}
+
+	return database, nil
+}
+
+func runMigrateUp(database *gorm.DB, output io.Writer) error {
+	applied, err := db.MigrateUp(database)
+
+	for _, migration := range applied {
+		fmt.Fprintf(output, "Applied %d %s\n", migration.Version, migration.Name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		fmt.Fprintln(output, "No pending migrations")
+	}
+
+	return nil
+}
+
+func runMigrateDown(database *gorm.DB, output io.Writer) error {
+	migration, err := db.MigrateDown(database)
+	if err != nil {
+		return err
+	}
+
+	if migration == nil {
+		fmt.Fprintln(output, "No applied migrations")
+		return nil
+	}
+
+	fmt.Fprintf(output, "Reverted %d %s\n", migration.Version, migration.Name)
+
+	return nil
+}
+
+func runMigrateDownTo(database *gorm.DB, version uint, output io.Writer) error {
+	reverted, err := db.MigrateDownTo(database, version)
+
+	for _, migration := range reverted {
+		fmt.Fprintf(output, "Reverted %d %s\n", migration.Version, migration.Name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(reverted) == 0 {
+		fmt.Fprintf(output, "No applied migrations above %d\n", version)
+	}
+
+	return nil
+}
+
+func runMigrateStatus(database *gorm.DB, output io.Writer) error {
+	states, err := db.MigrationStatus(database)
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		if state.Applied {
+			fmt.Fprintf(output, "%d %s applied %s\n", state.Version, state.Name, state.AppliedAt.Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(output, "%d %s pending\n", state.Version, state.Name)
+		}
+	}
+
+	return nil
+}
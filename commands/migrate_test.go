@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	guuid "github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// openMigrateTestDatabase opens an empty database, without any migration applied, and a buffer for the
+// output of the migrate commands.
+func openMigrateTestDatabase(t *testing.T) (*gorm.DB, *bytes.Buffer) {
+	database, err := db.ConnectDatabase("sqlite3", "file:"+guuid.New().String()+"?mode=memory")
+	assert.Nil(t, err)
+
+	database.LogMode(false)
+
+	var feedback bytes.Buffer
+
+	t.Cleanup(func() {
+		database.Close()
+	})
+
+	return database, &feedback
+}
+
+func TestRunMigrateUp_NewDatabase_ShouldApplyAllAndReportStatus(t *testing.T) {
+	database, feedback := openMigrateTestDatabase(t)
+
+	assert.Nil(t, runMigrateStatus(database, feedback))
+
+	for _, migration := range db.Migrations {
+		assert.Contains(t, feedback.String(), fmt.Sprintf("%d %s pending\n", migration.Version, migration.Name))
+	}
+
+	feedback.Reset()
+	assert.Nil(t, runMigrateUp(database, feedback))
+
+	expected := ""
+	for _, migration := range db.Migrations {
+		expected += fmt.Sprintf("Applied %d %s\n", migration.Version, migration.Name)
+	}
+
+	assert.Equal(t, expected, feedback.String())
+
+	feedback.Reset()
+	assert.Nil(t, runMigrateStatus(database, feedback))
+
+	lines := strings.Split(strings.TrimSpace(feedback.String()), "\n")
+	assert.Equal(t, len(db.Migrations), len(lines))
+
+	for i, migration := range db.Migrations {
+		assert.True(t, strings.HasPrefix(lines[i], fmt.Sprintf("%d %s applied ", migration.Version, migration.Name)), lines[i])
+	}
+
+	feedback.Reset()
+	assert.Nil(t, runMigrateUp(database, feedback))
+	assert.Equal(t, "No pending migrations\n", feedback.String())
+}
+
+func TestRunMigrateDown_Target_ShouldRevertAboveTarget(t *testing.T) {
+	database, feedback := openMigrateTestDatabase(t)
+
+	assert.Nil(t, runMigrateUp(database, feedback))
+
+	last := len(db.Migrations) - 1
+	target := db.Migrations[last-2].Version
+
+	feedback.Reset()
+	assert.Nil(t, runMigrateDownTo(database, target, feedback))
+	assert.Equal(t, fmt.Sprintf("Reverted %d %s\nReverted %d %s\n",
+		db.Migrations[last].Version, db.Migrations[last].Name,
+		db.Migrations[last-1].Version, db.Migrations[last-1].Name), feedback.String())
+
+	states, err := db.MigrationStatus(database)
+
+	assert.Nil(t, err)
+	assert.True(t, states[last-2].Applied)
+	assert.False(t, states[last-1].Applied)
+	assert.False(t, states[last].Applied)
+
+	feedback.Reset()
+	assert.Nil(t, runMigrateDownTo(database, target, feedback))
+	assert.Equal(t, fmt.Sprintf("No applied migrations above %d\n", target), feedback.String())
+
+	feedback.Reset()
+	assert.Nil(t, runMigrateDown(database, feedback))
+	assert.Equal(t, fmt.Sprintf("Reverted %d %s\n", db.Migrations[last-2].Version, db.Migrations[last-2].Name), feedback.String())
+
+	feedback.Reset()
+	assert.Nil(t, runMigrateDownTo(database, 0, feedback))
+
+	feedback.Reset()
+	assert.Nil(t, runMigrateDown(database, feedback))
+	assert.Equal(t, "No applied migrations\n", feedback.String())
+}
+
+func TestRunMigrateDown_UnknownTarget_ShouldReturnError(t *testing.T) {
+	database, feedback := openMigrateTestDatabase(t)
+
+	assert.Nil(t, runMigrateUp(database, feedback))
+
+	feedback.Reset()
+	err := runMigrateDownTo(database, 999, feedback)
+
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "unknown migration version 999", err.Error())
+	}
+
+	assert.Empty(t, feedback.String())
+
+	states, err := db.MigrationStatus(database)
+
+	assert.Nil(t, err)
+
+	for _, state := range states {
+		assert.True(t, state.Applied)
+	}
+}
@@ -0,0 +1,190 @@
+package commands
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionMargin is kept on top of the longest window, so that no load still counted toward a limit is pruned.
+const retentionMargin = 24 * time.Hour
+
+var (
+	pruneOlderThan string
+	pruneArchive   string
+	pruneHard      bool
+
+	pruneCommand = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove old transactions",
+		Long: `Removes the transactions older than the retention period, optionally archiving them first. The retention
+must cover the longest window of the limits and the custom rules, and nothing is pruned while a custom rule
+reads account_age or a window that is not constant, which need the whole history of the customers. The voided
+and expired reservations are archived and removed like the settled loads, with their state in the archive. The
+partially approved loads are archived with the amount requested, which replay evaluates, and the amount approved.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fs = afero.NewOsFs()
+
+			var err error
+
+			store, err = openStore(databaseDialect, databaseConnection)
+			if err != nil {
+				return errors.New("failed to connect database " + err.Error())
+			}
+			defer store.Close()
+
+			count, err := runPrune(pruneOlderThan, pruneArchive, pruneHard, time.Now())
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "Pruned %d transactions\n", count)
+
+			return nil
+		},
+	}
+)
+
+func init() {
+	pruneCommand.Flags().StringVarP(&pruneOlderThan, "older-than", "", "90d", "Remove the transactions older than this, e.g. 90d, 12w or 2160h")
+	pruneCommand.Flags().StringVarP(&pruneArchive, "archive", "", "", "Gzipped NDJSON file to archive the removed transactions to")
+	pruneCommand.Flags().BoolVarP(&pruneHard, "hard", "", false, "Delete the transactions instead of marking them as deleted")
+
+	bindCommandConfig(pruneCommand)
+
+	rootCmd.AddCommand(pruneCommand)
+}
+
+// parseRetention parses a duration, also accepting days (d) and weeks (w).
+func parseRetention(value string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+
+	for suffix, unit := range units {
+		if strings.HasSuffix(value, suffix) {
+			count, err := strconv.ParseFloat(strings.TrimSuffix(value, suffix), 64)
+			if err != nil {
+				return 0, errors.New("invalid retention " + value)
+			}
+
+			return time.Duration(count * float64(unit)), nil
+		}
+	}
+
+	return time.ParseDuration(value)
+}
+
+// runPrune removes the transactions older than the retention, archiving them first when archive is set.
+func runPrune(olderThan string, archive string, hard bool, now time.Time) (int, error) {
+	retention, err := parseRetention(olderThan)
+	if err != nil {
+		return 0, err
+	}
+
+	longest, whole := currentRules().historyReach()
+	if len(whole) > 0 {
+		return 0, fmt.Errorf("the rules %s read the whole history of the customers, which pruning would lose", strings.Join(whole, ", "))
+	}
+
+	if longest < db.LongestWindow() {
+		longest = db.LongestWindow()
+	}
+
+	minimum := longest + retentionMargin
+	if retention < minimum {
+		return 0, fmt.Errorf("retention %s is shorter than the longest window plus margin, %s", olderThan, minimum)
+	}
+
+	before := now.Add(-retention)
+
+	if archive == "" {
+		return store.Prune(before, hard, nil)
+	}
+
+	archiveFile, err := fs.OpenFile(archive, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	writer := gzip.NewWriter(archiveFile)
+	count, err := store.Prune(before, hard, &archiveWriter{file: archiveFile, writer: writer, encoder: json.NewEncoder(writer)})
+	if err != nil {
+		// Nothing was removed, so the partial archive is not needed.
+		archiveFile.Close()
+		fs.Remove(archive)
+
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// archiveWriter writes the pruned transactions to a gzipped NDJSON file, which is flushed, synced and closed
+// before the transactions are removed.
+type archiveWriter struct {
+	file    afero.File
+	writer  *gzip.Writer
+	encoder *json.Encoder
+}
+
+func (a *archiveWriter) Archive(transaction db.Transaction) error {
+	return a.encoder.Encode(newArchiveRecord(transaction))
+}
+
+func (a *archiveWriter) Complete() error {
+	if err := a.writer.Close(); err != nil {
+		return err
+	}
+
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+
+	return a.file.Close()
+}
+
+// archiveRecord is an archived transaction: a line of the source file with the requested amount, so that it
+// replays as it was requested, with the amount approved when it was capped and the state of the reservations
+// that were not settled.
+type archiveRecord struct {
+	jsonRecord
+	ApprovedAmount string `json:"approved_amount,omitempty"`
+	State          string `json:"state,omitempty"`
+}
+
+func newArchiveRecord(transaction db.Transaction) archiveRecord {
+	record := archiveRecord{jsonRecord: newJsonRecord(transaction)}
+
+	if transaction.RequestedAmount > 0 && transaction.RequestedAmount != transaction.LoadAmount {
+		record.LoadAmount = formatAmount(transaction.RequestedAmount)
+		record.ApprovedAmount = formatAmount(transaction.LoadAmount)
+	}
+
+	if transaction.State != db.StateSettled {
+		record.State = transaction.State
+	}
+
+	return record
+}
+
+// newJsonRecord formats a transaction as a line of the source file.
+func newJsonRecord(transaction db.Transaction) jsonRecord {
+	return jsonRecord{
+		ID:            strconv.FormatInt(int64(transaction.TransactionID), 10),
+		CustomerID:    strconv.FormatInt(int64(transaction.CustomerID), 10),
+		LoadAmount:    formatAmount(transaction.LoadAmount),
+		Time:          transaction.Time,
+		FundingSource: transaction.FundingSource,
+		MerchantID:    transaction.MerchantID,
+	}
+}
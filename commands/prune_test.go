@@ -0,0 +1,217 @@
+package commands
+
+import (
+	"bufio"
+	"compress/gzip"
+	"github.com/dragosv/velocity/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRunPrune_WithArchive_ShouldArchiveAndRemoveOldTransactions(t *testing.T) {
+	setup()
+
+	if _, ok := store.(*db.RedisStore); ok {
+		t.Skip("redis expires the transactions by itself")
+	}
+
+	now := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	assert.Nil(t, store.Insert(&db.Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: now.AddDate(0, 0, -100)}))
+	assert.Nil(t, store.Insert(&db.Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 200.5, Time: now.AddDate(0, 0, -95)}))
+	assert.Nil(t, store.Insert(&db.Transaction{TransactionID: 3, CustomerID: 1, LoadAmount: 300, Time: now.AddDate(0, 0, -1)}))
+
+	count, err := runPrune("90d", "/velocity/archive.ndjson.gz", true, now)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	archiveFile, err := fs.Open("/velocity/archive.ndjson.gz")
+	assert.Nil(t, err)
+	defer archiveFile.Close()
+
+	reader, err := gzip.NewReader(archiveFile)
+	assert.Nil(t, err)
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	assert.Equal(t, []string{
+		"{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$100.00\",\"time\":\"2020-08-01T03:51:48Z\"}",
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$200.50\",\"time\":\"2020-08-06T03:51:48Z\"}",
+	}, lines)
+
+	transaction, err := store.FindByLoadID(1, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, transaction)
+
+	transaction, err = store.FindByLoadID(1, 3)
+	assert.Nil(t, err)
+	assert.NotNil(t, transaction)
+
+	usage, err := store.SumAndCount(1, db.WindowDay, "2020-08-01")
+	assert.Nil(t, err)
+	assert.Equal(t, db.Usage{}, usage)
+}
+
+func TestRunPrune_ReleasedReservations_ShouldArchiveWithStateAndRemove(t *testing.T) {
+	setup()
+
+	if _, ok := store.(*db.RedisStore); ok {
+		t.Skip("redis expires the transactions by itself")
+	}
+
+	now := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+	states := []string{db.StateSettled, db.StateVoided, db.StateExpired}
+
+	for i, state := range states {
+		transaction := newTransaction(Record{ID: uint(i + 1), CustomerID: 1, LoadAmount: 100, Time: now.AddDate(0, 0, -100+i), ReservedUntil: now.AddDate(0, 0, -99+i)})
+
+		assert.Nil(t, store.Insert(&transaction))
+		assert.Nil(t, store.SetState(&transaction, state))
+	}
+
+	count, err := runPrune("90d", "/velocity/released.ndjson.gz", true, now)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+
+	archiveFile, err := fs.Open("/velocity/released.ndjson.gz")
+	assert.Nil(t, err)
+	defer archiveFile.Close()
+
+	reader, err := gzip.NewReader(archiveFile)
+	assert.Nil(t, err)
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	assert.Equal(t, []string{
+		"{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$100.00\",\"time\":\"2020-08-01T03:51:48Z\"}",
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$100.00\",\"time\":\"2020-08-02T03:51:48Z\",\"state\":\"voided\"}",
+		"{\"id\":\"3\",\"customer_id\":\"1\",\"load_amount\":\"$100.00\",\"time\":\"2020-08-03T03:51:48Z\",\"state\":\"expired\"}",
+	}, lines)
+
+	for i := range states {
+		transaction, err := store.FindByLoadID(1, uint(i+1))
+
+		assert.Nil(t, err)
+		assert.Nil(t, transaction)
+	}
+}
+
+func TestRunPrune_PartialApproval_ShouldArchiveRequestedAmount(t *testing.T) {
+	setup()
+
+	if _, ok := store.(*db.RedisStore); ok {
+		t.Skip("redis expires the transactions by itself")
+	}
+
+	now := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	assert.Nil(t, store.Insert(&db.Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 1200, RequestedAmount: 3000, Time: now.AddDate(0, 0, -100)}))
+
+	count, err := runPrune("90d", "/velocity/partial.ndjson.gz", true, now)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	archiveFile, err := fs.Open("/velocity/partial.ndjson.gz")
+	assert.Nil(t, err)
+	defer archiveFile.Close()
+
+	reader, err := gzip.NewReader(archiveFile)
+	assert.Nil(t, err)
+
+	scanner := bufio.NewScanner(reader)
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2020-08-01T03:51:48Z\",\"approved_amount\":\"$1200.00\"}", scanner.Text())
+
+	record, err := parseRecord(scanner.Text())
+	assert.Nil(t, err)
+	assert.Equal(t, 3000.0, record.LoadAmount)
+}
+
+func TestRunPrune_ShorterThanLongestWindow_ShouldFail(t *testing.T) {
+	setup()
+
+	_, err := runPrune("6d", "", false, time.Now())
+
+	assert.NotNil(t, err)
+}
+
+func TestRunPrune_RuleWindowLongerThanRetention_ShouldFail(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	custom, problems := compileRules(map[string]interface{}{
+		"quarterly-count": "count(120d) > 100",
+	}, "sqlite3")
+	assert.Empty(t, problems)
+
+	activateRules(newRuleSet(limits, custom...))
+
+	_, err := runPrune("90d", "", false, time.Now())
+
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "retention 90d is shorter than the longest window plus margin, 2904h0m0s", err.Error())
+	}
+
+	_, err = runPrune("121d", "", false, time.Now())
+
+	assert.Nil(t, err)
+}
+
+func TestRunPrune_AccountAgeRule_ShouldRefuse(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	custom, problems := compileRules(map[string]interface{}{
+		"new-account-large-load": "load_amount > $3000 && account_age() < 7d",
+		"weekly-count":           "count(7d) > 10",
+	}, "sqlite3")
+	assert.Empty(t, problems)
+
+	activateRules(newRuleSet(limits, custom...))
+
+	now := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+	assert.Nil(t, store.Insert(&db.Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: now.AddDate(0, 0, -100)}))
+
+	count, err := runPrune("90d", "", false, now)
+
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "the rules new-account-large-load read the whole history of the customers, which pruning would lose", err.Error())
+	}
+
+	assert.Equal(t, 0, count)
+
+	if _, ok := store.(*db.RedisStore); !ok {
+		transaction, err := store.FindByLoadID(1, 1)
+		assert.Nil(t, err)
+		assert.NotNil(t, transaction)
+	}
+}
+
+func TestParseRetention_Units_ShouldParse(t *testing.T) {
+	retention, err := parseRetention("90d")
+	assert.Nil(t, err)
+	assert.Equal(t, 90*24*time.Hour, retention)
+
+	retention, err = parseRetention("2w")
+	assert.Nil(t, err)
+	assert.Equal(t, 14*24*time.Hour, retention)
+
+	retention, err = parseRetention("36h")
+	assert.Nil(t, err)
+	assert.Equal(t, 36*time.Hour, retention)
+
+	_, err = parseRetention("xd")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,270 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"strconv"
+)
+
+// responseKey identifies the response to a load in an output file.
+type responseKey struct {
+	ID         string
+	CustomerID string
+}
+
+var (
+	replayArchive  string
+	replayOriginal string
+	replayReport   string
+
+	replayCommand = &cobra.Command{
+		Use:   "replay",
+		Short: "Re-evaluate archived loads under the current rules",
+		Long: `Re-evaluates an archived input stream against an empty scratch store with the current rules,
+and reports the loads whose decision, status, reason or approved amount differs from the original output file.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fs = afero.NewOsFs()
+
+			var report io.Writer = os.Stdout
+
+			if replayReport != "-" {
+				reportFile, err := fs.OpenFile(replayReport, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+				if err != nil {
+					return err
+				}
+				defer reportFile.Close()
+
+				report = reportFile
+			}
+
+			_, err := runReplay(replayArchive, replayOriginal, report)
+
+			return err
+		},
+	}
+)
+
+func init() {
+	replayCommand.Flags().StringVarP(&replayArchive, "from-archive", "a", "", "Archived input file to replay, NDJSON or CSV, optionally gzipped")
+	replayCommand.Flags().StringVarP(&replayOriginal, "original", "", "output.txt", "Original output file to compare the decisions with")
+	replayCommand.Flags().StringVarP(&replayReport, "report", "r", "-", "File to write the report to, - for the standard output")
+	replayCommand.MarkFlagRequired("from-archive")
+
+	bindCommandConfig(replayCommand)
+
+	rootCmd.AddCommand(replayCommand)
+}
+
+// responseLine is a response read from a line of an output file.
+type responseLine struct {
+	Key            responseKey
+	Accepted       bool
+	Status         string
+	Reason         string
+	ApprovedAmount string
+	Line           int
+	Text           string
+}
+
+// newResponseLine returns the line of the output file the response would be written to.
+func newResponseLine(response Response) responseLine {
+	jsonResponse := newJsonResponse(response)
+
+	return responseLine{
+		Accepted:       jsonResponse.Accepted,
+		Status:         jsonResponse.Status,
+		Reason:         jsonResponse.Reason,
+		ApprovedAmount: jsonResponse.ApprovedAmount,
+	}
+}
+
+// sameDecision reports whether the responses decide the same, with the same status, reason and approved
+// amount. The lines
+// of the outputs written before the statuses, which have none, are compared by whether the load was accepted.
+func (l responseLine) sameDecision(other responseLine) bool {
+	if l.Status == "" || other.Status == "" {
+		return l.Accepted == other.Accepted
+	}
+
+	return l.Status == other.Status && l.Reason == other.Reason && l.ApprovedAmount == other.ApprovedAmount
+}
+
+// describe returns the decision of the response, with its approved amount and reason.
+func (l responseLine) describe() string {
+	description := l.Status
+	if description == "" {
+		description = decision(l.Accepted)
+	}
+
+	if l.ApprovedAmount != "" {
+		description += " " + l.ApprovedAmount
+	}
+
+	if l.Reason != "" {
+		description += " (" + l.Reason + ")"
+	}
+
+	return description
+}
+
+// readResponseLines reads the responses of an output file, skipping the empty lines.
+func readResponseLines(filename string) ([]responseLine, error) {
+	file, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	responses := make([]responseLine, 0)
+	line := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line++
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var response jsonResponse
+
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", filename, line, err)
+		}
+
+		responses = append(responses, responseLine{
+			Key:            responseKey{ID: response.ID, CustomerID: response.CustomerID},
+			Accepted:       response.Accepted,
+			Status:         response.Status,
+			Reason:         response.Reason,
+			ApprovedAmount: response.ApprovedAmount,
+			Line:           line,
+			Text:           scanner.Text(),
+		})
+	}
+
+	return responses, scanner.Err()
+}
+
+// readResponses reads the responses of an output file, in order for every load.
+func readResponses(filename string) (map[responseKey][]responseLine, error) {
+	lines, err := readResponseLines(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make(map[responseKey][]responseLine)
+
+	for _, line := range lines {
+		responses[line.Key] = append(responses[line.Key], line)
+	}
+
+	return responses, nil
+}
+
+func decision(accepted bool) string {
+	if accepted {
+		return "accepted"
+	}
+
+	return "declined"
+}
+
+// runReplay evaluates the archived loads in a scratch store and writes to the report the loads whose
+// decision differs from the original output. It returns the number of loads whose decision flipped or
+// whose status, reason or approved amount changed.
+func runReplay(archive string, original string, report io.Writer) (flipped int, err error) {
+	if archive == "" {
+		return 0, errors.New("Archive file is not set. Please specify one using the --from-archive flag")
+	}
+
+	originalResponses, err := readResponses(original)
+	if err != nil {
+		return
+	}
+
+	next, closeRecords, err := openRecords(archive, recordsFormatOf(archive))
+	if err != nil {
+		return
+	}
+	defer closeRecords()
+
+	previousStore := store
+	store = db.NewMemoryStore()
+	defer func() {
+		store = previousStore
+	}()
+
+	replayed, toDeclined, toAccepted, changed, missing := 0, 0, 0, 0, 0
+
+	for {
+		record, recordError := next()
+		if recordError == io.EOF {
+			break
+		}
+
+		if recordError != nil {
+			return flipped, recordError
+		}
+
+		response, processError := processRecord(record)
+		if processError != nil {
+			return flipped, processError
+		}
+
+		replayed++
+
+		key := responseKey{
+			ID:         strconv.FormatInt(int64(record.ID), 10),
+			CustomerID: strconv.FormatInt(int64(record.CustomerID), 10),
+		}
+
+		replayedLine := newResponseLine(response)
+
+		originalLines := originalResponses[key]
+		if len(originalLines) == 0 {
+			missing++
+			fmt.Fprintf(report, "missing -> %s %s\n", replayedLine.describe(), formatRecord(record))
+			continue
+		}
+
+		originalLine := originalLines[0]
+		originalResponses[key] = originalLines[1:]
+
+		if originalLine.sameDecision(replayedLine) {
+			continue
+		}
+
+		switch {
+		case originalLine.Accepted && !replayedLine.Accepted:
+			toDeclined++
+		case !originalLine.Accepted && replayedLine.Accepted:
+			toAccepted++
+		default:
+			changed++
+		}
+
+		fmt.Fprintf(report, "%s -> %s %s\n", originalLine.describe(), replayedLine.describe(), formatRecord(record))
+	}
+
+	flipped = toDeclined + toAccepted + changed
+
+	_, err = fmt.Fprintf(report, "Replayed %d loads: %d accepted -> declined, %d declined -> accepted, %d with another status, reason or approved amount, %d missing from the original output\n",
+		replayed, toDeclined, toAccepted, changed, missing)
+
+	return
+}
+
+// formatRecord formats the record as a line of the source file.
+func formatRecord(record Record) string {
+	bytes, _ := json.Marshal(newJsonRecord(newTransaction(record)))
+
+	return string(bytes)
+}
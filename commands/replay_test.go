@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"bytes"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRunReplay_ChangedDecisions_ShouldReportFlips(t *testing.T) {
+	setup()
+
+	afero.WriteFile(fs, source, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T00:00:00Z\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"{\"id\":\"3\",\"customer_id\":\"2\",\"load_amount\":\"$100.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"{\"id\":\"4\",\"customer_id\":\"2\",\"load_amount\":\"$100.00\",\"time\":\"2000-01-01T02:00:00Z\"}\n"), 0644)
+
+	afero.WriteFile(fs, destination, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":true}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"accepted\":true}\n"+
+		"{\"id\":\"3\",\"customer_id\":\"2\",\"accepted\":false}\n"), 0644)
+
+	original := store
+
+	var report bytes.Buffer
+
+	flipped, err := runReplay(source, destination, &report)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, flipped)
+	assert.Equal(t, "accepted -> declined (daily_amount) {\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"declined -> accepted {\"id\":\"3\",\"customer_id\":\"2\",\"load_amount\":\"$100.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"missing -> accepted {\"id\":\"4\",\"customer_id\":\"2\",\"load_amount\":\"$100.00\",\"time\":\"2000-01-01T02:00:00Z\"}\n"+
+		"Replayed 4 loads: 1 accepted -> declined, 1 declined -> accepted, 0 with another status, reason or approved amount, 1 missing from the original output\n", report.String())
+
+	assert.Equal(t, original, store)
+
+	transaction, err := store.FindByLoadID(1, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, transaction)
+}
+
+func TestRunReplay_ChangedReason_ShouldReportChange(t *testing.T) {
+	setup()
+
+	afero.WriteFile(fs, source, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T00:00:00Z\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"), 0644)
+
+	afero.WriteFile(fs, destination, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":true,\"status\":\"accepted\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"accepted\":false,\"status\":\"declined\",\"reason\":\"daily_count\"}\n"), 0644)
+
+	var report bytes.Buffer
+
+	flipped, err := runReplay(source, destination, &report)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, flipped)
+	assert.Equal(t, "declined (daily_count) -> declined (daily_amount) {\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"Replayed 2 loads: 0 accepted -> declined, 0 declined -> accepted, 1 with another status, reason or approved amount, 0 missing from the original output\n", report.String())
+}
+
+func TestRunReplay_ChangedApprovedAmount_ShouldReportChange(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	partial := limits
+	partial.PartialApproval = true
+	activateRules(newRuleSet(partial))
+
+	afero.WriteFile(fs, source, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$3800.00\",\"time\":\"2000-01-01T00:00:00Z\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"), 0644)
+
+	afero.WriteFile(fs, destination, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":true,\"status\":\"accepted\",\"approved_amount\":\"$3800.00\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"accepted\":true,\"status\":\"accepted\",\"approved_amount\":\"$3000.00\"}\n"), 0644)
+
+	var report bytes.Buffer
+
+	flipped, err := runReplay(source, destination, &report)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, flipped)
+	assert.Equal(t, "accepted $3000.00 -> accepted $1200.00 {\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"Replayed 2 loads: 0 accepted -> declined, 0 declined -> accepted, 1 with another status, reason or approved amount, 0 missing from the original output\n", report.String())
+}
@@ -0,0 +1,201 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errReservationNotFound = errors.New("no authorized load with this id for the customer")
+
+// reservationStateError is returned when finalizing a reservation that is not authorized anymore.
+type reservationStateError struct {
+	State string
+}
+
+func (e *reservationStateError) Error() string {
+	return "the load is " + e.State + ", not authorized"
+}
+
+// jsonReservation identifies the authorized load to capture or void.
+type jsonReservation struct {
+	ID         string `json:"id"`
+	CustomerID string `json:"customer_id"`
+	State      string `json:"state,omitempty"`
+}
+
+// finalizeReservation captures the authorized load, settling it, or voids it, releasing its amount.
+// A reservation that expired cannot be captured anymore, even before it is swept.
+func finalizeReservation(ctx context.Context, customerID uint, loadID uint, state string, now time.Time) (transaction *db.Transaction, err error) {
+	ctx, span := startSpan(ctx, "finalizeReservation")
+	defer func() { endSpan(span, err) }()
+
+	err = storeWithContext(ctx, store).RunInTransaction(func(tx db.TransactionStore) error {
+		var findError error
+
+		transaction, findError = tx.FindByLoadID(customerID, loadID)
+		if findError != nil {
+			return findError
+		}
+
+		if transaction == nil {
+			return errReservationNotFound
+		}
+
+		if transaction.State != db.StateAuthorized {
+			return &reservationStateError{State: transaction.State}
+		}
+
+		if state == db.StateSettled && transaction.ExpiredAt(now) {
+			return &reservationStateError{State: db.StateExpired}
+		}
+
+		return tx.SetState(transaction, state)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	reservationsFinalized.WithLabelValues(state).Inc()
+
+	return transaction, nil
+}
+
+// releaseExpiredReservations releases the reservations that expired at the time, and returns how many.
+func releaseExpiredReservations(now time.Time) (int, error) {
+	var expired []db.Transaction
+
+	err := store.ScanExpired(now, func(transaction db.Transaction) error {
+		expired = append(expired, transaction)
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, reservation := range expired {
+		released := false
+
+		// The reservation may have been captured or voided since the scan.
+		err := store.RunInTransaction(func(tx db.TransactionStore) error {
+			transaction, err := tx.FindByLoadID(reservation.CustomerID, reservation.TransactionID)
+			if err != nil || transaction == nil || !transaction.ExpiredAt(now) {
+				released = false
+				return err
+			}
+
+			released = true
+
+			return tx.SetState(transaction, db.StateExpired)
+		})
+
+		if err != nil {
+			return count, err
+		}
+
+		if released {
+			reservationsFinalized.WithLabelValues(db.StateExpired).Inc()
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// scheduleSweep releases the expired reservations at every interval until stop is closed.
+func scheduleSweep(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			count, err := releaseExpiredReservations(now)
+			if err != nil {
+				logger.WithError(err).Error("sweep of the expired reservations failed")
+				continue
+			}
+
+			if count > 0 {
+				logger.WithField("count", count).Info("released expired reservations")
+			}
+		}
+	}
+}
+
+// handleCapture settles the authorized load in the request body.
+func handleCapture(writer http.ResponseWriter, request *http.Request) {
+	serveReservation(writer, request, db.StateSettled)
+}
+
+// handleVoid releases the reservation of the authorized load in the request body.
+func handleVoid(writer http.ResponseWriter, request *http.Request) {
+	serveReservation(writer, request, db.StateVoided)
+}
+
+func serveReservation(writer http.ResponseWriter, request *http.Request, state string) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var reservation jsonReservation
+
+	if err := json.Unmarshal(body, &reservation); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loadID, err := strconv.ParseUint(reservation.ID, 10, 32)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid id %q", reservation.ID), http.StatusBadRequest)
+		return
+	}
+
+	customerID, err := strconv.ParseUint(reservation.CustomerID, 10, 32)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("invalid customer_id %q", reservation.CustomerID), http.StatusBadRequest)
+		return
+	}
+
+	_, err = finalizeReservation(request.Context(), uint(customerID), uint(loadID), state, time.Now())
+
+	var stateError *reservationStateError
+
+	switch {
+	case err == errReservationNotFound:
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	case errors.As(err, &stateError):
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logger.WithError(err).WithField("reservation", string(body)).Error("failed to finalize reservation")
+		http.Error(writer, "failed to finalize reservation", http.StatusInternalServerError)
+		return
+	}
+
+	reservation.State = state
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(reservation)
+}
@@ -0,0 +1,139 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postTo(handler http.Handler, path string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+
+	handler.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestServe_AuthorizeCaptureVoid_ShouldReserveUntilFinalized(t *testing.T) {
+	setup()
+
+	defer func(ttl time.Duration) { reservationTTL = ttl }(reservationTTL)
+	reservationTTL = 24 * time.Hour
+
+	handler := newServeHandler()
+	version := currentRules().Version
+
+	// The loads are made long before they are authorized.
+	authorize := func(id string, amount string) string {
+		return fmt.Sprintf("{\"id\":%q,\"customer_id\":\"528\",\"load_amount\":%q,\"time\":\"2000-01-01T00:00:00Z\"}", id, amount)
+	}
+
+	before := time.Now()
+	recorder := postTo(handler, "/authorize", authorize("1", "$3000.00"))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var authorized jsonResponse
+
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &authorized))
+	assert.True(t, authorized.Accepted)
+	assert.Equal(t, version, authorized.RulesVersion)
+
+	// The reservation expires after the TTL from now, whatever the time of the load.
+	if assert.NotNil(t, authorized.ExpiresAt) {
+		assert.False(t, authorized.ExpiresAt.Before(before.Add(reservationTTL)))
+		assert.False(t, authorized.ExpiresAt.After(time.Now().Add(reservationTTL)))
+	}
+
+	count, err := releaseExpiredReservations(time.Now())
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// The reserved amount counts toward the daily limit.
+	recorder = postTo(handler, "/authorize", authorize("2", "$2500.00"))
+
+	assert.Equal(t, "{\"id\":\"2\",\"customer_id\":\"528\",\"accepted\":false,\"status\":\"declined\",\"reason\":\"daily_amount\",\"rules_version\":\""+version+"\"}\n", recorder.Body.String())
+
+	recorder = postTo(handler, "/void", "{\"id\":\"1\",\"customer_id\":\"528\"}")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "{\"id\":\"1\",\"customer_id\":\"528\",\"state\":\"voided\"}\n", recorder.Body.String())
+
+	recorder = postTo(handler, "/authorize", authorize("3", "$2500.00"))
+
+	assert.Contains(t, recorder.Body.String(), "\"accepted\":true")
+
+	recorder = postTo(handler, "/capture", "{\"id\":\"3\",\"customer_id\":\"528\"}")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "{\"id\":\"3\",\"customer_id\":\"528\",\"state\":\"settled\"}\n", recorder.Body.String())
+
+	transaction, err := store.FindByLoadID(528, 3)
+
+	assert.Nil(t, err)
+	assert.Equal(t, db.StateSettled, transaction.State)
+
+	recorder = postTo(handler, "/void", "{\"id\":\"3\",\"customer_id\":\"528\"}")
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, "the load is settled, not authorized\n", recorder.Body.String())
+
+	recorder = postTo(handler, "/capture", "{\"id\":\"4\",\"customer_id\":\"528\"}")
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+	recorder = postTo(handler, "/capture", "{\"id\":\"x\",\"customer_id\":\"528\"}")
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestReleaseExpiredReservations_Expired_ShouldReleaseAmount(t *testing.T) {
+	setup()
+
+	start := time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC)
+
+	response, err := processRecord(Record{ID: 1, CustomerID: 7, LoadAmount: 4000, Time: start, ReservedUntil: start.Add(time.Hour)})
+
+	assert.Nil(t, err)
+	assert.True(t, response.Accepted)
+
+	response, err = processRecord(Record{ID: 2, CustomerID: 7, LoadAmount: 2000, Time: start.Add(time.Minute)})
+
+	assert.Nil(t, err)
+	assert.False(t, response.Accepted)
+
+	count, err := releaseExpiredReservations(start.Add(59 * time.Minute))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+
+	// An expired reservation cannot be captured, even before it is swept.
+	_, err = finalizeReservation(context.Background(), 7, 1, db.StateSettled, start.Add(time.Hour))
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "the load is expired, not authorized", err.Error())
+
+	count, err = releaseExpiredReservations(start.Add(time.Hour))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	transaction, err := store.FindByLoadID(7, 1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, db.StateExpired, transaction.State)
+
+	response, err = processRecord(Record{ID: 3, CustomerID: 7, LoadAmount: 2000, Time: start.Add(2 * time.Hour)})
+
+	assert.Nil(t, err)
+	assert.True(t, response.Accepted)
+}
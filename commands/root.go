@@ -2,46 +2,113 @@ package commands
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/dragosv/velocity/db"
 	"github.com/jinzhu/gorm"
-	homedir "github.com/mitchellh/go-homedir"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
-	jww "github.com/spf13/jwalterweatherman"
-	"github.com/spf13/viper"
-	"log"
+	"github.com/spf13/pflag"
+	"go.opentelemetry.io/otel/label"
+	"math"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type jsonRecord struct {
-	ID         string    `json:"id"`
-	CustomerID string    `json:"customer_id"`
-	LoadAmount string    `json:"load_amount"`
-	Time       time.Time `json:"time"`
+	ID            string    `json:"id"`
+	CustomerID    string    `json:"customer_id"`
+	LoadAmount    string    `json:"load_amount"`
+	Time          time.Time `json:"time"`
+	FundingSource string    `json:"funding_source,omitempty"`
+	MerchantID    string    `json:"merchant_id,omitempty"`
 }
 
+// Record is a load, with the fingerprint of the card or account funding it and the merchant or program it
+// is made through when they are known.
 type Record struct {
-	ID         uint
-	CustomerID uint
-	LoadAmount float64
-	Time       time.Time
+	ID            uint
+	CustomerID    uint
+	LoadAmount    float64
+	Time          time.Time
+	FundingSource string
+	MerchantID    string
+	// ReservedUntil is when the reservation of an authorized load expires, zero for a load settled right away.
+	ReservedUntil time.Time
 }
 
 type Response struct {
-	ID         uint `json:"id",omitempty`
-	CustomerID uint `json:"customer_id",omitempty`
-	Accepted   bool `json:"accepted",omitempty`
+	ID         uint `json:"id"`
+	CustomerID uint `json:"customer_id"`
+	Accepted   bool `json:"accepted"`
+	// Status is accepted, declined, review for a load accepted but flagged, or step_up for a load declined
+	// until the customer is authenticated again.
+	Status string `json:"status"`
+	// Reason names the limit or the rule that declined or flagged the load.
+	Reason string `json:"reason,omitempty"`
+	// ApprovedAmount is the amount loaded, with partial approval.
+	ApprovedAmount float64 `json:"approved_amount,omitempty"`
+	// ExpiresAt is when the reservation of an authorized load expires, unless it is captured before.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// RulesVersion is the version of the rule set the load was checked against.
+	RulesVersion string `json:"-"`
+	// Usage holds the usage of the windows read to decide, before the load, by window kind.
+	Usage map[string]db.Usage `json:"-"`
 }
 
+// Limits are the velocity limits of every customer.
+type Limits struct {
+	// DailyAmount is the largest total amount loaded per day.
+	DailyAmount float64
+	// DailyCount is the largest number of loads per day.
+	DailyCount uint
+	// WeeklyAmount is the largest total amount loaded per week.
+	WeeklyAmount float64
+	// DailyAmountAction, DailyCountAction and WeeklyAmountAction are the actions on the loads exceeding the
+	// limits: decline, review or step-up.
+	DailyAmountAction  string
+	DailyCountAction   string
+	WeeklyAmountAction string
+	// PartialApproval caps the loads above the headroom left by the amount limits instead of declining them.
+	PartialApproval bool
+}
+
+// The limits a load can exceed.
+const (
+	reasonDailyAmount  = "daily_amount"
+	reasonDailyCount   = "daily_count"
+	reasonWeeklyAmount = "weekly_amount"
+)
+
+// The reasons of the decisions on the loads of the customers on the blocklist or the allowlist.
+const (
+	reasonBlocked = "customer_blocked"
+	reasonAllowed = "customer_allowed"
+)
+
+// The statuses of a load.
+const (
+	statusAccepted = "accepted"
+	statusDeclined = "declined"
+	statusReview   = "review"
+	statusStepUp   = "step_up"
+)
+
 type jsonResponse struct {
-	ID         string `json:"id",omitempty`
-	CustomerID string `json:"customer_id",omitempty`
-	Accepted   bool   `json:"accepted",omitempty`
+	ID             string     `json:"id"`
+	CustomerID     string     `json:"customer_id"`
+	Accepted       bool       `json:"accepted"`
+	Status         string     `json:"status"`
+	Reason         string     `json:"reason,omitempty"`
+	ApprovedAmount string     `json:"approved_amount,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	RulesVersion   string     `json:"rules_version,omitempty"`
 }
 
 var (
@@ -51,76 +118,132 @@ var (
 	databaseDialect    string
 	databaseConnection string
 	destination        string
+	batchSize          int
+	metricsTextfile    string
+	limits             Limits
 	fs                 afero.Fs
-	database           *gorm.DB
+	store              db.TransactionStore
 
 	rootCmd = &cobra.Command{
 		Use:   "velocity",
 		Short: "Velocity Limits Command Line Interface",
 		Long:  `Velocity Limits is a program that accepts or declines attempts to load funds into customers' accounts in real-time.`,
 
+		// The errors are logged by Execute, to the standard error, instead of printed by cobra.
+		SilenceErrors: true,
+
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfig(config, cmd); err != nil {
+				return err
+			}
+
+			custom, problems := compileRules(config.GetStringMap("rules"), databaseDialect)
+
+			if problems = append(validateLimits(limits), problems...); len(problems) > 0 {
+				return problemsError(problems)
+			}
+
+			activateRules(newRuleSet(limits, custom...))
+
+			return nil
+		},
+
 		RunE: func(cmd *cobra.Command, args []string) error {
 			fs = afero.NewOsFs()
 
 			var err error
 
-			database, err = openDatabase(databaseDialect, databaseConnection)
+			store, err = openStore(databaseDialect, databaseConnection)
 			if err != nil {
 				return errors.New("failed to connect database " + err.Error())
 			}
+			defer store.Close()
+
+			if err := openAuditLog(auditLogFile, auditMaxSize); err != nil {
+				return err
+			}
+			defer closeAuditLog()
+
+			flushSpans, err := setupTracing(otlpEndpoint)
+			if err != nil {
+				return err
+			}
+			defer flushSpans()
+
+			if err := runRootCommand(source, destination); err != nil {
+				return err
+			}
 
-			return runRootCommand(source, destination)
+			if metricsTextfile != "" {
+				return writeMetricsTextfile(metricsTextfile)
+			}
+
+			return nil
 		},
 	}
 )
 
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		er(err)
 	}
 }
 
 func init() {
 	cobra.OnInitialize(initConfig)
 
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "c", "config file (default is $HOME/.velocity)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file, YAML or TOML (default is .velocity.yaml or .velocity.toml in $HOME or the current directory)")
 
 	rootCmd.Flags().StringVarP(&source, "source", "s", "input.txt", "Source file to read from")
 	rootCmd.Flags().StringVarP(&destination, "destination", "d", "output.txt", "Destination file to write to")
-	rootCmd.Flags().StringVarP(&databaseDialect, "dialect", "", "sqlite3", "Database dialect")
-	rootCmd.Flags().StringVarP(&databaseConnection, "connection", "", "file:velocity.sqlite", "Database connection string")
+	rootCmd.PersistentFlags().StringVarP(&databaseDialect, "dialect", "", "sqlite3", "Database dialect: sqlite3, postgres, mysql, mssql, bolt or redis")
+	rootCmd.PersistentFlags().StringVarP(&databaseConnection, "connection", "", "file:velocity.sqlite", "Database connection string")
+	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", "info", "Log level: trace, debug, info, warn, error, fatal or panic")
+	rootCmd.PersistentFlags().StringVarP(&logFormat, "log-format", "", "text", "Log format: text or json")
+	rootCmd.PersistentFlags().StringVarP(&otlpEndpoint, "otlp-endpoint", "", "", "Address of the OTLP collector to export the traces to, none by default")
+	rootCmd.PersistentFlags().StringVarP(&auditLogFile, "audit-log", "", "", "JSON lines file to append an audit entry of every decision to")
+	rootCmd.PersistentFlags().Int64VarP(&auditMaxSize, "audit-max-size", "", 100, "Size in megabytes after which the audit log is rotated")
+	rootCmd.Flags().IntVarP(&batchSize, "batch-size", "", 1, "Number of loads to write to the database in one transaction")
+	rootCmd.Flags().StringVarP(&metricsTextfile, "metrics-textfile", "", "", "File to write the metrics to after the run, in the Prometheus text format")
+	rootCmd.PersistentFlags().Float64VarP(&limits.DailyAmount, "limit-daily-amount", "", 5000, "Largest total amount a customer can load per day")
+	rootCmd.PersistentFlags().UintVarP(&limits.DailyCount, "limit-daily-count", "", 3, "Largest number of loads a customer can make per day")
+	rootCmd.PersistentFlags().Float64VarP(&limits.WeeklyAmount, "limit-weekly-amount", "", 20000, "Largest total amount a customer can load per week")
+	rootCmd.PersistentFlags().StringVarP(&limits.DailyAmountAction, "limit-daily-amount-action", "", actionDecline, "Action on the loads exceeding the daily amount: decline, review or step-up")
+	rootCmd.PersistentFlags().StringVarP(&limits.DailyCountAction, "limit-daily-count-action", "", actionDecline, "Action on the loads exceeding the daily count: decline, review or step-up")
+	rootCmd.PersistentFlags().StringVarP(&limits.WeeklyAmountAction, "limit-weekly-amount-action", "", actionDecline, "Action on the loads exceeding the weekly amount: decline, review or step-up")
+	rootCmd.PersistentFlags().BoolVarP(&limits.PartialApproval, "limit-partial-approval", "", false, "Approve the part of a load within the amount limits instead of declining it")
+
+	// The limits are grouped under limits in the config file.
+	rootCmd.PersistentFlags().VisitAll(func(flag *pflag.Flag) {
+		switch {
+		case flag.Name == "config":
+		case strings.HasPrefix(flag.Name, "limit-"):
+			bindConfig("limits."+strings.TrimPrefix(flag.Name, "limit-"), flag)
+		default:
+			bindConfig(flag.Name, flag)
+		}
+	})
 
-	viper.BindPFlag("source", rootCmd.PersistentFlags().Lookup("source"))
-	viper.BindPFlag("destination", rootCmd.PersistentFlags().Lookup("destination"))
-	viper.BindPFlag("dialect", rootCmd.PersistentFlags().Lookup("dialect"))
-	viper.BindPFlag("connection", rootCmd.PersistentFlags().Lookup("connection"))
+	bindFlagsConfig("", rootCmd.Flags())
 }
 
+// er logs the error, to the standard error so that it never mixes with the output of the commands, and exits.
 func er(msg interface{}) {
-	fmt.Println("Error:", msg)
+	logger.Error(msg)
 	os.Exit(1)
 }
 
 func initConfig() {
-	if cfgFile != "" {
-		// Use config file from the flag.
-		viper.SetConfigFile(cfgFile)
-	} else {
-		// Find home directory.
-		home, err := homedir.Dir()
-		if err != nil {
-			er(err)
-		}
-
-		viper.AddConfigPath(home)
-		viper.SetConfigName(".velocity")
+	if err := readConfig(config, cfgFile); err != nil {
+		er(err)
 	}
 
-	viper.AutomaticEnv()
+	if err := configureLogger(config.GetString("log-level"), config.GetString("log-format")); err != nil {
+		er(err)
+	}
 
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	if config.ConfigFileUsed() != "" {
+		logger.WithField("file", config.ConfigFileUsed()).Info("using config file")
 	}
 }
 
@@ -130,6 +253,15 @@ func openDatabase(databaseDialect string, databaseConnection string) (database *
 	return
 }
 
+func openStore(databaseDialect string, databaseConnection string) (db.TransactionStore, error) {
+	store, err := db.OpenStore(databaseDialect, databaseConnection)
+	if err != nil {
+		return nil, err
+	}
+
+	return newInstrumentedStore(store), nil
+}
+
 func fileExists(filename string) bool {
 	info, err := fs.Stat(filename)
 	if os.IsNotExist(err) {
@@ -139,7 +271,7 @@ func fileExists(filename string) bool {
 }
 
 func runRootCommand(source string, destination string) error {
-	jww.FEEDBACK.Println("Running ")
+	logger.WithFields(logrus.Fields{"source": source, "destination": destination}).Info("running")
 
 	if !fileExists(source) {
 		return errors.New("Source file does not exist. Please specify one using the --source flag")
@@ -152,49 +284,21 @@ func runRootCommand(source string, destination string) error {
 	defer sourceFile.Close()
 
 	var records []Record
-	var jsonRecord jsonRecord
-	var record Record
 
 	records = make([]Record, 0)
 
 	scanner := bufio.NewScanner(sourceFile)
 	for scanner.Scan() {
 		text := scanner.Text()
-		bytes := []byte(text)
-
-		jsonError := json.Unmarshal(bytes, &jsonRecord)
-
-		if jsonError != nil {
-			log.Println(text)
-			return jsonError
-		} else {
-			id, parseError := strconv.ParseInt(jsonRecord.ID, 10, 32)
-			if parseError != nil {
-				log.Println(text)
-				return parseError
-			}
 
-			customerId, parseError := strconv.ParseInt(jsonRecord.CustomerID, 10, 32)
-			if parseError != nil {
-				log.Println(text)
-				return parseError
-			}
-
-			loadAmount, parseError := strconv.ParseFloat(jsonRecord.LoadAmount[1:], 64)
-			if parseError != nil {
-				log.Println(text)
-				return parseError
-			}
-
-			record = Record{
-				ID:         uint(id),
-				CustomerID: uint((customerId)),
-				LoadAmount: loadAmount,
-				Time:       jsonRecord.Time,
-			}
-
-			records = append(records, record)
+		record, parseError := parseRecord(text)
+		if parseError != nil {
+			parseErrors.Inc()
+			logger.WithError(parseError).WithField("line", text).Error("failed to parse load")
+			return parseError
 		}
+
+		records = append(records, record)
 	}
 
 	if scannerError := scanner.Err(); scannerError != nil {
@@ -224,13 +328,7 @@ func runRootCommand(source string, destination string) error {
 
 	for _, response := range responses {
 		if response.ID > 0 {
-			jsonResponse := jsonResponse{
-				ID:         strconv.FormatInt(int64(response.ID), 10),
-				CustomerID: strconv.FormatInt(int64(response.CustomerID), 10),
-				Accepted:   response.Accepted,
-			}
-
-			responseBytes, responseError := json.Marshal(jsonResponse)
+			responseBytes, responseError := json.Marshal(newJsonResponse(response))
 
 			if responseError != nil {
 				return responseError
@@ -247,88 +345,376 @@ func runRootCommand(source string, destination string) error {
 	return nil
 }
 
+// parseRecord parses a line of the source file.
+func parseRecord(text string) (Record, error) {
+	var jsonRecord jsonRecord
+
+	jsonError := json.Unmarshal([]byte(text), &jsonRecord)
+	if jsonError != nil {
+		return Record{}, jsonError
+	}
+
+	id, parseError := strconv.ParseInt(jsonRecord.ID, 10, 32)
+	if parseError != nil {
+		return Record{}, parseError
+	}
+
+	customerId, parseError := strconv.ParseInt(jsonRecord.CustomerID, 10, 32)
+	if parseError != nil {
+		return Record{}, parseError
+	}
+
+	if len(jsonRecord.LoadAmount) < 2 {
+		return Record{}, errors.New("invalid load amount " + jsonRecord.LoadAmount)
+	}
+
+	loadAmount, parseError := strconv.ParseFloat(jsonRecord.LoadAmount[1:], 64)
+	if parseError != nil {
+		return Record{}, parseError
+	}
+
+	return Record{
+		ID:            uint(id),
+		CustomerID:    uint((customerId)),
+		LoadAmount:    loadAmount,
+		Time:          jsonRecord.Time,
+		FundingSource: jsonRecord.FundingSource,
+		MerchantID:    jsonRecord.MerchantID,
+	}, nil
+}
+
+// formatAmount formats the amount like the load amounts of the records.
+func formatAmount(amount float64) string {
+	return fmt.Sprintf("$%.2f", amount)
+}
+
+func newJsonResponse(response Response) jsonResponse {
+	jsonResponse := jsonResponse{
+		ID:         strconv.FormatInt(int64(response.ID), 10),
+		CustomerID: strconv.FormatInt(int64(response.CustomerID), 10),
+		Accepted:   response.Accepted,
+		Status:     response.Status,
+		Reason:     response.Reason,
+		ExpiresAt:  response.ExpiresAt,
+	}
+
+	if response.ApprovedAmount > 0 {
+		jsonResponse.ApprovedAmount = formatAmount(response.ApprovedAmount)
+	}
+
+	return jsonResponse
+}
+
 func processRecords(records []Record) ([]Response, error) {
 	var responses []Response
 
 	responses = make([]Response, 0, len(records))
 
-	for i := 0; i < len(records); i++ {
-		response, error := processRecord(records[i])
+	if batchSize <= 1 {
+		for i := 0; i < len(records); i++ {
+			response, error := processRecord(records[i])
+
+			if error != nil {
+				return nil, error
+			}
+
+			responses = append(responses, response)
+		}
+
+		return responses, nil
+	}
+
+	for start := 0; start < len(records); start += batchSize {
+		end := start + batchSize
+		if end > len(records) {
+			end = len(records)
+		}
+
+		batchResponses, error := processBatch(records[start:end])
 
 		if error != nil {
 			return nil, error
 		}
 
-		responses = append(responses, response)
+		responses = append(responses, batchResponses...)
 	}
 
 	return responses, nil
 }
 
-type total struct {
-	CustomerID uint
-	Total      float64
-	Count      uint
+// processBatch evaluates the records and writes the accepted ones in a single database transaction.
+// The limit checks run inside the same transaction, so the totals include the loads accepted earlier
+// in the batch even though they are not committed yet.
+func processBatch(records []Record) ([]Response, error) {
+	var responses []Response
+	var durations []time.Duration
+
+	ctx, span := startSpan(context.Background(), "processBatch", label.Int("batch.size", len(records)))
+
+	error := storeWithContext(ctx, store).RunInTransaction(func(tx db.TransactionStore) error {
+		responses = make([]Response, 0, len(records))
+		durations = make([]time.Duration, 0, len(records))
+
+		for i := 0; i < len(records); i++ {
+			start := time.Now()
+
+			response, err := checkAndInsertRecord(tx, records[i])
+
+			if err != nil {
+				return err
+			}
+
+			responses = append(responses, response)
+			durations = append(durations, time.Since(start))
+		}
+
+		return nil
+	})
+
+	endSpan(span, error)
+
+	if error != nil {
+		return nil, error
+	}
+
+	// The decisions are counted and audited once the batch is committed, so that retried batches are counted once.
+	for i, response := range responses {
+		observeDecision(response, durations[i])
+		auditDecision(records[i], response)
+	}
+
+	return responses, nil
 }
 
 func processRecord(record Record) (Response, error) {
-	response := Response{
-		ID:         record.ID,
-		CustomerID: record.CustomerID,
-		Accepted:   false,
+	return processRecordContext(context.Background(), record)
+}
+
+// processRecordContext evaluates the record, tracing the evaluation as a child of the span of the context.
+func processRecordContext(ctx context.Context, record Record) (response Response, err error) {
+	ctx, span := startSpan(ctx, "processRecord", recordLabels(record)...)
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+
+	// The limit checks and the insert run in one transaction, so that concurrent instances
+	// cannot both accept loads that together exceed the limits.
+	err = storeWithContext(ctx, store).RunInTransaction(func(tx db.TransactionStore) error {
+		var checkError error
+
+		response, checkError = checkAndInsertRecord(tx, record)
+
+		return checkError
+	})
+
+	if err != nil {
+		return response, err
 	}
 
-	var dbTransaction db.Transaction
+	observeDecision(response, time.Since(start))
+	auditDecision(record, response)
 
+	return response, nil
+}
+
+// newTransaction returns the transaction saving the record, with the buckets of its time.
+func newTransaction(record Record) db.Transaction {
 	isoYear, isoWeek := record.Time.ISOWeek()
-	year := uint(isoYear)
-	week := uint(isoWeek)
-	month := uint(record.Time.Month())
-	day := uint(record.Time.Day())
 
-	customerTotal := total{}
+	transaction := db.Transaction{
+		TransactionID:   uint(record.ID),
+		CustomerID:      uint(record.CustomerID),
+		LoadAmount:      record.LoadAmount,
+		RequestedAmount: record.LoadAmount,
+		Time:            record.Time,
+		Year:            uint(isoYear),
+		Month:           uint(record.Time.Month()),
+		Day:             uint(record.Time.Day()),
+		Week:            uint(isoWeek),
+		FundingSource:   record.FundingSource,
+		MerchantID:      record.MerchantID,
+		State:           db.StateSettled,
+	}
 
-	// 5000 per day
-	database.Table("transactions").Select("customer_id, sum(load_amount) as total, count(load_amount) as count").
-		Where("customer_id = ? and year = ? and month = ? and day = ?", record.CustomerID, year, month, day).
-		Group("customer_id").First(&customerTotal)
+	if !record.ReservedUntil.IsZero() {
+		expiresAt := record.ReservedUntil.UTC()
 
-	if record.LoadAmount+customerTotal.Total > 5000 {
-		return response, nil
+		transaction.State = db.StateAuthorized
+		transaction.ExpiresAt = &expiresAt
 	}
 
-	// 3 times per day
-	if customerTotal.Count > 2 {
-		return response, nil
+	return transaction
+}
+
+func checkAndInsertRecord(tx db.TransactionStore, record Record) (Response, error) {
+	rules := currentRules()
+	limits := rules.Limits
+
+	response := Response{
+		ID:           record.ID,
+		CustomerID:   record.CustomerID,
+		Accepted:     false,
+		RulesVersion: rules.Version,
+		Usage:        make(map[string]db.Usage),
 	}
 
-	// 20000 per day
-	database.Table("transactions").Select("customer_id, sum(load_amount) as total").
-		Where("customer_id = ? and year = ? and week = ?", record.CustomerID, year, week).
-		Group("customer_id").First(&customerTotal)
+	ctx := storeContext(tx)
+
+	// The loads of the listed customers are decided before any limit is queried.
+	listing, err := storeWithContext(ctx, tx).FindListing(record.CustomerID)
+	if err != nil {
+		return response, err
+	}
+
+	// The listings expire by the clock, as their expiry is set from the clock, whatever the time of the load.
+	listed := ""
+	if listing != nil && listing.ActiveAt(time.Now()) {
+		listed = listing.List
+	}
+
+	if listed == db.ListBlocked {
+		response.Status = statusDeclined
+		response.Reason = reasonBlocked
 
-	if record.LoadAmount+customerTotal.Total > 20000 {
 		return response, nil
 	}
 
-	dbTransaction = db.Transaction{
-		TransactionID: uint(record.ID),
-		CustomerID:    uint(record.CustomerID),
-		LoadAmount:    record.LoadAmount,
-		Time:          record.Time,
-		Year:          year,
-		Month:         month,
-		Day:           day,
-		Week:          week,
+	// The usage of each window is read once, by the first limit needing it.
+	readUsage := func(ctx context.Context, kind string) (db.Usage, error) {
+		if usage, found := response.Usage[kind]; found {
+			usageCacheHits.Inc()
+			return usage, nil
+		}
+
+		usageCacheMisses.Inc()
+
+		usage, queryError := storeWithContext(ctx, tx).SumAndCount(record.CustomerID, kind, db.WindowKey(kind, record.Time))
+		if queryError != nil {
+			return usage, queryError
+		}
+
+		response.Usage[kind] = usage
+
+		return usage, nil
+	}
+
+	requestedAmount := record.LoadAmount
+
+	// With partial approval, a load above the headroom left by the amount limits is capped to it,
+	// and checked as if it was requested so.
+	if limits.PartialApproval && listed != db.ListAllowed {
+		headroom, err := amountHeadroom(ctx, limits, readUsage)
+		if err != nil {
+			return response, err
+		}
+
+		if headroom > 0 && headroom < record.LoadAmount {
+			record.LoadAmount = headroom
+		}
 	}
 
-	error := database.Save(&dbTransaction).Error
+	checks := []ruleCheck{
+		// Amount per day
+		{reasonDailyAmount, limits.DailyAmountAction, priorityDailyAmount, func(ctx context.Context) (bool, error) {
+			usage, queryError := readUsage(ctx, db.WindowDay)
+
+			return record.LoadAmount+usage.Total > limits.DailyAmount, queryError
+		}},
+		// Loads per day
+		{reasonDailyCount, limits.DailyCountAction, priorityDailyCount, func(ctx context.Context) (bool, error) {
+			usage, queryError := readUsage(ctx, db.WindowDay)
+
+			return usage.Count >= limits.DailyCount, queryError
+		}},
+		// Amount per week
+		{reasonWeeklyAmount, limits.WeeklyAmountAction, priorityWeeklyAmount, func(ctx context.Context) (bool, error) {
+			usage, queryError := readUsage(ctx, db.WindowWeek)
+
+			return record.LoadAmount+usage.Total > limits.WeeklyAmount, queryError
+		}},
+	}
 
-	if error != nil {
-		return response, error
+	for _, rule := range rules.Custom {
+		rule := rule
+
+		checks = append(checks, ruleCheck{rule.Name, rule.Action, rule.Priority, func(ctx context.Context) (bool, error) {
+			return rule.Matches(storeWithContext(ctx, tx), record)
+		}})
+	}
+
+	if listed == db.ListAllowed {
+		checks = nil
+		response.Reason = reasonAllowed
+	}
+
+	// The rules run by priority, and the first one matching decides.
+	sort.SliceStable(checks, func(i, j int) bool {
+		return checks[i].priority < checks[j].priority
+	})
+
+	response.Status = statusAccepted
+
+	for _, check := range checks {
+		matched, err := checkRule(ctx, &response, check.reason, check.action, check.check)
+		if err != nil {
+			return response, err
+		}
+
+		if matched {
+			response.Status = ruleActions[check.action]
+			break
+		}
+	}
+
+	if response.Status == statusDeclined || response.Status == statusStepUp {
+		return response, nil
+	}
+
+	dbTransaction := newTransaction(record)
+	dbTransaction.RequestedAmount = requestedAmount
+
+	err = tx.Insert(&dbTransaction)
+
+	if err != nil {
+		return response, err
 	}
 
 	response.Accepted = true
+	response.ExpiresAt = dbTransaction.ExpiresAt
+
+	if limits.PartialApproval {
+		response.ApprovedAmount = record.LoadAmount
+	}
 
 	return response, nil
 }
+
+// amountHeadroom returns the amount the customer can still load before exceeding the amount limits
+// that decline, rounded down to the cent.
+func amountHeadroom(ctx context.Context, limits Limits, readUsage func(ctx context.Context, kind string) (db.Usage, error)) (float64, error) {
+	headroom := math.Inf(1)
+
+	amountLimits := []struct {
+		kind   string
+		limit  float64
+		action string
+	}{
+		{db.WindowDay, limits.DailyAmount, limits.DailyAmountAction},
+		{db.WindowWeek, limits.WeeklyAmount, limits.WeeklyAmountAction},
+	}
+
+	for _, amountLimit := range amountLimits {
+		if amountLimit.action != actionDecline {
+			continue
+		}
+
+		usage, err := readUsage(ctx, amountLimit.kind)
+		if err != nil {
+			return 0, err
+		}
+
+		headroom = math.Min(headroom, amountLimit.limit-usage.Total)
+	}
+
+	return math.Floor(headroom*100+1e-6) / 100, nil
+}
@@ -0,0 +1,384 @@
+package commands
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dragosv/velocity/db"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ruleSet is a version of the limits and custom rules the loads are checked against. The version is
+// derived from them, so that the same limits and rules always have the same version.
+type ruleSet struct {
+	Limits  Limits
+	Custom  []*customRule
+	Version string
+}
+
+// The actions of a rule matching a load.
+const (
+	actionDecline = "decline"
+	actionReview  = "review"
+	actionStepUp  = "step-up"
+)
+
+// ruleActions are the statuses of the loads matched by a rule, by action.
+var ruleActions = map[string]string{
+	actionDecline: statusDeclined,
+	actionReview:  statusReview,
+	actionStepUp:  statusStepUp,
+}
+
+// The priorities of the limits: the rules run from the lowest priority, the limits first by default.
+const (
+	priorityDailyAmount  = 10
+	priorityDailyCount   = 20
+	priorityWeeklyAmount = 30
+	defaultRulePriority  = 100
+)
+
+func checkAction(action string) error {
+	if _, known := ruleActions[action]; !known {
+		return fmt.Errorf("unknown action %s, expected one of %s, %s or %s", action, actionDecline, actionReview, actionStepUp)
+	}
+
+	return nil
+}
+
+// ruleCheck is a limit or a custom rule, with the action on the loads it matches.
+type ruleCheck struct {
+	reason   string
+	action   string
+	priority int
+	check    func(ctx context.Context) (bool, error)
+}
+
+// customRule applies its action to the loads matching its compiled expression, with its name as the reason.
+// historyReach returns the longest window of the aggregates of the custom rules, and the names of the rules
+// reading the whole history of the customers.
+func (r *ruleSet) historyReach() (longest time.Duration, whole []string) {
+	for _, rule := range r.Custom {
+		ruleLongest, ruleWhole := historyReach(rule.expression)
+		if ruleLongest > longest {
+			longest = ruleLongest
+		}
+
+		if ruleWhole {
+			whole = append(whole, rule.Name)
+		}
+	}
+
+	return
+}
+
+type customRule struct {
+	Name       string
+	Expression string
+	Action     string
+	Priority   int
+	expression expressionNode
+}
+
+// ruleDefinition is a custom rule of the config file, given either as its expression alone or as a table
+// of its condition, action and priority.
+type ruleDefinition struct {
+	When     string
+	Action   string
+	Priority int
+}
+
+func parseRuleDefinition(value interface{}) (definition ruleDefinition, err error) {
+	definition = ruleDefinition{Action: actionDecline, Priority: defaultRulePriority}
+
+	if expression, isExpression := value.(string); isExpression {
+		definition.When = expression
+		return definition, nil
+	}
+
+	fields, err := cast.ToStringMapE(value)
+	if err != nil {
+		return definition, errors.New("expected an expression or a table of when, action and priority")
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err = parseRuleField(&definition, strings.ToLower(key), fields[key]); err != nil {
+			return definition, err
+		}
+	}
+
+	if definition.When == "" {
+		return definition, errors.New("missing when, the condition of the rule")
+	}
+
+	return definition, nil
+}
+
+// parseRuleField sets a field of the definition.
+func parseRuleField(definition *ruleDefinition, field string, value interface{}) (err error) {
+	switch field {
+	case "when":
+		definition.When, err = cast.ToStringE(value)
+	case "action":
+		if definition.Action, err = cast.ToStringE(value); err == nil {
+			err = checkAction(definition.Action)
+		}
+	case "priority":
+		definition.Priority, err = cast.ToIntE(value)
+	default:
+		return fmt.Errorf("unknown field %s, expected when, action or priority", field)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %v", field, err)
+	}
+
+	return nil
+}
+
+// compileRule compiles the condition of a rule, for the store of the dialect.
+func compileRule(name string, definition ruleDefinition, dialect string) (*customRule, error) {
+	node, err := compileExpression(definition.When)
+	if err != nil {
+		return nil, err
+	}
+
+	if dialect == "redis" && readsHistory(node) {
+		return nil, errors.New("count, sum and account_age need the transaction history, which the redis dialect does not keep")
+	}
+
+	return &customRule{Name: name, Expression: definition.When, Action: definition.Action, Priority: definition.Priority, expression: node}, nil
+}
+
+// compileRules compiles the rules configured by name for the store of the dialect, in order of priority
+// then name.
+func compileRules(definitions map[string]interface{}, dialect string) ([]*customRule, []configProblem) {
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var rules []*customRule
+	var problems []configProblem
+
+	for _, name := range names {
+		definition, err := parseRuleDefinition(definitions[name])
+		if err != nil {
+			problems = append(problems, configProblem{"rules." + name, err.Error()})
+			continue
+		}
+
+		rule, err := compileRule(name, definition, dialect)
+		if err != nil {
+			problems = append(problems, configProblem{"rules." + name, err.Error()})
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+
+	return rules, problems
+}
+
+// Matches evaluates the condition of the rule against the record, with the history of the store.
+func (r *customRule) Matches(store db.TransactionStore, record Record) (bool, error) {
+	load := ruleLoad{
+		ID:            record.ID,
+		CustomerID:    record.CustomerID,
+		LoadAmount:    record.LoadAmount,
+		Time:          record.Time,
+		FundingSource: record.FundingSource,
+		MerchantID:    record.MerchantID,
+	}
+
+	matched, err := r.expression.Eval(&expressionEnv{store: store, current: load, load: load})
+	if err != nil {
+		return false, fmt.Errorf("rule %s: %v", r.Name, err)
+	}
+
+	return matched.(bool), nil
+}
+
+// configProblem is a problem of the value of a configuration key.
+type configProblem struct {
+	Key     string
+	Message string
+}
+
+func (p configProblem) String() string {
+	return p.Key + ": " + p.Message
+}
+
+// problemsError returns an error listing the problems.
+func problemsError(problems []configProblem) error {
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.String()
+	}
+
+	return errors.New("invalid configuration: " + strings.Join(messages, ", "))
+}
+
+// activeRules holds the *ruleSet the loads are checked against, swapped as a whole on reloads.
+var activeRules atomic.Value
+
+func newRuleSet(limits Limits, custom ...*customRule) *ruleSet {
+	bytes, _ := json.Marshal(limits)
+
+	for _, rule := range custom {
+		bytes = append(bytes, fmt.Sprintf("\x00%s\x00%s\x00%s\x00%d", rule.Name, rule.Expression, rule.Action, rule.Priority)...)
+	}
+
+	sum := sha256.Sum256(bytes)
+
+	return &ruleSet{Limits: limits, Custom: custom, Version: hex.EncodeToString(sum[:])[:12]}
+}
+
+// currentRules returns the active rule set, or the one of the configured limits when none was activated.
+func currentRules() *ruleSet {
+	if rules, ok := activeRules.Load().(*ruleSet); ok {
+		return rules
+	}
+
+	return newRuleSet(limits)
+}
+
+func activateRules(rules *ruleSet) {
+	activeRules.Store(rules)
+
+	rulesInfo.Reset()
+	rulesInfo.WithLabelValues(rules.Version).Set(1)
+}
+
+// validateLimits returns the problems of the limits.
+func validateLimits(limits Limits) []configProblem {
+	var problems []configProblem
+
+	if limits.DailyAmount <= 0 {
+		problems = append(problems, configProblem{"limits.daily-amount", "must be positive"})
+	}
+
+	if limits.DailyCount == 0 {
+		problems = append(problems, configProblem{"limits.daily-count", "must be positive"})
+	}
+
+	if limits.WeeklyAmount <= 0 {
+		problems = append(problems, configProblem{"limits.weekly-amount", "must be positive"})
+	}
+
+	if limits.DailyAmount > limits.WeeklyAmount {
+		problems = append(problems, configProblem{"limits.daily-amount", "must not be above limits.weekly-amount"})
+	}
+
+	actions := []struct {
+		key    string
+		action string
+	}{
+		{"limits.daily-amount-action", limits.DailyAmountAction},
+		{"limits.daily-count-action", limits.DailyCountAction},
+		{"limits.weekly-amount-action", limits.WeeklyAmountAction},
+	}
+
+	for _, action := range actions {
+		if err := checkAction(action.action); err != nil {
+			problems = append(problems, configProblem{action.key, err.Error()})
+		}
+	}
+
+	return problems
+}
+
+// limitsFromConfig returns the limits resolved by the configuration.
+func limitsFromConfig(v *viper.Viper) (Limits, error) {
+	return parseLimits(func(key string) string {
+		return configValue(v, key)
+	})
+}
+
+// parseLimits parses the limits from the values of their configuration keys.
+func parseLimits(value func(key string) string) (limits Limits, err error) {
+	if limits.DailyAmount, err = strconv.ParseFloat(value("limits.daily-amount"), 64); err != nil {
+		return limits, fmt.Errorf("limits.daily-amount: %v", err)
+	}
+
+	dailyCount, err := strconv.ParseUint(value("limits.daily-count"), 10, 32)
+	if err != nil {
+		return limits, fmt.Errorf("limits.daily-count: %v", err)
+	}
+
+	limits.DailyCount = uint(dailyCount)
+
+	if limits.WeeklyAmount, err = strconv.ParseFloat(value("limits.weekly-amount"), 64); err != nil {
+		return limits, fmt.Errorf("limits.weekly-amount: %v", err)
+	}
+
+	limits.DailyAmountAction = value("limits.daily-amount-action")
+	limits.DailyCountAction = value("limits.daily-count-action")
+	limits.WeeklyAmountAction = value("limits.weekly-amount-action")
+
+	if limits.PartialApproval, err = strconv.ParseBool(value("limits.partial-approval")); err != nil {
+		return limits, fmt.Errorf("limits.partial-approval: %v", err)
+	}
+
+	return limits, nil
+}
+
+// reloadRules reads the config file again and activates its limits when they are valid, keeping the
+// active rule set otherwise.
+func reloadRules(v *viper.Viper) (*ruleSet, error) {
+	rules, err := readRules(v)
+	if err != nil {
+		ruleReloads.WithLabelValues("failure").Inc()
+		return nil, err
+	}
+
+	activateRules(rules)
+	ruleReloads.WithLabelValues("success").Inc()
+
+	return rules, nil
+}
+
+func readRules(v *viper.Viper) (*ruleSet, error) {
+	// The watcher keeps the previous values when the file cannot be parsed, so parse it again to tell.
+	fileValues := viper.New()
+	fileValues.SetConfigFile(v.ConfigFileUsed())
+
+	if err := fileValues.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	limits, err := limitsFromConfig(v)
+	if err != nil {
+		return nil, err
+	}
+
+	custom, problems := compileRules(v.GetStringMap("rules"), databaseDialect)
+
+	if problems = append(validateLimits(limits), problems...); len(problems) > 0 {
+		return nil, problemsError(problems)
+	}
+
+	return newRuleSet(limits, custom...), nil
+}
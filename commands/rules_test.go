@@ -0,0 +1,404 @@
+package commands
+
+import (
+	"encoding/json"
+	"github.com/dragosv/velocity/db"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReloadRules_ValidChange_ShouldSwapRules(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	filename := writeTestConfig(t, "reload.yaml", "limits:\n  daily-amount: 1000\n")
+
+	v := newConfig()
+	assert.Nil(t, readConfig(v, filename))
+
+	rules, err := reloadRules(v)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Limits{DailyAmount: 1000, DailyCount: 3, WeeklyAmount: 20000, DailyAmountAction: actionDecline, DailyCountAction: actionDecline, WeeklyAmountAction: actionDecline}, currentRules().Limits)
+	assert.Equal(t, rules.Version, currentRules().Version)
+	assert.NotEqual(t, newRuleSet(limits).Version, rules.Version)
+	assert.Equal(t, 1.0, testutil.ToFloat64(rulesInfo.WithLabelValues(rules.Version)))
+
+	records := generateRecords(1)
+	records[0].LoadAmount = 2000
+
+	response, err := processRecord(records[0])
+
+	assert.Nil(t, err)
+	assert.False(t, response.Accepted)
+	assert.Equal(t, rules.Version, response.RulesVersion)
+
+	// Removing the limit from the file restores its default.
+	writeTestConfig(t, "reload.yaml", "limits:\n  daily-count: 3\n")
+	assert.Nil(t, v.ReadInConfig())
+
+	rules, err = reloadRules(v)
+
+	assert.Nil(t, err)
+	assert.Equal(t, newRuleSet(limits).Version, rules.Version)
+}
+
+func TestReloadRules_InvalidChange_ShouldKeepActiveRules(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	filename := writeTestConfig(t, "invalid.yaml", "limits:\n  daily-amount: 1000\n")
+
+	v := newConfig()
+	assert.Nil(t, readConfig(v, filename))
+
+	active, err := reloadRules(v)
+	assert.Nil(t, err)
+
+	failures := testutil.ToFloat64(ruleReloads.WithLabelValues("failure"))
+
+	writeTestConfig(t, "invalid.yaml", "limits:\n  daily-amount: 30000\n")
+	assert.Nil(t, v.ReadInConfig())
+
+	_, err = reloadRules(v)
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "limits.daily-amount: must not be above limits.weekly-amount")
+	assert.Equal(t, active, currentRules())
+
+	writeTestConfig(t, "invalid.yaml", "limits: [\n")
+
+	_, err = reloadRules(v)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, active, currentRules())
+	assert.Equal(t, failures+2, testutil.ToFloat64(ruleReloads.WithLabelValues("failure")))
+}
+
+func TestProcessRecord_CustomRule_ShouldDeclineWithRuleName(t *testing.T) {
+	if os.Getenv("VELOCITY_TEST_DIALECT") == "redis" {
+		t.Skip("redis does not keep the transaction history")
+	}
+
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	custom, problems := compileRules(map[string]interface{}{"large-loads-per-hour": "load_amount > 1000 && count(1h, load_amount > 1000) >= 2"}, "sqlite3")
+	assert.Empty(t, problems)
+
+	rules := newRuleSet(limits, custom...)
+	activateRules(rules)
+
+	assert.NotEqual(t, newRuleSet(limits).Version, rules.Version)
+
+	start := time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC)
+	amounts := []float64{1500, 1200, 1100, 500}
+	reasons := []string{"", "", "large-loads-per-hour", ""}
+
+	for i, amount := range amounts {
+		response, err := processRecord(Record{ID: uint(i + 1), CustomerID: 7, LoadAmount: amount, Time: start.Add(time.Duration(i) * 5 * time.Minute)})
+
+		assert.Nil(t, err)
+		assert.Equal(t, reasons[i] == "", response.Accepted)
+		assert.Equal(t, reasons[i], response.Reason)
+	}
+}
+
+func TestProcessRecord_DimensionRules_ShouldCapMerchantAndPlatform(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	custom, problems := compileRules(map[string]interface{}{
+		"merchant-daily-amount": "sum_by(merchant, day) + load_amount > 6000",
+		"platform-daily-amount": "sum_by(platform, day) + load_amount > 10000",
+	}, "sqlite3")
+	assert.Empty(t, problems)
+
+	activateRules(newRuleSet(limits, custom...))
+
+	start := time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC)
+	records := []Record{
+		{CustomerID: 1, LoadAmount: 4000, MerchantID: "m-1"},
+		{CustomerID: 2, LoadAmount: 3000, MerchantID: "m-1"},
+		{CustomerID: 3, LoadAmount: 3000, MerchantID: "m-2"},
+		{CustomerID: 4, LoadAmount: 2000, MerchantID: "m-1"},
+		{CustomerID: 5, LoadAmount: 3500},
+		{CustomerID: 6, LoadAmount: 1000},
+	}
+	reasons := []string{"", "merchant-daily-amount", "", "", "platform-daily-amount", ""}
+
+	for i, record := range records {
+		record.ID = uint(i + 1)
+		record.Time = start.Add(time.Duration(i) * time.Minute)
+
+		response, err := processRecord(record)
+
+		assert.Nil(t, err)
+		assert.Equal(t, reasons[i], response.Reason, record.ID)
+	}
+
+	transaction, err := store.FindByLoadID(4, 4)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "m-1", transaction.MerchantID)
+}
+
+func TestProcessRecord_PlatformDailyAmount_ShouldResetAtMidnight(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	custom, problems := compileRules(map[string]interface{}{
+		"platform-daily-amount": "sum_by(platform, day) + load_amount > 5000",
+	}, "sqlite3")
+	assert.Empty(t, problems)
+
+	activateRules(newRuleSet(limits, custom...))
+
+	records := []Record{
+		{ID: 1, CustomerID: 1, LoadAmount: 3000, Time: time.Date(2020, 11, 9, 23, 0, 0, 0, time.UTC)},
+		{ID: 2, CustomerID: 2, LoadAmount: 3000, Time: time.Date(2020, 11, 10, 1, 0, 0, 0, time.UTC)},
+		{ID: 3, CustomerID: 3, LoadAmount: 3000, Time: time.Date(2020, 11, 10, 23, 30, 0, 0, time.UTC)},
+	}
+	reasons := []string{"", "", "platform-daily-amount"}
+
+	for i, record := range records {
+		response, err := processRecord(record)
+
+		assert.Nil(t, err)
+		assert.Equal(t, reasons[i], response.Reason, record.ID)
+	}
+}
+
+func TestParseRecord_Dimensions_ShouldBeOptional(t *testing.T) {
+	record, err := parseRecord(`{"id":"1","customer_id":"2","load_amount":"$10.00","time":"2020-11-09T10:00:00Z","funding_source":"fp-9","merchant_id":"m-1"}`)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "fp-9", record.FundingSource)
+	assert.Equal(t, "m-1", record.MerchantID)
+
+	record, err = parseRecord(`{"id":"1","customer_id":"2","load_amount":"$10.00","time":"2020-11-09T10:00:00Z"}`)
+
+	assert.Nil(t, err)
+	assert.Empty(t, record.MerchantID)
+
+	line, _ := json.Marshal(newJsonRecord(newTransaction(record)))
+
+	assert.Equal(t, `{"id":"1","customer_id":"2","load_amount":"$10.00","time":"2020-11-09T10:00:00Z"}`, string(line))
+}
+
+func TestReloadRules_CustomRules_ShouldCompileAndReportErrors(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	filename := writeTestConfig(t, "custom.yaml", "rules:\n  night: hour < 6 && load_amount > 500\n")
+
+	v := newConfig()
+	assert.Nil(t, readConfig(v, filename))
+
+	rules, err := reloadRules(v)
+
+	assert.Nil(t, err)
+	if assert.Len(t, rules.Custom, 1) {
+		assert.Equal(t, "night", rules.Custom[0].Name)
+	}
+
+	writeTestConfig(t, "custom.yaml", "rules:\n  night: hour < 6 &&\n")
+	assert.Nil(t, v.ReadInConfig())
+
+	_, err = reloadRules(v)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "invalid configuration: rules.night: column 12: unexpected end of expression", err.Error())
+	assert.Equal(t, rules, currentRules())
+}
+
+func TestProcessRecord_ReviewAction_ShouldAcceptAndFlag(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	soft := limits
+	soft.DailyAmountAction = actionReview
+	activateRules(newRuleSet(soft))
+
+	records := generateRecords(2)
+	records[0].LoadAmount = 6000
+	records[1].CustomerID, records[1].LoadAmount = records[0].CustomerID, 100
+
+	response, err := processRecord(records[0])
+
+	assert.Nil(t, err)
+	assert.True(t, response.Accepted)
+	assert.Equal(t, statusReview, response.Status)
+	assert.Equal(t, reasonDailyAmount, response.Reason)
+
+	// The flagged load was saved, so it counts toward the limits.
+	response, err = processRecord(records[1])
+
+	assert.Nil(t, err)
+	assert.Equal(t, statusReview, response.Status)
+	assert.Equal(t, db.Usage{Total: 6000, Count: 1}, response.Usage[db.WindowDay])
+}
+
+func TestProcessRecord_Priorities_ShouldApplyFirstMatchingRule(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	custom, problems := compileRules(map[string]interface{}{
+		"large": map[string]interface{}{"when": "load_amount > 4900", "action": actionStepUp, "priority": 5},
+		"any":   map[string]interface{}{"when": "load_amount > 100", "action": actionReview},
+		"tiny":  "load_amount < 1",
+	}, "sqlite3")
+
+	assert.Empty(t, problems)
+	activateRules(newRuleSet(limits, custom...))
+
+	tests := []struct {
+		amount   float64
+		status   string
+		accepted bool
+		reason   string
+	}{
+		// The step-up rule runs before the daily amount limit.
+		{6000, statusStepUp, false, "large"},
+		{4950, statusStepUp, false, "large"},
+		{200, statusReview, true, "any"},
+		{50, statusAccepted, true, ""},
+		{0.5, statusDeclined, false, "tiny"},
+		{4800, statusDeclined, false, reasonDailyAmount},
+	}
+
+	for i, test := range tests {
+		response, err := processRecord(Record{ID: uint(i + 1), CustomerID: 3, LoadAmount: test.amount, Time: time.Date(2020, 11, 9, 10, i, 0, 0, time.UTC)})
+
+		assert.Nil(t, err)
+		assert.Equal(t, test.status, response.Status, test.amount)
+		assert.Equal(t, test.accepted, response.Accepted, test.amount)
+		assert.Equal(t, test.reason, response.Reason, test.amount)
+	}
+}
+
+func TestCompileRules_InvalidDefinitions_ShouldReportProblems(t *testing.T) {
+	_, problems := compileRules(map[string]interface{}{
+		"no-condition": map[string]interface{}{"action": actionReview},
+		"bad-action":   map[string]interface{}{"when": "true", "action": "ignore"},
+		"bad-priority": map[string]interface{}{"when": "true", "priority": "first"},
+		"bad-field":    map[string]interface{}{"when": "true", "unless": "false"},
+		"list":         []interface{}{"true"},
+	}, "sqlite3")
+
+	assert.Equal(t, []configProblem{
+		{"rules.bad-action", "action: unknown action ignore, expected one of decline, review or step-up"},
+		{"rules.bad-field", "unknown field unless, expected when, action or priority"},
+		{"rules.bad-priority", "priority: unable to cast \"first\" of type string to int"},
+		{"rules.list", "expected an expression or a table of when, action and priority"},
+		{"rules.no-condition", "missing when, the condition of the rule"},
+	}, problems)
+}
+
+func TestCompileRules_HistoryRulesWithRedis_ShouldReportProblems(t *testing.T) {
+	definitions := map[string]interface{}{
+		"night":     "hour < 6 && load_amount > 500",
+		"new":       "!(account_age() >= 7d) && load_amount > 1000",
+		"merchants": map[string]interface{}{"when": "load_amount > 100 && sum_by(merchant, day) > 5000", "action": actionReview},
+	}
+
+	custom, problems := compileRules(definitions, "redis")
+
+	assert.Len(t, custom, 2)
+
+	assert.Equal(t, []configProblem{
+		{"rules.new", "count, sum and account_age need the transaction history, which the redis dialect does not keep"},
+	}, problems)
+
+	custom, problems = compileRules(definitions, "bolt")
+
+	assert.Len(t, custom, 3)
+	assert.Empty(t, problems)
+}
+
+func TestProcessRecord_PartialApproval_ShouldCapToHeadroom(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	partial := limits
+	partial.PartialApproval = true
+	activateRules(newRuleSet(partial))
+
+	start := time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC)
+	amounts := []float64{3800, 3000, 100}
+
+	var responses []Response
+
+	for i, amount := range amounts {
+		response, err := processRecord(Record{ID: uint(i + 1), CustomerID: 4, LoadAmount: amount, Time: start.Add(time.Duration(i) * time.Minute)})
+
+		assert.Nil(t, err)
+		responses = append(responses, response)
+	}
+
+	assert.True(t, responses[0].Accepted)
+	assert.Equal(t, 3800.0, responses[0].ApprovedAmount)
+
+	assert.True(t, responses[1].Accepted)
+	assert.Equal(t, statusAccepted, responses[1].Status)
+	assert.Equal(t, 1200.0, responses[1].ApprovedAmount)
+
+	bytes, err := json.Marshal(newJsonResponse(responses[1]))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"id\":\"2\",\"customer_id\":\"4\",\"accepted\":true,\"status\":\"accepted\",\"approved_amount\":\"$1200.00\"}", string(bytes))
+
+	// The approved amount counts toward the limits, leaving no headroom.
+	assert.False(t, responses[2].Accepted)
+	assert.Equal(t, reasonDailyAmount, responses[2].Reason)
+	assert.Equal(t, 0.0, responses[2].ApprovedAmount)
+
+	transaction, err := store.FindByLoadID(4, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1200.0, transaction.LoadAmount)
+	assert.Equal(t, 3000.0, transaction.RequestedAmount)
+}
+
+func TestProcessRecord_PartialApproval_ShouldCapToWeeklyHeadroom(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	partial := limits
+	partial.PartialApproval = true
+	activateRules(newRuleSet(partial))
+
+	start := time.Date(2020, 11, 9, 10, 0, 0, 0, time.UTC)
+	amounts := []float64{5000, 5000, 5000, 4000, 3000}
+	approved := []float64{5000, 5000, 5000, 4000, 1000}
+
+	for i, amount := range amounts {
+		response, err := processRecord(Record{ID: uint(i + 1), CustomerID: 5, LoadAmount: amount, Time: start.Add(time.Duration(i) * 24 * time.Hour)})
+
+		assert.Nil(t, err)
+		assert.True(t, response.Accepted)
+		assert.Equal(t, approved[i], response.ApprovedAmount)
+	}
+}
+
+func TestProcessRecord_PartialApprovalWithSoftLimit_ShouldNotCap(t *testing.T) {
+	setup()
+	defer activateRules(newRuleSet(limits))
+
+	partial := limits
+	partial.PartialApproval = true
+	partial.DailyAmountAction = actionReview
+	activateRules(newRuleSet(partial))
+
+	records := generateRecords(1)
+	records[0].LoadAmount = 6000
+
+	response, err := processRecord(records[0])
+
+	assert.Nil(t, err)
+	assert.Equal(t, statusReview, response.Status)
+	assert.Equal(t, 6000.0, response.ApprovedAmount)
+}
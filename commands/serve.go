@@ -0,0 +1,234 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var (
+	listenAddress       string
+	pruneInterval       time.Duration
+	pruneArchiveDir     string
+	reservationTTL      time.Duration
+	sweepInterval       time.Duration
+	serveShutdownPeriod = 10 * time.Second
+
+	serveCommand = &cobra.Command{
+		Use:   "serve",
+		Short: "Evaluate loads over HTTP",
+		Long: `Runs an HTTP server that accepts or declines loads posted to /loads, one JSON load per request,
+in the same format as the lines of the source file, and exposes Prometheus metrics on /metrics.
+The limits are reloaded whenever the config file changes, keeping the active ones if it is invalid.
+
+Loads can also be authorized first: a load posted to /authorize reserves its amount, counted toward the
+limits, until its id and customer_id are posted to /capture, settling it, or to /void, releasing it.
+The reservations not captured in time are released by a periodic sweep.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fs = afero.NewOsFs()
+
+			var err error
+
+			store, err = openStore(databaseDialect, databaseConnection)
+			if err != nil {
+				return errors.New("failed to connect database " + err.Error())
+			}
+			defer store.Close()
+
+			if err := openAuditLog(auditLogFile, auditMaxSize); err != nil {
+				return err
+			}
+			defer closeAuditLog()
+
+			flushSpans, err := setupTracing(otlpEndpoint)
+			if err != nil {
+				return err
+			}
+			defer flushSpans()
+
+			if config.ConfigFileUsed() != "" {
+				watchRules(config)
+			}
+
+			return runServeCommand(listenAddress)
+		},
+	}
+)
+
+func init() {
+	serveCommand.Flags().StringVarP(&listenAddress, "listen", "l", ":8080", "Address to listen on")
+	serveCommand.Flags().DurationVarP(&pruneInterval, "prune-interval", "", 0, "Interval between prunes of old transactions, 0 to disable")
+	serveCommand.Flags().StringVarP(&pruneOlderThan, "prune-older-than", "", "90d", "Prune the transactions older than this, e.g. 90d, 12w or 2160h")
+	serveCommand.Flags().StringVarP(&pruneArchiveDir, "prune-archive-dir", "", "", "Directory to archive the pruned transactions to, one gzipped NDJSON file per prune")
+	serveCommand.Flags().BoolVarP(&pruneHard, "prune-hard", "", false, "Delete the pruned transactions instead of marking them as deleted")
+	serveCommand.Flags().DurationVarP(&reservationTTL, "reservation-ttl", "", 7*24*time.Hour, "Time after which the reservation of an authorized load is released if it is not captured")
+	serveCommand.Flags().DurationVarP(&sweepInterval, "sweep-interval", "", time.Minute, "Interval between releases of the expired reservations, 0 to disable")
+
+	bindCommandConfig(serveCommand)
+
+	rootCmd.AddCommand(serveCommand)
+}
+
+func runServeCommand(address string) error {
+	server := &http.Server{
+		Addr:    address,
+		Handler: newServeHandler(),
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	if pruneInterval > 0 {
+		go schedulePrune(pruneInterval, stop)
+	}
+
+	if sweepInterval > 0 {
+		go scheduleSweep(sweepInterval, stop)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	serveError := make(chan error, 1)
+
+	go func() {
+		logger.WithField("address", address).Info("listening")
+		serveError <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveError:
+		return err
+	case <-signals:
+		ctx, cancel := context.WithTimeout(context.Background(), serveShutdownPeriod)
+		defer cancel()
+
+		return server.Shutdown(ctx)
+	}
+}
+
+func newServeHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loads", handleLoad)
+	mux.HandleFunc("/authorize", handleAuthorize)
+	mux.HandleFunc("/capture", handleCapture)
+	mux.HandleFunc("/void", handleVoid)
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	return mux
+}
+
+// handleLoad evaluates the load in the request body and writes the response, as a line of the destination file.
+func handleLoad(writer http.ResponseWriter, request *http.Request) {
+	serveLoad(writer, request, "handleLoad", 0)
+}
+
+// handleAuthorize evaluates the load in the request body like handleLoad, reserving its amount when it is accepted.
+func handleAuthorize(writer http.ResponseWriter, request *http.Request) {
+	serveLoad(writer, request, "handleAuthorize", reservationTTL)
+}
+
+// serveLoad evaluates the load in the request body, reserving it for the ttl when it is not zero.
+func serveLoad(writer http.ResponseWriter, request *http.Request, name string, ttl time.Duration) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, span := startSpan(request.Context(), name)
+	defer span.End()
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, parseSpan := startSpan(ctx, "parseRecord")
+	record, err := parseRecord(string(body))
+	endSpan(parseSpan, err)
+
+	if err != nil {
+		parseErrors.Inc()
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The reservation is swept by the clock of the server, so it expires after the TTL from now, whatever
+	// the time of the load.
+	if ttl > 0 {
+		record.ReservedUntil = time.Now().Add(ttl).UTC()
+	}
+
+	response, err := processRecordContext(ctx, record)
+	if err != nil {
+		logger.WithError(err).WithField("load", string(body)).Error("failed to process load")
+		http.Error(writer, "failed to process load", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse := newJsonResponse(response)
+	jsonResponse.RulesVersion = response.RulesVersion
+
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(jsonResponse)
+}
+
+// watchRules reloads the rules whenever the config file changes.
+func watchRules(v *viper.Viper) {
+	v.OnConfigChange(func(event fsnotify.Event) {
+		rules, err := reloadRules(v)
+		if err != nil {
+			logger.WithError(err).WithField("file", event.Name).Error("invalid configuration, keeping the active rules")
+			return
+		}
+
+		logger.WithField("version", rules.Version).Info("reloaded the rules")
+	})
+
+	v.WatchConfig()
+}
+
+// schedulePrune prunes the old transactions at every interval until stop is closed.
+func schedulePrune(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			archive := ""
+			if pruneArchiveDir != "" {
+				archive = filepath.Join(pruneArchiveDir, "archive-"+now.UTC().Format("20060102T150405")+".ndjson.gz")
+			}
+
+			count, err := runPrune(pruneOlderThan, archive, pruneHard, now)
+			if err != nil {
+				logger.WithError(err).Error("prune failed")
+				continue
+			}
+
+			if count == 0 && archive != "" {
+				fs.Remove(archive)
+			}
+
+			logger.WithField("count", count).Info("pruned transactions")
+		}
+	}
+}
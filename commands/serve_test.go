@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postLoad(handler http.Handler, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/loads", strings.NewReader(body))
+
+	handler.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestServe_PostLoads_ShouldRespondWithDecisions(t *testing.T) {
+	setup()
+
+	handler := newServeHandler()
+
+	recorder := postLoad(handler, "{\"id\":\"1\",\"customer_id\":\"528\",\"load_amount\":\"$3318.47\",\"time\":\"2000-01-01T00:00:00Z\"}")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "{\"id\":\"1\",\"customer_id\":\"528\",\"accepted\":true,\"status\":\"accepted\",\"rules_version\":\""+currentRules().Version+"\"}\n", recorder.Body.String())
+
+	recorder = postLoad(handler, "{\"id\":\"2\",\"customer_id\":\"528\",\"load_amount\":\"$2000.00\",\"time\":\"2000-01-01T01:00:00Z\"}")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "{\"id\":\"2\",\"customer_id\":\"528\",\"accepted\":false,\"status\":\"declined\",\"reason\":\"daily_amount\",\"rules_version\":\""+currentRules().Version+"\"}\n", recorder.Body.String())
+}
+
+func TestServe_InvalidLoad_ShouldRespondBadRequest(t *testing.T) {
+	setup()
+
+	recorder := postLoad(newServeHandler(), "{\"id\":\"x\"}")
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestServe_Get_ShouldRespondMethodNotAllowed(t *testing.T) {
+	setup()
+
+	recorder := httptest.NewRecorder()
+	newServeHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/loads", nil))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
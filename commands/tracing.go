@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"context"
+	"github.com/dragosv/velocity/db"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/dragosv/velocity/commands"
+
+var otlpEndpoint string
+
+// tracingErrorHandler logs the errors of the tracer provider and the exporter.
+type tracingErrorHandler struct{}
+
+func (tracingErrorHandler) Handle(err error) {
+	if err != nil {
+		logger.WithError(err).Warn("failed to export the spans")
+	}
+}
+
+// setupTracing exports the spans to the OTLP collector at the endpoint. Without an endpoint the spans
+// are not recorded. The returned function flushes the pending spans.
+func setupTracing(endpoint string) (func(), error) {
+	if endpoint == "" {
+		return func() {}, nil
+	}
+
+	exporter, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String("velocity"))),
+	)
+
+	otel.SetErrorHandler(tracingErrorHandler{})
+	otel.SetTracerProvider(provider)
+
+	return func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			logger.WithError(err).Error("failed to flush the spans")
+		}
+	}, nil
+}
+
+// startSpan starts a span of the tracer of the commands.
+func startSpan(ctx context.Context, name string, attributes ...label.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan ends the span, recording the error if there is one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// storeContext returns the context whose span the operations of the store are traced under.
+func storeContext(store db.TransactionStore) context.Context {
+	if instrumented, ok := store.(*instrumentedStore); ok {
+		return instrumented.ctx
+	}
+
+	return context.Background()
+}
+
+// checkRule runs the check of a rule in a span named after its reason, setting the reason of the response
+// when the rule matches the load.
+func checkRule(ctx context.Context, response *Response, reason string, action string, check func(ctx context.Context) (bool, error)) (bool, error) {
+	ctx, span := startSpan(ctx, "rule."+reason)
+
+	matched, err := check(ctx)
+	if matched && err == nil {
+		response.Reason = reason
+	}
+
+	span.SetAttributes(label.Bool("rule.matched", matched), label.String("rule.action", action))
+	endSpan(span, err)
+
+	return matched, err
+}
+
+func recordLabels(record Record) []label.KeyValue {
+	return []label.KeyValue{
+		label.Int64("load.id", int64(record.ID)),
+		label.Int64("load.customer_id", int64(record.CustomerID)),
+	}
+}
@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	exporttrace "go.opentelemetry.io/otel/sdk/export/trace"
+	"go.opentelemetry.io/otel/sdk/export/trace/tracetest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"testing"
+)
+
+func setupTestTracing() (*tracetest.InMemoryExporter, func()) {
+	exporter := tracetest.NewInMemoryExporter()
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	return exporter, func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	}
+}
+
+func spansByName(spans []*exporttrace.SpanData) map[string][]*exporttrace.SpanData {
+	byName := make(map[string][]*exporttrace.SpanData)
+	for _, span := range spans {
+		byName[span.Name] = append(byName[span.Name], span)
+	}
+
+	return byName
+}
+
+func TestServe_PostLoad_ShouldTraceEvaluation(t *testing.T) {
+	setup()
+
+	exporter, teardown := setupTestTracing()
+	defer teardown()
+
+	recorder := postLoad(newServeHandler(), "{\"id\":\"1\",\"customer_id\":\"528\",\"load_amount\":\"$3318.47\",\"time\":\"2000-01-01T00:00:00Z\"}")
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	spans := spansByName(exporter.GetSpans())
+
+	for _, name := range []string{"handleLoad", "parseRecord", "processRecord", "store.transaction",
+		"rule.daily_amount", "rule.daily_count", "rule.weekly_amount", "store.insert"} {
+		assert.Len(t, spans[name], 1, name)
+	}
+
+	assert.Len(t, spans["store.sum_and_count"], 2)
+
+	handle := spans["handleLoad"][0]
+	process := spans["processRecord"][0]
+	transaction := spans["store.transaction"][0]
+	rule := spans["rule.daily_amount"][0]
+
+	assert.Equal(t, handle.SpanContext.SpanID, spans["parseRecord"][0].ParentSpanID)
+	assert.Equal(t, handle.SpanContext.SpanID, process.ParentSpanID)
+	assert.Equal(t, process.SpanContext.SpanID, transaction.ParentSpanID)
+	assert.Equal(t, transaction.SpanContext.SpanID, rule.ParentSpanID)
+	assert.Equal(t, transaction.SpanContext.SpanID, spans["store.insert"][0].ParentSpanID)
+	assert.Equal(t, rule.SpanContext.SpanID, spans["store.sum_and_count"][0].ParentSpanID)
+	assert.Equal(t, handle.SpanContext.TraceID, spans["store.insert"][0].SpanContext.TraceID)
+}
+
+func TestProcessRecord_Declined_ShouldStopTracingAtDecliningRule(t *testing.T) {
+	setup()
+
+	exporter, teardown := setupTestTracing()
+	defer teardown()
+
+	records := generateRecords(1)
+	records[0].LoadAmount = 6000
+
+	response, err := processRecord(records[0])
+	assert.Nil(t, err)
+	assert.False(t, response.Accepted)
+
+	spans := spansByName(exporter.GetSpans())
+
+	assert.Len(t, spans["rule.daily_amount"], 1)
+	assert.Empty(t, spans["rule.weekly_amount"])
+	assert.Empty(t, spans["store.insert"])
+
+	matched := false
+	for _, attribute := range spans["rule.daily_amount"][0].Attributes {
+		if attribute.Key == "rule.matched" {
+			matched = attribute.Value.AsBool()
+		}
+	}
+
+	assert.True(t, matched)
+}
@@ -0,0 +1,174 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+var (
+	verifyExpected string
+	verifyActual   string
+	verifyInput    string
+
+	verifyCommand = &cobra.Command{
+		Use:   "verify",
+		Short: "Compare an output file with the expected one",
+		Long: `Matches the responses of two output files by id and customer id, and reports the mismatched,
+missing and extra responses with the input lines they answer. Fails when the files differ. The responses
+are compared by status, reason and approved amount, or by whether the load was accepted when either has
+no status.`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			fs = afero.NewOsFs()
+
+			differences, err := runVerify(verifyExpected, verifyActual, verifyInput, os.Stdout)
+			if err != nil {
+				return err
+			}
+
+			if differences > 0 {
+				return fmt.Errorf("%d differences between %s and %s", differences, verifyExpected, verifyActual)
+			}
+
+			return nil
+		},
+	}
+)
+
+func init() {
+	verifyCommand.Flags().StringVarP(&verifyExpected, "expected", "e", "expected.txt", "Expected output file")
+	verifyCommand.Flags().StringVarP(&verifyActual, "actual", "a", "output.txt", "Actual output file")
+	verifyCommand.Flags().StringVarP(&verifyInput, "input", "i", "", "Input file, to show the loads the differing responses answer")
+
+	bindCommandConfig(verifyCommand)
+
+	rootCmd.AddCommand(verifyCommand)
+}
+
+// inputLine is a line of a source file.
+type inputLine struct {
+	Line int
+	Text string
+}
+
+// readInputLines reads the lines of a source file by load, without validating them.
+func readInputLines(filename string) (map[responseKey][]inputLine, error) {
+	file, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make(map[responseKey][]inputLine)
+	line := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line++
+
+		var record jsonRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+
+		key := responseKey{ID: record.ID, CustomerID: record.CustomerID}
+		lines[key] = append(lines[key], inputLine{Line: line, Text: scanner.Text()})
+	}
+
+	return lines, scanner.Err()
+}
+
+// runVerify writes to the report the differences between the expected and the actual output files,
+// and returns how many there are. The n-th response to a load in one file is matched with the n-th
+// response to the same load in the other.
+func runVerify(expected string, actual string, input string, report io.Writer) (int, error) {
+	expectedLines, err := readResponseLines(expected)
+	if err != nil {
+		return 0, err
+	}
+
+	actualLines, err := readResponseLines(actual)
+	if err != nil {
+		return 0, err
+	}
+
+	inputLines := make(map[responseKey][]inputLine)
+	if input != "" {
+		if inputLines, err = readInputLines(input); err != nil {
+			return 0, err
+		}
+	}
+
+	// context returns the input line of the n-th response to the load.
+	occurrences := make(map[responseKey]int)
+	context := func(key responseKey, occurrence int) string {
+		lines := inputLines[key]
+		if occurrence >= len(lines) {
+			return ""
+		}
+
+		return fmt.Sprintf("\n    %s:%d %s", input, lines[occurrence].Line, lines[occurrence].Text)
+	}
+
+	pending := make(map[responseKey][]responseLine)
+	for _, line := range actualLines {
+		pending[line.Key] = append(pending[line.Key], line)
+	}
+
+	matched, mismatched, missing, extra := 0, 0, 0, 0
+
+	for _, expectedLine := range expectedLines {
+		occurrence := occurrences[expectedLine.Key]
+		occurrences[expectedLine.Key]++
+
+		candidates := pending[expectedLine.Key]
+		if len(candidates) == 0 {
+			missing++
+			fmt.Fprintf(report, "missing %s:%d %s%s\n", expected, expectedLine.Line, expectedLine.Text,
+				context(expectedLine.Key, occurrence))
+			continue
+		}
+
+		actualLine := candidates[0]
+		pending[expectedLine.Key] = candidates[1:]
+
+		if actualLine.sameDecision(expectedLine) {
+			matched++
+			continue
+		}
+
+		mismatched++
+		fmt.Fprintf(report, "mismatch %s:%d expected %s, %s:%d got %s%s\n",
+			expected, expectedLine.Line, expectedLine.describe(),
+			actual, actualLine.Line, actualLine.describe(),
+			context(expectedLine.Key, occurrence))
+	}
+
+	for _, actualLine := range actualLines {
+		candidates := pending[actualLine.Key]
+		if len(candidates) == 0 || candidates[0].Line != actualLine.Line {
+			continue
+		}
+
+		pending[actualLine.Key] = candidates[1:]
+
+		occurrence := occurrences[actualLine.Key]
+		occurrences[actualLine.Key]++
+
+		extra++
+		fmt.Fprintf(report, "extra %s:%d %s%s\n", actual, actualLine.Line, actualLine.Text,
+			context(actualLine.Key, occurrence))
+	}
+
+	differences := mismatched + missing + extra
+
+	_, err = fmt.Fprintf(report, "%d matched, %d mismatched, %d missing, %d extra\n", matched, mismatched, missing, extra)
+
+	return differences, err
+}
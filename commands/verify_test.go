@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"bytes"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRunVerify_DifferentOutputs_ShouldReportDifferences(t *testing.T) {
+	setup()
+
+	afero.WriteFile(fs, source, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T00:00:00Z\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"{\"id\":\"3\",\"customer_id\":\"2\",\"load_amount\":\"$100.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"{\"id\":\"4\",\"customer_id\":\"2\",\"load_amount\":\"$100.00\",\"time\":\"2000-01-01T02:00:00Z\"}\n"), 0644)
+
+	afero.WriteFile(fs, "expected.txt", []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":true}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"accepted\":false}\n"+
+		"{\"id\":\"3\",\"customer_id\":\"2\",\"accepted\":true}\n"), 0644)
+
+	afero.WriteFile(fs, destination, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":true}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"accepted\":true}\n"+
+		"{\"id\":\"4\",\"customer_id\":\"2\",\"accepted\":true}\n"), 0644)
+
+	var report bytes.Buffer
+
+	differences, err := runVerify("expected.txt", destination, source, &report)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, differences)
+	assert.Equal(t, "mismatch expected.txt:2 expected declined, "+destination+":2 got accepted\n"+
+		"    "+source+":2 {\"id\":\"2\",\"customer_id\":\"1\",\"load_amount\":\"$3000.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"missing expected.txt:3 {\"id\":\"3\",\"customer_id\":\"2\",\"accepted\":true}\n"+
+		"    "+source+":3 {\"id\":\"3\",\"customer_id\":\"2\",\"load_amount\":\"$100.00\",\"time\":\"2000-01-01T01:00:00Z\"}\n"+
+		"extra "+destination+":3 {\"id\":\"4\",\"customer_id\":\"2\",\"accepted\":true}\n"+
+		"    "+source+":4 {\"id\":\"4\",\"customer_id\":\"2\",\"load_amount\":\"$100.00\",\"time\":\"2000-01-01T02:00:00Z\"}\n"+
+		"1 matched, 1 mismatched, 1 missing, 1 extra\n", report.String())
+}
+
+func TestRunVerify_SameOutputs_ShouldReportNoDifferences(t *testing.T) {
+	setup()
+
+	output := []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":true}\n{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":false}\n")
+
+	afero.WriteFile(fs, "expected.txt", output, 0644)
+	afero.WriteFile(fs, destination, output, 0644)
+
+	var report bytes.Buffer
+
+	differences, err := runVerify("expected.txt", destination, "", &report)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, differences)
+	assert.Equal(t, "2 matched, 0 mismatched, 0 missing, 0 extra\n", report.String())
+}
+
+func TestRunVerify_DifferentStatuses_ShouldReportMismatches(t *testing.T) {
+	setup()
+
+	afero.WriteFile(fs, "expected.txt", []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":false,\"status\":\"review\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"accepted\":false,\"status\":\"declined\",\"reason\":\"daily_amount\"}\n"+
+		"{\"id\":\"3\",\"customer_id\":\"1\",\"accepted\":true}\n"), 0644)
+
+	afero.WriteFile(fs, destination, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":false,\"status\":\"step_up\"}\n"+
+		"{\"id\":\"2\",\"customer_id\":\"1\",\"accepted\":false,\"status\":\"declined\",\"reason\":\"weekly_amount\"}\n"+
+		"{\"id\":\"3\",\"customer_id\":\"1\",\"accepted\":true,\"status\":\"accepted\"}\n"), 0644)
+
+	var report bytes.Buffer
+
+	differences, err := runVerify("expected.txt", destination, "", &report)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, differences)
+	assert.Equal(t, "mismatch expected.txt:1 expected review, "+destination+":1 got step_up\n"+
+		"mismatch expected.txt:2 expected declined (daily_amount), "+destination+":2 got declined (weekly_amount)\n"+
+		"1 matched, 2 mismatched, 0 missing, 0 extra\n", report.String())
+}
+
+func TestRunVerify_DifferentApprovedAmounts_ShouldReportMismatch(t *testing.T) {
+	setup()
+
+	afero.WriteFile(fs, "expected.txt", []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":true,\"status\":\"accepted\",\"approved_amount\":\"$1200.00\"}\n"), 0644)
+	afero.WriteFile(fs, destination, []byte("{\"id\":\"1\",\"customer_id\":\"1\",\"accepted\":true,\"status\":\"accepted\",\"approved_amount\":\"$1000.00\"}\n"), 0644)
+
+	var report bytes.Buffer
+
+	differences, err := runVerify("expected.txt", destination, "", &report)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, differences)
+	assert.Equal(t, "mismatch expected.txt:1 expected accepted $1200.00, "+destination+":1 got accepted $1000.00\n"+
+		"0 matched, 1 mismatched, 0 missing, 0 extra\n", report.String())
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// MaxTransactionAttempts is how many times a transaction is attempted before a conflict is reported.
+const MaxTransactionAttempts = 5
+
+// RunInTransaction runs fn in a serializable database transaction. When the database aborts the
+// transaction because of a conflict with a concurrent one, fn is retried in a new transaction.
+// If the database is already in a transaction, fn joins it.
+func RunInTransaction(database *gorm.DB, fn func(tx *gorm.DB) error) (err error) {
+	if _, ok := database.CommonDB().(*sql.Tx); ok {
+		return fn(database)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = runInTransaction(database, fn)
+
+		if err == nil || attempt >= MaxTransactionAttempts || !IsRetryable(err) {
+			return
+		}
+
+		time.Sleep(time.Duration(rand.Intn(10*attempt)+1) * time.Millisecond)
+	}
+}
+
+func runInTransaction(database *gorm.DB, fn func(tx *gorm.DB) error) (err error) {
+	tx := database.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = fn(tx)
+
+	if err == nil {
+		err = tx.Commit().Error
+	}
+
+	panicked = false
+	return
+}
+
+// ForUpdate makes the queries of a transaction lock the rows they read until the transaction ends,
+// on the dialects that support it. SQLite locks the whole database on BEGIN IMMEDIATE instead.
+func ForUpdate(database *gorm.DB) *gorm.DB {
+	switch database.Dialect().GetName() {
+	case "postgres", "mysql":
+		return database.Set("gorm:query_option", "FOR UPDATE")
+	}
+
+	return database
+}
+
+// IsRetryable reports whether the error is caused by a conflict with a concurrent transaction,
+// in which case the transaction can be safely retried.
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case *pq.Error:
+		// serialization_failure, deadlock_detected, unique_violation
+		return e.Code == "40001" || e.Code == "40P01" || e.Code == "23505"
+	case *mysql.MySQLError:
+		// ER_LOCK_DEADLOCK, ER_LOCK_WAIT_TIMEOUT, ER_DUP_ENTRY
+		return e.Number == 1213 || e.Number == 1205 || e.Number == 1062
+	case sqlite3.Error:
+		return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked ||
+			e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || e.ExtendedCode == sqlite3.ErrConstraintUnique
+	case mssql.Error:
+		// deadlock victim, snapshot update conflict, duplicate key
+		return e.Number == 1205 || e.Number == 3960 || e.Number == 2627 || e.Number == 2601
+	}
+
+	return false
+}
+
+// sqliteConnection makes SQLite transactions take the write lock when they begin, so that
+// concurrent check-and-insert transactions are serialized instead of failing on upgrade.
+func sqliteConnection(databaseConnection string) string {
+	if strings.Contains(databaseConnection, "_txlock=") {
+		return databaseConnection
+	}
+
+	if strings.Contains(databaseConnection, "?") {
+		return databaseConnection + "&_txlock=immediate"
+	}
+
+	return databaseConnection + "?_txlock=immediate"
+}
@@ -0,0 +1,748 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	transactionsBucket   = []byte("transactions")
+	loadsBucket          = []byte("loads")
+	usageBucket          = []byte("usage")
+	dimensionUsageBucket = []byte("dimension_usage")
+	listingsBucket       = []byte("listings")
+	reservationsBucket   = []byte("reservations")
+	metaBucket           = []byte("meta")
+
+	formatKey = []byte("format")
+)
+
+// boltFormat is the version of the key format. The files of version 1, without one, kept the times as
+// unsigned, sorting the times before 1970 after the others, and the files of version 2 had no dimension usage.
+const boltFormat = 3
+
+// BoltStore is a TransactionStore kept in a single bbolt file, for deployments without a SQL database.
+//
+// The transactions bucket holds a nested bucket per customer, with the transactions ordered by time.
+// The loads bucket indexes them by customer and load id, the usage bucket holds the day and week
+// aggregates of every customer, and the dimension usage bucket the ones of every value of the dimensions. The listings bucket holds the listing of the customers on a list, and the
+// reservations bucket indexes the authorized transactions by the expiry of their reservation. The meta bucket
+// holds the version of the key format.
+type BoltStore struct {
+	database *bolt.DB
+}
+
+// OpenBoltStore opens the bbolt file at the path, creating it if it does not exist.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	database, err := bolt.Open(strings.TrimPrefix(path, "file:"), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{transactionsBucket, loadsBucket, usageBucket, dimensionUsageBucket, listingsBucket, reservationsBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return upgradeBoltFormat(tx)
+	})
+
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+
+	return &BoltStore{database: database}, nil
+}
+
+func (s *BoltStore) RunInTransaction(fn func(store TransactionStore) error) error {
+	return s.database.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTransaction{tx: tx})
+	})
+}
+
+func (s *BoltStore) SumAndCount(customerID uint, kind string, key string) (usage Usage, err error) {
+	err = s.database.View(func(tx *bolt.Tx) error {
+		usage, err = (&boltTransaction{tx: tx}).SumAndCount(customerID, kind, key)
+		return err
+	})
+
+	return
+}
+
+func (s *BoltStore) SumAndCountBy(dimension string, value string, kind string, key string) (usage Usage, err error) {
+	err = s.database.View(func(tx *bolt.Tx) error {
+		usage, err = (&boltTransaction{tx: tx}).SumAndCountBy(dimension, value, kind, key)
+		return err
+	})
+
+	return
+}
+
+func (s *BoltStore) Insert(transaction *Transaction) error {
+	return s.RunInTransaction(func(store TransactionStore) error {
+		return store.Insert(transaction)
+	})
+}
+
+func (s *BoltStore) FindByLoadID(customerID uint, loadID uint) (transaction *Transaction, err error) {
+	err = s.database.View(func(tx *bolt.Tx) error {
+		transaction, err = (&boltTransaction{tx: tx}).FindByLoadID(customerID, loadID)
+		return err
+	})
+
+	return
+}
+
+func (s *BoltStore) Scan(filter TransactionFilter, fn func(transaction Transaction) error) error {
+	return s.database.View(func(tx *bolt.Tx) error {
+		return (&boltTransaction{tx: tx}).Scan(filter, fn)
+	})
+}
+
+func (s *BoltStore) Prune(before time.Time, hard bool, archive PruneArchive) (count int, err error) {
+	err = s.database.Update(func(tx *bolt.Tx) error {
+		count = 0
+
+		loads := tx.Bucket(loadsBucket)
+		customers := tx.Bucket(transactionsBucket)
+		limit := boltTime(before)
+
+		err := customers.ForEach(func(customerID []byte, value []byte) error {
+			customer := customers.Bucket(customerID)
+			if customer == nil {
+				return nil
+			}
+
+			cursor := customer.Cursor()
+
+			for key, value := cursor.First(); key != nil && bytes.Compare(key[:8], limit) < 0; key, value = cursor.First() {
+				var transaction Transaction
+
+				if err := json.Unmarshal(value, &transaction); err != nil {
+					return err
+				}
+
+				if archive != nil {
+					if err := archive.Archive(transaction); err != nil {
+						return err
+					}
+				}
+
+				if err := loads.Delete(boltLoadKey(transaction.CustomerID, transaction.TransactionID)); err != nil {
+					return err
+				}
+
+				if transaction.State == StateAuthorized && transaction.ExpiresAt != nil {
+					if err := tx.Bucket(reservationsBucket).Delete(boltReservationKey(&transaction)); err != nil {
+						return err
+					}
+				}
+
+				if err := cursor.Delete(); err != nil {
+					return err
+				}
+
+				count++
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		// The removals are committed with the bolt transaction, after the archive is completed.
+		if archive != nil {
+			if err := archive.Complete(); err != nil {
+				return err
+			}
+		}
+
+		ended := endedWindowKeys(before)
+
+		err = pruneBoltUsage(tx.Bucket(usageBucket), ended, func(key []byte) []string {
+			return strings.SplitN(string(key[8:]), "/", 2)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return pruneBoltUsage(tx.Bucket(dimensionUsageBucket), ended, func(key []byte) []string {
+			return strings.SplitN(string(key), "/", 3)
+		})
+	})
+
+	if err != nil {
+		count = 0
+	}
+
+	return
+}
+
+// pruneBoltUsage removes the usage of the windows that ended, window returning the kind and the key of the
+// window of a usage key first.
+func pruneBoltUsage(usages *bolt.Bucket, ended map[string]string, window func(key []byte) []string) error {
+	cursor := usages.Cursor()
+
+	for key, _ := cursor.First(); key != nil; {
+		if kindAndKey := window(key); len(kindAndKey) >= 2 && kindAndKey[1] < ended[kindAndKey[0]] {
+			deleted := append([]byte(nil), key...)
+
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+
+			key, _ = cursor.Seek(deleted)
+		} else {
+			key, _ = cursor.Next()
+		}
+	}
+
+	return nil
+}
+
+func (s *BoltStore) SetState(transaction *Transaction, state string) error {
+	return s.RunInTransaction(func(store TransactionStore) error {
+		return store.SetState(transaction, state)
+	})
+}
+
+func (s *BoltStore) ScanExpired(at time.Time, fn func(transaction Transaction) error) error {
+	return s.database.View(func(tx *bolt.Tx) error {
+		return (&boltTransaction{tx: tx}).ScanExpired(at, fn)
+	})
+}
+
+func (s *BoltStore) FindListing(customerID uint) (listing *CustomerListing, err error) {
+	err = s.database.View(func(tx *bolt.Tx) error {
+		listing, err = (&boltTransaction{tx: tx}).FindListing(customerID)
+		return err
+	})
+
+	return
+}
+
+func (s *BoltStore) SaveListing(listing *CustomerListing) error {
+	return s.RunInTransaction(func(store TransactionStore) error {
+		return store.SaveListing(listing)
+	})
+}
+
+func (s *BoltStore) DeleteListing(customerID uint) (deleted bool, err error) {
+	err = s.RunInTransaction(func(store TransactionStore) error {
+		deleted, err = store.DeleteListing(customerID)
+		return err
+	})
+
+	return
+}
+
+func (s *BoltStore) Close() error {
+	return s.database.Close()
+}
+
+type boltTransaction struct {
+	tx *bolt.Tx
+}
+
+func (t *boltTransaction) RunInTransaction(fn func(store TransactionStore) error) error {
+	return fn(t)
+}
+
+func (t *boltTransaction) SumAndCount(customerID uint, kind string, key string) (Usage, error) {
+	value := t.tx.Bucket(usageBucket).Get(boltUsageKey(customerID, kind, key))
+	if value == nil {
+		return Usage{}, nil
+	}
+
+	return decodeUsage(value)
+}
+
+func (t *boltTransaction) SumAndCountBy(dimension string, value string, kind string, key string) (Usage, error) {
+	usage := t.tx.Bucket(dimensionUsageBucket).Get(boltDimensionUsageKey(dimension, value, kind, key))
+	if usage == nil {
+		return Usage{}, nil
+	}
+
+	return decodeUsage(usage)
+}
+
+func (t *boltTransaction) Insert(transaction *Transaction) error {
+	if !t.tx.Writable() {
+		return errors.New("insert outside of a writable transaction")
+	}
+
+	customers := t.tx.Bucket(transactionsBucket)
+
+	customer, err := customers.CreateBucketIfNotExists(boltUint(transaction.CustomerID))
+	if err != nil {
+		return err
+	}
+
+	sequence, err := customers.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	transaction.ID = uint(sequence)
+	transaction.CreatedAt = now
+	transaction.UpdatedAt = now
+
+	value, err := json.Marshal(transaction)
+	if err != nil {
+		return err
+	}
+
+	transactionKey := boltTransactionKey(transaction)
+
+	if err := customer.Put(transactionKey, value); err != nil {
+		return err
+	}
+
+	if err := t.tx.Bucket(loadsBucket).Put(boltLoadKey(transaction.CustomerID, transaction.TransactionID), transactionKey); err != nil {
+		return err
+	}
+
+	if transaction.State == StateAuthorized && transaction.ExpiresAt != nil {
+		if err := t.tx.Bucket(reservationsBucket).Put(boltReservationKey(transaction), nil); err != nil {
+			return err
+		}
+	}
+
+	return t.addUsage(transaction, 1)
+}
+
+// addUsage adds the transaction to the usage of the customer and of its dimensions, or takes it out for a
+// negative sign.
+func (t *boltTransaction) addUsage(transaction *Transaction, sign int) error {
+	for _, kind := range []string{WindowDay, WindowWeek} {
+		key := boltUsageKey(transaction.CustomerID, kind, WindowKey(kind, transaction.Time))
+
+		if err := addBoltUsage(t.tx.Bucket(usageBucket), key, transaction.LoadAmount, sign); err != nil {
+			return err
+		}
+	}
+
+	return t.addDimensionUsage(transaction, sign)
+}
+
+// addDimensionUsage adds the transaction to the usage of its dimensions, or takes it out for a negative sign.
+func (t *boltTransaction) addDimensionUsage(transaction *Transaction, sign int) error {
+	for _, kind := range []string{WindowDay, WindowWeek} {
+		for _, value := range dimensionValues(transaction) {
+			key := boltDimensionUsageKey(value.dimension, value.value, kind, WindowKey(kind, transaction.Time))
+
+			if err := addBoltUsage(t.tx.Bucket(dimensionUsageBucket), key, transaction.LoadAmount, sign); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// addBoltUsage adds the amount to the usage of the key, or takes it out for a negative sign, leaving the
+// usage of the windows that were pruned alone.
+func addBoltUsage(usages *bolt.Bucket, key []byte, amount float64, sign int) error {
+	usage := Usage{}
+
+	if value := usages.Get(key); value != nil {
+		var err error
+		if usage, err = decodeUsage(value); err != nil {
+			return err
+		}
+	} else if sign < 0 {
+		return nil
+	}
+
+	usage.Total += float64(sign) * amount
+	usage.Count = uint(int(usage.Count) + sign)
+
+	return usages.Put(key, encodeUsage(usage))
+}
+
+func (t *boltTransaction) SetState(transaction *Transaction, state string) error {
+	if !t.tx.Writable() {
+		return errors.New("set state outside of a writable transaction")
+	}
+
+	transactionKey := t.tx.Bucket(loadsBucket).Get(boltLoadKey(transaction.CustomerID, transaction.TransactionID))
+	customer := t.tx.Bucket(transactionsBucket).Bucket(boltUint(transaction.CustomerID))
+
+	if transactionKey == nil || customer == nil || customer.Get(transactionKey) == nil {
+		return errors.New("set the state of a transaction that is not saved")
+	}
+
+	var saved Transaction
+
+	if err := json.Unmarshal(customer.Get(transactionKey), &saved); err != nil {
+		return err
+	}
+
+	if saved.State == StateAuthorized && saved.ExpiresAt != nil {
+		if err := t.tx.Bucket(reservationsBucket).Delete(boltReservationKey(&saved)); err != nil {
+			return err
+		}
+	}
+
+	released := saved.Counted() && !(&Transaction{State: state}).Counted()
+
+	saved.State = state
+	saved.UpdatedAt = time.Now()
+
+	value, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// The key is copied, as the values of a bucket are only valid until it is changed.
+	if err := customer.Put(append([]byte(nil), transactionKey...), value); err != nil {
+		return err
+	}
+
+	transaction.State = state
+
+	if released {
+		return t.addUsage(&saved, -1)
+	}
+
+	return nil
+}
+
+func (t *boltTransaction) ScanExpired(at time.Time, fn func(transaction Transaction) error) error {
+	cursor := t.tx.Bucket(reservationsBucket).Cursor()
+	limit := boltTime(at)
+
+	for key, _ := cursor.First(); key != nil && bytes.Compare(key[:8], limit) <= 0; key, _ = cursor.Next() {
+		transaction, err := t.FindByLoadID(uint(binary.BigEndian.Uint64(key[8:])), uint(binary.BigEndian.Uint64(key[16:])))
+		if err != nil {
+			return err
+		}
+
+		if transaction == nil || !transaction.ExpiredAt(at) {
+			continue
+		}
+
+		if err := fn(*transaction); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *boltTransaction) FindByLoadID(customerID uint, loadID uint) (*Transaction, error) {
+	transactionKey := t.tx.Bucket(loadsBucket).Get(boltLoadKey(customerID, loadID))
+	if transactionKey == nil {
+		return nil, nil
+	}
+
+	customer := t.tx.Bucket(transactionsBucket).Bucket(boltUint(customerID))
+	if customer == nil {
+		return nil, nil
+	}
+
+	value := customer.Get(transactionKey)
+	if value == nil {
+		return nil, nil
+	}
+
+	var transaction Transaction
+
+	if err := json.Unmarshal(value, &transaction); err != nil {
+		return nil, err
+	}
+
+	return &transaction, nil
+}
+
+func (t *boltTransaction) Scan(filter TransactionFilter, fn func(transaction Transaction) error) error {
+	customers := t.tx.Bucket(transactionsBucket)
+
+	scanCustomer := func(customer *bolt.Bucket) error {
+		cursor := customer.Cursor()
+
+		key, value := cursor.First()
+		if !filter.From.IsZero() {
+			key, value = cursor.Seek(boltTime(filter.From))
+		}
+
+		for ; key != nil; key, value = cursor.Next() {
+			var transaction Transaction
+
+			if err := json.Unmarshal(value, &transaction); err != nil {
+				return err
+			}
+
+			if !filter.To.IsZero() && !transaction.Time.Before(filter.To) {
+				return nil
+			}
+
+			if !filter.Matches(&transaction) {
+				continue
+			}
+
+			if err := fn(transaction); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if filter.CustomerID != nil {
+		customer := customers.Bucket(boltUint(*filter.CustomerID))
+		if customer == nil {
+			return nil
+		}
+
+		return scanCustomer(customer)
+	}
+
+	return customers.ForEach(func(customerID []byte, value []byte) error {
+		customer := customers.Bucket(customerID)
+		if customer == nil {
+			return nil
+		}
+
+		return scanCustomer(customer)
+	})
+}
+
+func (t *boltTransaction) Prune(before time.Time, hard bool, archive PruneArchive) (int, error) {
+	return 0, errors.New("prune inside of a transaction")
+}
+
+func (t *boltTransaction) FindListing(customerID uint) (*CustomerListing, error) {
+	value := t.tx.Bucket(listingsBucket).Get(boltUint(customerID))
+	if value == nil {
+		return nil, nil
+	}
+
+	var listing CustomerListing
+
+	if err := json.Unmarshal(value, &listing); err != nil {
+		return nil, err
+	}
+
+	return &listing, nil
+}
+
+func (t *boltTransaction) SaveListing(listing *CustomerListing) error {
+	if !t.tx.Writable() {
+		return errors.New("save listing outside of a writable transaction")
+	}
+
+	if listing.CreatedAt.IsZero() {
+		listing.CreatedAt = time.Now()
+	}
+
+	value, err := json.Marshal(listing)
+	if err != nil {
+		return err
+	}
+
+	return t.tx.Bucket(listingsBucket).Put(boltUint(listing.CustomerID), value)
+}
+
+func (t *boltTransaction) DeleteListing(customerID uint) (bool, error) {
+	if !t.tx.Writable() {
+		return false, errors.New("delete listing outside of a writable transaction")
+	}
+
+	listings := t.tx.Bucket(listingsBucket)
+	key := boltUint(customerID)
+
+	if listings.Get(key) == nil {
+		return false, nil
+	}
+
+	return true, listings.Delete(key)
+}
+
+func (t *boltTransaction) Close() error {
+	return nil
+}
+
+func boltUint(value uint) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(value))
+
+	return key
+}
+
+// boltTime encodes the time so that the keys sort in time order, with the sign bit flipped so that the
+// times before 1970 sort first.
+func boltTime(at time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(at.UnixNano())^1<<63)
+
+	return key
+}
+
+// boltTransactionKey orders the transactions of a customer by time, then by id.
+func boltTransactionKey(transaction *Transaction) []byte {
+	return append(boltTime(transaction.Time), boltUint(transaction.ID)...)
+}
+
+func boltLoadKey(customerID uint, loadID uint) []byte {
+	return append(boltUint(customerID), boltUint(loadID)...)
+}
+
+// boltReservationKey orders the reservations by expiry, then by customer and load id.
+func boltReservationKey(transaction *Transaction) []byte {
+	return append(boltTime(*transaction.ExpiresAt), boltLoadKey(transaction.CustomerID, transaction.TransactionID)...)
+}
+
+func boltUsageKey(customerID uint, kind string, key string) []byte {
+	return append(boltUint(customerID), []byte(kind+"/"+key)...)
+}
+
+// boltDimensionUsageKey leads with the window, as the values of the dimensions may hold any character.
+func boltDimensionUsageKey(dimension string, value string, kind string, key string) []byte {
+	return []byte(kind + "/" + key + "/" + dimension + "/" + value)
+}
+
+func encodeUsage(usage Usage) []byte {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value, math.Float64bits(usage.Total))
+	binary.BigEndian.PutUint64(value[8:], uint64(usage.Count))
+
+	return value
+}
+
+func decodeUsage(value []byte) (Usage, error) {
+	if len(value) != 16 {
+		return Usage{}, errors.New("invalid usage value")
+	}
+
+	return Usage{
+		Total: math.Float64frombits(binary.BigEndian.Uint64(value)),
+		Count: uint(binary.BigEndian.Uint64(value[8:])),
+	}, nil
+}
+
+// upgradeBoltFormat rewrites the keys of a file of an older format.
+func upgradeBoltFormat(tx *bolt.Tx) error {
+	meta := tx.Bucket(metaBucket)
+
+	format := uint64(1)
+	if value := meta.Get(formatKey); value != nil {
+		format = binary.BigEndian.Uint64(value)
+	}
+
+	if format < 2 {
+		if err := flipBoltTimeKeys(tx); err != nil {
+			return err
+		}
+	}
+
+	if format < 3 {
+		if err := addBoltDimensionUsage(tx); err != nil {
+			return err
+		}
+	}
+
+	return meta.Put(formatKey, boltUint(boltFormat))
+}
+
+// addBoltDimensionUsage adds the transactions counting toward the limits to the usage of their dimensions,
+// converting the files of the format 2 to the format 3.
+func addBoltDimensionUsage(tx *bolt.Tx) error {
+	customers := tx.Bucket(transactionsBucket)
+	t := &boltTransaction{tx: tx}
+
+	return customers.ForEach(func(customerID []byte, value []byte) error {
+		customer := customers.Bucket(customerID)
+		if customer == nil {
+			return nil
+		}
+
+		return customer.ForEach(func(key []byte, value []byte) error {
+			var transaction Transaction
+
+			if err := json.Unmarshal(value, &transaction); err != nil {
+				return err
+			}
+
+			if !transaction.Counted() {
+				return nil
+			}
+
+			return t.addDimensionUsage(&transaction, 1)
+		})
+	})
+}
+
+// flipBoltTimeKeys flips the sign bit of the times leading the keys of the transactions and the
+// reservations, and the values of the loads index, converting them between the formats 1 and 2.
+func flipBoltTimeKeys(tx *bolt.Tx) error {
+	customers := tx.Bucket(transactionsBucket)
+
+	err := customers.ForEach(func(customerID []byte, value []byte) error {
+		if customer := customers.Bucket(customerID); customer != nil {
+			return flipBoltBucket(customer, true)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := flipBoltBucket(tx.Bucket(reservationsBucket), true); err != nil {
+		return err
+	}
+
+	return flipBoltBucket(tx.Bucket(loadsBucket), false)
+}
+
+// flipBoltBucket flips the sign bit of the time leading the keys, or the values, of the bucket. All the
+// entries are removed before they are put back, as a flipped key may be the key of another entry.
+func flipBoltBucket(bucket *bolt.Bucket, keys bool) error {
+	var entries [][2][]byte
+
+	err := bucket.ForEach(func(key []byte, value []byte) error {
+		entries = append(entries, [2][]byte{append([]byte(nil), key...), append([]byte(nil), value...)})
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := bucket.Delete(entry[0]); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		flipped := entry[1]
+		if keys {
+			flipped = entry[0]
+		}
+
+		flipped[0] ^= 0x80
+
+		if err := bucket.Put(entry[0], entry[1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
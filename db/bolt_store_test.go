@@ -0,0 +1,206 @@
+package db
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStore_Reopen_ShouldKeepTransactionsAndUsage(t *testing.T) {
+	directory, err := ioutil.TempDir("", "velocity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "velocity.db")
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	store, err := OpenBoltStore(path)
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: startDate.AddDate(0, 0, 1)}))
+	assert.Nil(t, store.Close())
+
+	store, err = OpenBoltStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	usage, err := store.SumAndCount(1, WindowWeek, "2020-W46")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 150, Count: 2}, usage)
+
+	transaction, err := store.FindByLoadID(1, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 50.0, transaction.LoadAmount)
+	assert.True(t, startDate.AddDate(0, 0, 1).Equal(transaction.Time))
+}
+
+func TestBoltStore_RunInTransactionFails_ShouldRollback(t *testing.T) {
+	directory, err := ioutil.TempDir("", "velocity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := OpenBoltStore(filepath.Join(directory, "velocity.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	err = store.RunInTransaction(func(tx TransactionStore) error {
+		assert.Nil(t, tx.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}))
+
+		return errors.New("failed")
+	})
+
+	assert.NotNil(t, err)
+
+	usage, err := store.SumAndCount(1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{}, usage)
+
+	transaction, err := store.FindByLoadID(1, 1)
+
+	assert.Nil(t, err)
+	assert.Nil(t, transaction)
+}
+
+func TestBoltStore_TimesBefore1970_ShouldSortFirst(t *testing.T) {
+	directory, err := ioutil.TempDir("", "velocity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := OpenBoltStore(filepath.Join(directory, "velocity.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	epoch := time.Unix(0, 0).UTC()
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: epoch.AddDate(0, 0, 1)}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: epoch.AddDate(0, 0, -1)}))
+
+	var loadIDs []uint
+
+	err = store.Scan(TransactionFilter{From: epoch.AddDate(0, 0, -2)}, func(transaction Transaction) error {
+		loadIDs = append(loadIDs, transaction.TransactionID)
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []uint{2, 1}, loadIDs)
+
+	count, err := store.Prune(epoch, true, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	transaction, err := store.FindByLoadID(1, 1)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, transaction)
+}
+
+func TestBoltStore_ReopenFormat1_ShouldUpgradeKeys(t *testing.T) {
+	directory, err := ioutil.TempDir("", "velocity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "velocity.db")
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+	expiresAt := startDate.Add(time.Hour)
+
+	store, err := OpenBoltStore(path)
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: startDate, State: StateAuthorized, ExpiresAt: &expiresAt}))
+
+	// Turn the file back into the format 1, which had no version.
+	assert.Nil(t, store.database.Update(func(tx *bolt.Tx) error {
+		if err := flipBoltTimeKeys(tx); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket(dimensionUsageBucket); err != nil {
+			return err
+		}
+
+		return tx.Bucket(metaBucket).Delete(formatKey)
+	}))
+	assert.Nil(t, store.Close())
+
+	store, err = OpenBoltStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	transaction, err := store.FindByLoadID(1, 1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 100.0, transaction.LoadAmount)
+
+	count := 0
+
+	err = store.Scan(TransactionFilter{From: startDate}, func(transaction Transaction) error {
+		count++
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	var expired []uint
+
+	err = store.ScanExpired(expiresAt, func(transaction Transaction) error {
+		expired = append(expired, transaction.TransactionID)
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []uint{2}, expired)
+}
+
+func TestBoltStore_ReopenFormat2_ShouldAddDimensionUsage(t *testing.T) {
+	directory, err := ioutil.TempDir("", "velocity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "velocity.db")
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	store, err := OpenBoltStore(path)
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate, MerchantID: "m-1"}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: startDate, MerchantID: "m-1", State: StateVoided}))
+
+	// Turn the file back into the format 2, which had no dimension usage.
+	assert.Nil(t, store.database.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(dimensionUsageBucket); err != nil {
+			return err
+		}
+
+		return tx.Bucket(metaBucket).Put(formatKey, boltUint(2))
+	}))
+	assert.Nil(t, store.Close())
+
+	store, err = OpenBoltStore(path)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	usage, err := store.SumAndCountBy(DimensionMerchant, "m-1", WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 100, Count: 1}, usage)
+
+	usage, err = store.SumAndCountBy(DimensionPlatform, "", WindowWeek, "2020-W46")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 100, Count: 1}, usage)
+}
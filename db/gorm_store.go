@@ -0,0 +1,263 @@
+package db
+
+import (
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// GormStore is a TransactionStore backed by one of the SQL databases supported by gorm.
+type GormStore struct {
+	database *gorm.DB
+}
+
+func NewGormStore(database *gorm.DB) *GormStore {
+	return &GormStore{database: database}
+}
+
+// Database returns the underlying gorm database.
+func (s *GormStore) Database() *gorm.DB {
+	return s.database
+}
+
+func (s *GormStore) RunInTransaction(fn func(store TransactionStore) error) error {
+	return RunInTransaction(s.database, func(tx *gorm.DB) error {
+		return fn(&GormStore{database: tx})
+	})
+}
+
+func (s *GormStore) SumAndCount(customerID uint, kind string, key string) (Usage, error) {
+	usage, err := FindUsage(ForUpdate(s.database), customerID, kind, key)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	return Usage{Total: usage.Total, Count: usage.Count}, nil
+}
+
+func (s *GormStore) SumAndCountBy(dimension string, value string, kind string, key string) (Usage, error) {
+	usage, err := FindDimensionUsage(ForUpdate(s.database), dimension, value, kind, key)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	return Usage{Total: usage.Total, Count: usage.Count}, nil
+}
+
+func (s *GormStore) Insert(transaction *Transaction) error {
+	return InsertTransaction(s.database, transaction)
+}
+
+func (s *GormStore) FindByLoadID(customerID uint, loadID uint) (*Transaction, error) {
+	var transaction Transaction
+
+	err := s.database.Where("customer_id = ? and transaction_id = ?", customerID, loadID).First(&transaction).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &transaction, nil
+}
+
+func (s *GormStore) SetState(transaction *Transaction, state string) error {
+	return RunInTransaction(s.database, func(tx *gorm.DB) error {
+		released := transaction.Counted() && !(&Transaction{State: state}).Counted()
+
+		if err := tx.Model(transaction).Update("state", state).Error; err != nil {
+			return err
+		}
+
+		transaction.State = state
+
+		if released {
+			return removeUsage(tx, transaction)
+		}
+
+		return nil
+	})
+}
+
+func (s *GormStore) ScanExpired(at time.Time, fn func(transaction Transaction) error) error {
+	rows, err := s.database.Model(&Transaction{}).
+		Where("state = ? and expires_at <= ?", StateAuthorized, at.UTC()).
+		Order("expires_at").Rows()
+
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var transaction Transaction
+
+		if err := s.database.ScanRows(rows, &transaction); err != nil {
+			return err
+		}
+
+		if err := fn(transaction); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *GormStore) FindListing(customerID uint) (*CustomerListing, error) {
+	var listing CustomerListing
+
+	err := s.database.Where("customer_id = ?", customerID).First(&listing).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &listing, nil
+}
+
+func (s *GormStore) SaveListing(listing *CustomerListing) error {
+	return s.database.Save(listing).Error
+}
+
+func (s *GormStore) DeleteListing(customerID uint) (bool, error) {
+	result := s.database.Where("customer_id = ?", customerID).Delete(&CustomerListing{})
+
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *GormStore) Close() error {
+	return s.database.Close()
+}
+
+func (s *GormStore) Scan(filter TransactionFilter, fn func(transaction Transaction) error) error {
+	query := s.database.Model(&Transaction{})
+
+	query = query.Where("state IS NULL OR state NOT IN (?)", []string{StateVoided, StateExpired})
+
+	if filter.CustomerID != nil {
+		query = query.Where("customer_id = ?", *filter.CustomerID)
+	}
+
+	if !filter.From.IsZero() {
+		query = query.Where("time >= ?", filter.From)
+	}
+
+	if !filter.To.IsZero() {
+		query = query.Where("time < ?", filter.To)
+	}
+
+	rows, err := query.Order("customer_id, time, id").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var transaction Transaction
+
+		if err := s.database.ScanRows(rows, &transaction); err != nil {
+			return err
+		}
+
+		if err := fn(transaction); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// pruneBatchSize is the number of archived transactions removed by one statement, below the limit of
+// SQLite on the number of parameters.
+const pruneBatchSize = 500
+
+func (s *GormStore) Prune(before time.Time, hard bool, archive PruneArchive) (int, error) {
+	// The archive cannot be rolled back, so it is written before the transaction, which may be retried,
+	// and the transaction then removes the archived transactions only.
+	var archived []uint
+
+	if archive != nil {
+		rows, err := s.database.Model(&Transaction{}).Where("time < ?", before).Order("time").Rows()
+		if err != nil {
+			return 0, err
+		}
+
+		for rows.Next() {
+			var transaction Transaction
+
+			if err := s.database.ScanRows(rows, &transaction); err != nil {
+				rows.Close()
+				return 0, err
+			}
+
+			if err := archive.Archive(transaction); err != nil {
+				rows.Close()
+				return 0, err
+			}
+
+			archived = append(archived, transaction.ID)
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		if err := archive.Complete(); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+
+	err := RunInTransaction(s.database, func(tx *gorm.DB) error {
+		if hard {
+			tx = tx.Unscoped()
+		}
+
+		count = 0
+
+		if archive == nil {
+			result := tx.Where("time < ?", before).Delete(&Transaction{})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			count = int(result.RowsAffected)
+		}
+
+		for start := 0; start < len(archived); start += pruneBatchSize {
+			end := start + pruneBatchSize
+			if end > len(archived) {
+				end = len(archived)
+			}
+
+			result := tx.Where("id IN (?)", archived[start:end]).Delete(&Transaction{})
+			if result.Error != nil {
+				return result.Error
+			}
+
+			count += int(result.RowsAffected)
+		}
+
+		for kind, key := range endedWindowKeys(before) {
+			if err := tx.Where("window_kind = ? and window_key < ?", kind, key).Delete(&CustomerUsage{}).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Where("window_kind = ? and window_key < ?", kind, key).Delete(&DimensionUsage{}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return count, err
+}
@@ -0,0 +1,32 @@
+package db
+
+import (
+	"time"
+)
+
+// The lists a customer can be put on.
+const (
+	// ListBlocked declines every load of the customer, such as one blocked for fraud.
+	ListBlocked = "blocked"
+	// ListAllowed accepts every load of the customer without checking the limits, such as an internal test account.
+	ListAllowed = "allowed"
+)
+
+// CustomerListing puts a customer on the blocklist or the allowlist, until it expires.
+type CustomerListing struct {
+	CustomerID uint   `gorm:"primary_key;auto_increment:false"`
+	List       string `gorm:"size:16"`
+	Reason     string
+	// ExpiresAt is when the listing stops applying, nil when it does not expire.
+	ExpiresAt *time.Time
+	CreatedAt time.Time
+}
+
+func (CustomerListing) TableName() string {
+	return "customer_listings"
+}
+
+// ActiveAt reports whether the listing applies at the time.
+func (l *CustomerListing) ActiveAt(at time.Time) bool {
+	return l.ExpiresAt == nil || at.Before(*l.ExpiresAt)
+}
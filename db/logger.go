@@ -0,0 +1,41 @@
+package db
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.StandardLogger()
+
+// SetLogger sets the logger of the databases connected afterwards. Their SQL statements are logged
+// at debug level, and only when it is enabled.
+func SetLogger(l *logrus.Logger) {
+	logger = l
+}
+
+// gormLogger logs the messages of gorm as structured entries.
+type gormLogger struct {
+	logger *logrus.Logger
+}
+
+// Print receives the level and the source of the message, followed by the duration, the statement,
+// its variables and the number of affected rows for sql messages, or by the values to log otherwise.
+func (l gormLogger) Print(values ...interface{}) {
+	if len(values) < 2 {
+		l.logger.Debug(values...)
+		return
+	}
+
+	entry := l.logger.WithField("source", values[1])
+
+	if values[0] == "sql" && len(values) == 6 {
+		entry.WithFields(logrus.Fields{
+			"duration": values[2],
+			"vars":     fmt.Sprint(values[4]),
+			"rows":     values[5],
+		}).Debug(values[3])
+		return
+	}
+
+	entry.Debug(values[2:]...)
+}
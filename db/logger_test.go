@@ -0,0 +1,46 @@
+package db
+
+import (
+	guuid "github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConnectDatabase_DebugLevel_ShouldLogStatements(t *testing.T) {
+	original := logger
+	defer SetLogger(original)
+
+	testLogger, hook := test.NewNullLogger()
+	testLogger.SetLevel(logrus.DebugLevel)
+	SetLogger(testLogger)
+
+	database, err := ConnectDatabase("sqlite3", "file:"+guuid.New().String()+"?mode=memory")
+	assert.Nil(t, err)
+	defer database.Close()
+
+	assert.Nil(t, database.Exec("select 1").Error)
+
+	entry := hook.LastEntry()
+	assert.NotNil(t, entry)
+	assert.Equal(t, logrus.DebugLevel, entry.Level)
+	assert.Equal(t, "select 1", entry.Message)
+	assert.Contains(t, entry.Data, "duration")
+}
+
+func TestConnectDatabase_InfoLevel_ShouldNotLogStatements(t *testing.T) {
+	original := logger
+	defer SetLogger(original)
+
+	testLogger, hook := test.NewNullLogger()
+	SetLogger(testLogger)
+
+	database, err := ConnectDatabase("sqlite3", "file:"+guuid.New().String()+"?mode=memory")
+	assert.Nil(t, err)
+	defer database.Close()
+
+	assert.Nil(t, database.Exec("select 1").Error)
+
+	assert.Empty(t, hook.AllEntries())
+}
@@ -0,0 +1,418 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// usageKey is the window of the usage of a customer, or of a value of a dimension when dimension is set.
+type usageKey struct {
+	customerID uint
+	dimension  string
+	value      string
+	kind       string
+	key        string
+}
+
+// MemoryStore is a TransactionStore that keeps everything in memory, for tests and embedding.
+type MemoryStore struct {
+	mutex sync.Mutex
+	state *memoryState
+}
+
+type memoryState struct {
+	// nextID is the id of the next inserted transaction, never reused once the transactions are pruned.
+	nextID       uint
+	transactions []Transaction
+	usage        map[usageKey]Usage
+	listings     map[uint]CustomerListing
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		state: &memoryState{
+			nextID:       1,
+			transactions: make([]Transaction, 0),
+			usage:        make(map[usageKey]Usage),
+			listings:     make(map[uint]CustomerListing),
+		},
+	}
+}
+
+func (s *MemoryStore) RunInTransaction(fn func(store TransactionStore) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx := &memoryTransaction{
+		state:            s.state,
+		undo:             make(map[usageKey]Usage),
+		undoTransactions: make(map[int]Transaction),
+		undoListings:     make(map[uint]*CustomerListing),
+		length:           len(s.state.transactions),
+	}
+
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+	}
+
+	return err
+}
+
+func (s *MemoryStore) SumAndCount(customerID uint, kind string, key string) (Usage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.sumAndCount(customerID, kind, key), nil
+}
+
+func (s *MemoryStore) SumAndCountBy(dimension string, value string, kind string, key string) (Usage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.sumAndCountBy(dimension, value, kind, key), nil
+}
+
+func (s *MemoryStore) Insert(transaction *Transaction) error {
+	return s.RunInTransaction(func(store TransactionStore) error {
+		return store.Insert(transaction)
+	})
+}
+
+func (s *MemoryStore) FindByLoadID(customerID uint, loadID uint) (*Transaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.findByLoadID(customerID, loadID), nil
+}
+
+func (s *MemoryStore) Scan(filter TransactionFilter, fn func(transaction Transaction) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.scan(filter, fn)
+}
+
+func (s *MemoryStore) Prune(before time.Time, hard bool, archive PruneArchive) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	kept := make([]Transaction, 0, len(s.state.transactions))
+
+	for _, transaction := range s.state.transactions {
+		if !transaction.Time.Before(before) {
+			kept = append(kept, transaction)
+			continue
+		}
+
+		if archive != nil {
+			if err := archive.Archive(transaction); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if archive != nil {
+		if err := archive.Complete(); err != nil {
+			return 0, err
+		}
+	}
+
+	count := len(s.state.transactions) - len(kept)
+	s.state.transactions = kept
+
+	ended := endedWindowKeys(before)
+
+	for key := range s.state.usage {
+		if key.key < ended[key.kind] {
+			delete(s.state.usage, key)
+		}
+	}
+
+	return count, nil
+}
+
+func (s *MemoryStore) SetState(transaction *Transaction, state string) error {
+	return s.RunInTransaction(func(store TransactionStore) error {
+		return store.SetState(transaction, state)
+	})
+}
+
+func (s *MemoryStore) ScanExpired(at time.Time, fn func(transaction Transaction) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.scanExpired(at, fn)
+}
+
+func (s *MemoryStore) FindListing(customerID uint) (*CustomerListing, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state.findListing(customerID), nil
+}
+
+func (s *MemoryStore) SaveListing(listing *CustomerListing) error {
+	return s.RunInTransaction(func(store TransactionStore) error {
+		return store.SaveListing(listing)
+	})
+}
+
+func (s *MemoryStore) DeleteListing(customerID uint) (deleted bool, err error) {
+	err = s.RunInTransaction(func(store TransactionStore) error {
+		deleted, err = store.DeleteListing(customerID)
+		return err
+	})
+
+	return
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryState) sumAndCount(customerID uint, kind string, key string) Usage {
+	return s.usage[usageKey{customerID: customerID, kind: kind, key: key}]
+}
+
+func (s *memoryState) sumAndCountBy(dimension string, value string, kind string, key string) Usage {
+	return s.usage[usageKey{dimension: dimension, value: value, kind: kind, key: key}]
+}
+
+func (s *memoryState) findListing(customerID uint) *CustomerListing {
+	listing, found := s.listings[customerID]
+	if !found {
+		return nil
+	}
+
+	return &listing
+}
+
+func (s *memoryState) findByLoadID(customerID uint, loadID uint) *Transaction {
+	if i := s.indexOf(customerID, loadID); i >= 0 {
+		transaction := s.transactions[i]
+		return &transaction
+	}
+
+	return nil
+}
+
+func (s *memoryState) indexOf(customerID uint, loadID uint) int {
+	for i := range s.transactions {
+		if s.transactions[i].CustomerID == customerID && s.transactions[i].TransactionID == loadID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (s *memoryState) scanExpired(at time.Time, fn func(transaction Transaction) error) error {
+	for _, transaction := range s.transactions {
+		if !transaction.ExpiredAt(at) {
+			continue
+		}
+
+		if err := fn(transaction); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryState) scan(filter TransactionFilter, fn func(transaction Transaction) error) error {
+	selected := make([]Transaction, 0)
+
+	for i := range s.transactions {
+		if filter.Matches(&s.transactions[i]) {
+			selected = append(selected, s.transactions[i])
+		}
+	}
+
+	sort.SliceStable(selected, func(i, j int) bool {
+		if selected[i].CustomerID != selected[j].CustomerID {
+			return selected[i].CustomerID < selected[j].CustomerID
+		}
+
+		return selected[i].Time.Before(selected[j].Time)
+	})
+
+	for _, transaction := range selected {
+		if err := fn(transaction); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// memoryTransaction applies the changes to the store state directly and remembers how to undo them.
+type memoryTransaction struct {
+	state            *memoryState
+	undo             map[usageKey]Usage
+	undoTransactions map[int]Transaction
+	undoListings     map[uint]*CustomerListing
+	length           int
+}
+
+func (t *memoryTransaction) RunInTransaction(fn func(store TransactionStore) error) error {
+	return fn(t)
+}
+
+func (t *memoryTransaction) SumAndCount(customerID uint, kind string, key string) (Usage, error) {
+	return t.state.sumAndCount(customerID, kind, key), nil
+}
+
+func (t *memoryTransaction) SumAndCountBy(dimension string, value string, kind string, key string) (Usage, error) {
+	return t.state.sumAndCountBy(dimension, value, kind, key), nil
+}
+
+func (t *memoryTransaction) Insert(transaction *Transaction) error {
+	now := time.Now()
+
+	transaction.ID = t.state.nextID
+	t.state.nextID++
+	transaction.CreatedAt = now
+	transaction.UpdatedAt = now
+
+	t.state.transactions = append(t.state.transactions, *transaction)
+
+	t.addUsage(transaction, 1)
+
+	return nil
+}
+
+// addUsage adds the transaction to the usage of the customer and of its dimensions, or takes it out for a
+// negative sign.
+func (t *memoryTransaction) addUsage(transaction *Transaction, sign int) {
+	for _, kind := range []string{WindowDay, WindowWeek} {
+		windowKey := WindowKey(kind, transaction.Time)
+		keys := []usageKey{{customerID: transaction.CustomerID, kind: kind, key: windowKey}}
+
+		for _, value := range dimensionValues(transaction) {
+			keys = append(keys, usageKey{dimension: value.dimension, value: value.value, kind: kind, key: windowKey})
+		}
+
+		for _, key := range keys {
+			usage, found := t.state.usage[key]
+			if !found && sign < 0 {
+				continue
+			}
+
+			if _, saved := t.undo[key]; !saved {
+				t.undo[key] = usage
+			}
+
+			usage.Total += float64(sign) * transaction.LoadAmount
+			usage.Count = uint(int(usage.Count) + sign)
+
+			t.state.usage[key] = usage
+		}
+	}
+}
+
+func (t *memoryTransaction) SetState(transaction *Transaction, state string) error {
+	i := t.state.indexOf(transaction.CustomerID, transaction.TransactionID)
+	if i < 0 {
+		return errors.New("set the state of a transaction that is not saved")
+	}
+
+	if _, saved := t.undoTransactions[i]; !saved && i < t.length {
+		t.undoTransactions[i] = t.state.transactions[i]
+	}
+
+	saved := &t.state.transactions[i]
+	released := saved.Counted() && !(&Transaction{State: state}).Counted()
+
+	saved.State = state
+	saved.UpdatedAt = time.Now()
+
+	if released {
+		t.addUsage(saved, -1)
+	}
+
+	transaction.State = state
+
+	return nil
+}
+
+func (t *memoryTransaction) ScanExpired(at time.Time, fn func(transaction Transaction) error) error {
+	return t.state.scanExpired(at, fn)
+}
+
+func (t *memoryTransaction) FindByLoadID(customerID uint, loadID uint) (*Transaction, error) {
+	return t.state.findByLoadID(customerID, loadID), nil
+}
+
+func (t *memoryTransaction) Scan(filter TransactionFilter, fn func(transaction Transaction) error) error {
+	return t.state.scan(filter, fn)
+}
+
+func (t *memoryTransaction) Prune(before time.Time, hard bool, archive PruneArchive) (int, error) {
+	return 0, errors.New("prune inside of a transaction")
+}
+
+func (t *memoryTransaction) FindListing(customerID uint) (*CustomerListing, error) {
+	return t.state.findListing(customerID), nil
+}
+
+func (t *memoryTransaction) SaveListing(listing *CustomerListing) error {
+	t.saveListingUndo(listing.CustomerID)
+
+	if listing.CreatedAt.IsZero() {
+		listing.CreatedAt = time.Now()
+	}
+
+	t.state.listings[listing.CustomerID] = *listing
+
+	return nil
+}
+
+func (t *memoryTransaction) DeleteListing(customerID uint) (bool, error) {
+	if _, found := t.state.listings[customerID]; !found {
+		return false, nil
+	}
+
+	t.saveListingUndo(customerID)
+	delete(t.state.listings, customerID)
+
+	return true, nil
+}
+
+// saveListingUndo remembers the listing of the customer before its first change.
+func (t *memoryTransaction) saveListingUndo(customerID uint) {
+	if _, saved := t.undoListings[customerID]; !saved {
+		t.undoListings[customerID] = t.state.findListing(customerID)
+	}
+}
+
+func (t *memoryTransaction) Close() error {
+	return nil
+}
+
+func (t *memoryTransaction) rollback() {
+	t.state.transactions = t.state.transactions[:t.length]
+
+	for i, transaction := range t.undoTransactions {
+		t.state.transactions[i] = transaction
+	}
+
+	for key, usage := range t.undo {
+		if usage.Count == 0 {
+			delete(t.state.usage, key)
+		} else {
+			t.state.usage[key] = usage
+		}
+	}
+
+	for customerID, listing := range t.undoListings {
+		if listing == nil {
+			delete(t.state.listings, customerID)
+		} else {
+			t.state.listings[customerID] = *listing
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore_Insert_ShouldAccumulateUsage(t *testing.T) {
+	store := NewMemoryStore()
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: startDate.AddDate(0, 0, 1)}))
+
+	daily, err := store.SumAndCount(1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 100, Count: 1}, daily)
+
+	weekly, err := store.SumAndCount(1, WindowWeek, "2020-W46")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 150, Count: 2}, weekly)
+
+	transaction, err := store.FindByLoadID(1, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 50.0, transaction.LoadAmount)
+}
+
+func TestMemoryStore_RunInTransactionFails_ShouldRollback(t *testing.T) {
+	store := NewMemoryStore()
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}))
+
+	err := store.RunInTransaction(func(tx TransactionStore) error {
+		assert.Nil(t, tx.Insert(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: startDate}))
+		assert.Nil(t, tx.Insert(&Transaction{TransactionID: 3, CustomerID: 2, LoadAmount: 50, Time: startDate}))
+
+		return errors.New("failed")
+	})
+
+	assert.NotNil(t, err)
+
+	usage, _ := store.SumAndCount(1, WindowDay, "2020-11-09")
+	assert.Equal(t, Usage{Total: 100, Count: 1}, usage)
+
+	usage, _ = store.SumAndCount(2, WindowDay, "2020-11-09")
+	assert.Equal(t, Usage{}, usage)
+
+	transaction, _ := store.FindByLoadID(1, 2)
+	assert.Nil(t, transaction)
+}
+
+func TestMemoryStore_RunInTransactionFails_ShouldRestoreListings(t *testing.T) {
+	store := NewMemoryStore()
+
+	assert.Nil(t, store.SaveListing(&CustomerListing{CustomerID: 1, List: ListBlocked, Reason: "fraud"}))
+
+	err := store.RunInTransaction(func(tx TransactionStore) error {
+		deleted, err := tx.DeleteListing(1)
+		assert.True(t, deleted)
+		assert.Nil(t, err)
+
+		assert.Nil(t, tx.SaveListing(&CustomerListing{CustomerID: 2, List: ListAllowed, Reason: "test account"}))
+
+		return errors.New("failed")
+	})
+
+	assert.NotNil(t, err)
+
+	listing, _ := store.FindListing(1)
+	assert.Equal(t, ListBlocked, listing.List)
+
+	listing, _ = store.FindListing(2)
+	assert.Nil(t, listing)
+}
+
+func TestMemoryStore_InsertAfterPrune_ShouldNotReuseIDs(t *testing.T) {
+	store := NewMemoryStore()
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	first := Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}
+	second := Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: startDate.AddDate(0, 0, 10)}
+
+	assert.Nil(t, store.Insert(&first))
+	assert.Nil(t, store.Insert(&second))
+
+	count, err := store.Prune(startDate.AddDate(0, 0, 1), true, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	third := Transaction{TransactionID: 3, CustomerID: 1, LoadAmount: 25, Time: startDate.AddDate(0, 0, 11)}
+
+	assert.Nil(t, store.Insert(&third))
+	assert.Equal(t, uint(3), third.ID)
+	assert.NotEqual(t, second.ID, third.ID)
+}
@@ -0,0 +1,583 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Migration is a versioned change of the schema, written once for every supported dialect.
+// Statements are keyed by the dialect name; Data, when set, runs after the Up statements.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      map[string][]string
+	Down    map[string][]string
+	Data    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records a migration applied to the database.
+type SchemaMigration struct {
+	Version   uint `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// MigrationState is a migration together with the time it was applied, if it was.
+type MigrationState struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var schemaMigrationsTable = map[string][]string{
+	"sqlite3": {
+		`CREATE TABLE IF NOT EXISTS "schema_migrations" ("version" integer PRIMARY KEY, "name" varchar(255), "applied_at" datetime)`,
+	},
+	"postgres": {
+		`CREATE TABLE IF NOT EXISTS "schema_migrations" ("version" integer PRIMARY KEY, "name" varchar(255), "applied_at" timestamp with time zone)`,
+	},
+	"mysql": {
+		"CREATE TABLE IF NOT EXISTS `schema_migrations` (`version` int unsigned PRIMARY KEY, `name` varchar(255), `applied_at` DATETIME NULL)",
+	},
+	"mssql": {
+		`IF OBJECT_ID('schema_migrations', 'U') IS NULL CREATE TABLE "schema_migrations" ("version" int PRIMARY KEY, "name" nvarchar(255), "applied_at" datetimeoffset)`,
+	},
+}
+
+// Migrations lists the schema versions in the order they are applied. The first ones create the
+// tables only when they are missing, so that databases created by gorm's AutoMigrate are adopted.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_transactions",
+		Up: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE IF NOT EXISTS "transactions" ("id" integer PRIMARY KEY AUTOINCREMENT, "created_at" datetime, "updated_at" datetime, "deleted_at" datetime, "transaction_id" integer, "customer_id" integer, "load_amount" real, "time" datetime, "year" integer, "month" integer, "day" integer, "week" integer)`,
+				`CREATE INDEX IF NOT EXISTS "idx_transactions_deleted_at" ON "transactions" ("deleted_at")`,
+			},
+			"postgres": {
+				`CREATE TABLE IF NOT EXISTS "transactions" ("id" serial PRIMARY KEY, "created_at" timestamp with time zone, "updated_at" timestamp with time zone, "deleted_at" timestamp with time zone, "transaction_id" integer, "customer_id" integer, "load_amount" numeric, "time" timestamp with time zone, "year" integer, "month" integer, "day" integer, "week" integer)`,
+				`CREATE INDEX IF NOT EXISTS "idx_transactions_deleted_at" ON "transactions" ("deleted_at")`,
+			},
+			"mysql": {
+				"CREATE TABLE IF NOT EXISTS `transactions` (`id` int unsigned AUTO_INCREMENT PRIMARY KEY, `created_at` DATETIME NULL, `updated_at` DATETIME NULL, `deleted_at` DATETIME NULL, `transaction_id` int unsigned, `customer_id` int unsigned, `load_amount` double, `time` DATETIME NULL, `year` int unsigned, `month` int unsigned, `day` int unsigned, `week` int unsigned, INDEX `idx_transactions_deleted_at` (`deleted_at`))",
+			},
+			"mssql": {
+				`IF OBJECT_ID('transactions', 'U') IS NULL CREATE TABLE "transactions" ("id" int IDENTITY(1,1) PRIMARY KEY, "created_at" datetimeoffset, "updated_at" datetimeoffset, "deleted_at" datetimeoffset, "transaction_id" int, "customer_id" int, "load_amount" float, "time" datetimeoffset, "year" int, "month" int, "day" int, "week" int)`,
+				`IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'idx_transactions_deleted_at') CREATE INDEX "idx_transactions_deleted_at" ON "transactions" ("deleted_at")`,
+			},
+		},
+		Down: map[string][]string{
+			"sqlite3":  {`DROP TABLE "transactions"`},
+			"postgres": {`DROP TABLE "transactions"`},
+			"mysql":    {"DROP TABLE `transactions`"},
+			"mssql":    {`DROP TABLE "transactions"`},
+		},
+	},
+	{
+		Version: 2,
+		Name:    "create_customer_usage",
+		Up: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE IF NOT EXISTS "customer_usage" ("customer_id" integer, "window_kind" varchar(16), "window_key" varchar(16), "total" real, "count" integer, PRIMARY KEY ("customer_id", "window_kind", "window_key"))`,
+			},
+			"postgres": {
+				`CREATE TABLE IF NOT EXISTS "customer_usage" ("customer_id" integer, "window_kind" varchar(16), "window_key" varchar(16), "total" numeric, "count" integer, PRIMARY KEY ("customer_id", "window_kind", "window_key"))`,
+			},
+			"mysql": {
+				"CREATE TABLE IF NOT EXISTS `customer_usage` (`customer_id` int unsigned, `window_kind` varchar(16), `window_key` varchar(16), `total` double, `count` int unsigned, PRIMARY KEY (`customer_id`, `window_kind`, `window_key`))",
+			},
+			"mssql": {
+				`IF OBJECT_ID('customer_usage', 'U') IS NULL CREATE TABLE "customer_usage" ("customer_id" int, "window_kind" nvarchar(16), "window_key" nvarchar(16), "total" float, "count" int, PRIMARY KEY ("customer_id", "window_kind", "window_key"))`,
+			},
+		},
+		Down: map[string][]string{
+			"sqlite3":  {`DROP TABLE "customer_usage"`},
+			"postgres": {`DROP TABLE "customer_usage"`},
+			"mysql":    {"DROP TABLE `customer_usage`"},
+			"mssql":    {`DROP TABLE "customer_usage"`},
+		},
+		Data: rebuildUsage,
+	},
+	{
+		Version: 3,
+		Name:    "add_transactions_requested_amount",
+		// The column is added by Data, as the databases created by AutoMigrate may have it already.
+		Up: map[string][]string{
+			"sqlite3":  {},
+			"postgres": {},
+			"mysql":    {},
+			"mssql":    {},
+		},
+		Down: map[string][]string{
+			// SQLite cannot drop a column before 3.35, so the table is copied without it.
+			"sqlite3": {
+				`CREATE TABLE "transactions_down" ("id" integer PRIMARY KEY AUTOINCREMENT, "created_at" datetime, "updated_at" datetime, "deleted_at" datetime, "transaction_id" integer, "customer_id" integer, "load_amount" real, "time" datetime, "year" integer, "month" integer, "day" integer, "week" integer)`,
+				`INSERT INTO "transactions_down" SELECT "id", "created_at", "updated_at", "deleted_at", "transaction_id", "customer_id", "load_amount", "time", "year", "month", "day", "week" FROM "transactions"`,
+				`DROP TABLE "transactions"`,
+				`ALTER TABLE "transactions_down" RENAME TO "transactions"`,
+				`CREATE INDEX IF NOT EXISTS "idx_transactions_deleted_at" ON "transactions" ("deleted_at")`,
+			},
+			"postgres": {`ALTER TABLE "transactions" DROP COLUMN "requested_amount"`},
+			"mysql":    {"ALTER TABLE `transactions` DROP COLUMN `requested_amount`"},
+			"mssql":    {`ALTER TABLE "transactions" DROP COLUMN "requested_amount"`},
+		},
+		Data: addRequestedAmount,
+	},
+	{
+		Version: 4,
+		Name:    "add_transactions_dimensions",
+		// The columns are added by Data, as the databases created by AutoMigrate may have them already.
+		Up: map[string][]string{
+			"sqlite3":  {},
+			"postgres": {},
+			"mysql":    {},
+			"mssql":    {},
+		},
+		Down: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE "transactions_down" ("id" integer PRIMARY KEY AUTOINCREMENT, "created_at" datetime, "updated_at" datetime, "deleted_at" datetime, "transaction_id" integer, "customer_id" integer, "load_amount" real, "time" datetime, "year" integer, "month" integer, "day" integer, "week" integer, "requested_amount" real)`,
+				`INSERT INTO "transactions_down" SELECT "id", "created_at", "updated_at", "deleted_at", "transaction_id", "customer_id", "load_amount", "time", "year", "month", "day", "week", "requested_amount" FROM "transactions"`,
+				`DROP TABLE "transactions"`,
+				`ALTER TABLE "transactions_down" RENAME TO "transactions"`,
+				`CREATE INDEX IF NOT EXISTS "idx_transactions_deleted_at" ON "transactions" ("deleted_at")`,
+			},
+			"postgres": {
+				`DROP INDEX IF EXISTS "idx_transactions_funding_source"`,
+				`DROP INDEX IF EXISTS "idx_transactions_merchant_id"`,
+				`ALTER TABLE "transactions" DROP COLUMN "funding_source", DROP COLUMN "merchant_id"`,
+			},
+			"mysql": {
+				"ALTER TABLE `transactions` DROP INDEX `idx_transactions_funding_source`, DROP INDEX `idx_transactions_merchant_id`",
+				"ALTER TABLE `transactions` DROP COLUMN `funding_source`, DROP COLUMN `merchant_id`",
+			},
+			"mssql": {
+				`DROP INDEX "idx_transactions_funding_source" ON "transactions"`,
+				`DROP INDEX "idx_transactions_merchant_id" ON "transactions"`,
+				`ALTER TABLE "transactions" DROP COLUMN "funding_source", "merchant_id"`,
+			},
+		},
+		Data: addDimensions,
+	},
+	{
+		Version: 5,
+		Name:    "create_customer_listings",
+		Up: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE "customer_listings" ("customer_id" integer PRIMARY KEY, "list" varchar(16), "reason" varchar(255), "expires_at" datetime, "created_at" datetime)`,
+			},
+			"postgres": {
+				`CREATE TABLE "customer_listings" ("customer_id" integer PRIMARY KEY, "list" varchar(16), "reason" varchar(255), "expires_at" timestamp with time zone, "created_at" timestamp with time zone)`,
+			},
+			"mysql": {
+				"CREATE TABLE `customer_listings` (`customer_id` int unsigned PRIMARY KEY, `list` varchar(16), `reason` varchar(255), `expires_at` DATETIME NULL, `created_at` DATETIME NULL)",
+			},
+			"mssql": {
+				`CREATE TABLE "customer_listings" ("customer_id" int PRIMARY KEY, "list" nvarchar(16), "reason" nvarchar(255), "expires_at" datetimeoffset, "created_at" datetimeoffset)`,
+			},
+		},
+		Down: map[string][]string{
+			"sqlite3":  {`DROP TABLE "customer_listings"`},
+			"postgres": {`DROP TABLE "customer_listings"`},
+			"mysql":    {"DROP TABLE `customer_listings`"},
+			"mssql":    {`DROP TABLE "customer_listings"`},
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add_transactions_reservations",
+		// The columns are added by Data, as the databases created by AutoMigrate may have them already.
+		Up: map[string][]string{
+			"sqlite3":  {},
+			"postgres": {},
+			"mysql":    {},
+			"mssql":    {},
+		},
+		Down: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE "transactions_down" ("id" integer PRIMARY KEY AUTOINCREMENT, "created_at" datetime, "updated_at" datetime, "deleted_at" datetime, "transaction_id" integer, "customer_id" integer, "load_amount" real, "time" datetime, "year" integer, "month" integer, "day" integer, "week" integer, "requested_amount" real, "funding_source" varchar(255), "merchant_id" varchar(255))`,
+				`INSERT INTO "transactions_down" SELECT "id", "created_at", "updated_at", "deleted_at", "transaction_id", "customer_id", "load_amount", "time", "year", "month", "day", "week", "requested_amount", "funding_source", "merchant_id" FROM "transactions"`,
+				`DROP TABLE "transactions"`,
+				`ALTER TABLE "transactions_down" RENAME TO "transactions"`,
+				`CREATE INDEX IF NOT EXISTS "idx_transactions_deleted_at" ON "transactions" ("deleted_at")`,
+				`CREATE INDEX idx_transactions_funding_source ON "transactions" ("funding_source", "time")`,
+				`CREATE INDEX idx_transactions_merchant_id ON "transactions" ("merchant_id", "time")`,
+			},
+			"postgres": {
+				`DROP INDEX IF EXISTS "idx_transactions_state_expires_at"`,
+				`ALTER TABLE "transactions" DROP COLUMN "state", DROP COLUMN "expires_at"`,
+			},
+			"mysql": {
+				"ALTER TABLE `transactions` DROP INDEX `idx_transactions_state_expires_at`",
+				"ALTER TABLE `transactions` DROP COLUMN `state`, DROP COLUMN `expires_at`",
+			},
+			"mssql": {
+				`DROP INDEX "idx_transactions_state_expires_at" ON "transactions"`,
+				`ALTER TABLE "transactions" DROP COLUMN "state", "expires_at"`,
+			},
+		},
+		Data: addReservations,
+	},
+	{
+		Version: 7,
+		Name:    "add_transactions_time_indexes",
+		// The custom rules aggregate the loads of a customer, or of the whole platform, within a time range.
+		Up: map[string][]string{
+			"sqlite3": {
+				`CREATE INDEX idx_transactions_customer_id_time ON "transactions" ("customer_id", "time")`,
+				`CREATE INDEX idx_transactions_time ON "transactions" ("time")`,
+			},
+			"postgres": {
+				`CREATE INDEX "idx_transactions_customer_id_time" ON "transactions" ("customer_id", "time")`,
+				`CREATE INDEX "idx_transactions_time" ON "transactions" ("time")`,
+			},
+			"mysql": {
+				"CREATE INDEX `idx_transactions_customer_id_time` ON `transactions` (`customer_id`, `time`)",
+				"CREATE INDEX `idx_transactions_time` ON `transactions` (`time`)",
+			},
+			"mssql": {
+				`CREATE INDEX "idx_transactions_customer_id_time" ON "transactions" ("customer_id", "time")`,
+				`CREATE INDEX "idx_transactions_time" ON "transactions" ("time")`,
+			},
+		},
+		Down: map[string][]string{
+			"sqlite3": {
+				`DROP INDEX idx_transactions_customer_id_time`,
+				`DROP INDEX idx_transactions_time`,
+			},
+			"postgres": {
+				`DROP INDEX IF EXISTS "idx_transactions_customer_id_time"`,
+				`DROP INDEX IF EXISTS "idx_transactions_time"`,
+			},
+			"mysql": {
+				"ALTER TABLE `transactions` DROP INDEX `idx_transactions_customer_id_time`, DROP INDEX `idx_transactions_time`",
+			},
+			"mssql": {
+				`DROP INDEX "idx_transactions_customer_id_time" ON "transactions"`,
+				`DROP INDEX "idx_transactions_time" ON "transactions"`,
+			},
+		},
+	},
+	{
+		Version: 8,
+		Name:    "create_dimension_usage",
+		// The platform has a single empty value, which gorm leaves out of the inserts, hence the default.
+		Up: map[string][]string{
+			"sqlite3": {
+				`CREATE TABLE "dimension_usage" ("dimension" varchar(16), "dimension_value" varchar(255) NOT NULL DEFAULT '', "window_kind" varchar(16), "window_key" varchar(16), "total" real, "count" integer, PRIMARY KEY ("dimension", "dimension_value", "window_kind", "window_key"))`,
+			},
+			"postgres": {
+				`CREATE TABLE "dimension_usage" ("dimension" varchar(16), "dimension_value" varchar(255) NOT NULL DEFAULT '', "window_kind" varchar(16), "window_key" varchar(16), "total" numeric, "count" integer, PRIMARY KEY ("dimension", "dimension_value", "window_kind", "window_key"))`,
+			},
+			"mysql": {
+				"CREATE TABLE `dimension_usage` (`dimension` varchar(16), `dimension_value` varchar(255) NOT NULL DEFAULT '', `window_kind` varchar(16), `window_key` varchar(16), `total` double, `count` int unsigned, PRIMARY KEY (`dimension`, `dimension_value`, `window_kind`, `window_key`))",
+			},
+			"mssql": {
+				`CREATE TABLE "dimension_usage" ("dimension" nvarchar(16), "dimension_value" nvarchar(255) NOT NULL DEFAULT '', "window_kind" nvarchar(16), "window_key" nvarchar(16), "total" float, "count" int, PRIMARY KEY ("dimension", "dimension_value", "window_kind", "window_key"))`,
+			},
+		},
+		Down: map[string][]string{
+			"sqlite3":  {`DROP TABLE "dimension_usage"`},
+			"postgres": {`DROP TABLE "dimension_usage"`},
+			"mysql":    {"DROP TABLE `dimension_usage`"},
+			"mssql":    {`DROP TABLE "dimension_usage"`},
+		},
+		Data: rebuildDimensionUsage,
+	},
+}
+
+var addRequestedAmountColumn = map[string][]string{
+	"sqlite3":  {`ALTER TABLE "transactions" ADD COLUMN "requested_amount" real`},
+	"postgres": {`ALTER TABLE "transactions" ADD COLUMN "requested_amount" numeric`},
+	"mysql":    {"ALTER TABLE `transactions` ADD COLUMN `requested_amount` double"},
+	"mssql":    {`ALTER TABLE "transactions" ADD "requested_amount" float`},
+}
+
+var (
+	addDimensionColumns = map[string]map[string][]string{
+		"funding_source": {
+			"sqlite3":  {`ALTER TABLE "transactions" ADD COLUMN "funding_source" varchar(255)`},
+			"postgres": {`ALTER TABLE "transactions" ADD COLUMN "funding_source" varchar(255)`},
+			"mysql":    {"ALTER TABLE `transactions` ADD COLUMN `funding_source` varchar(255)"},
+			"mssql":    {`ALTER TABLE "transactions" ADD "funding_source" nvarchar(255)`},
+		},
+		"merchant_id": {
+			"sqlite3":  {`ALTER TABLE "transactions" ADD COLUMN "merchant_id" varchar(255)`},
+			"postgres": {`ALTER TABLE "transactions" ADD COLUMN "merchant_id" varchar(255)`},
+			"mysql":    {"ALTER TABLE `transactions` ADD COLUMN `merchant_id` varchar(255)"},
+			"mssql":    {`ALTER TABLE "transactions" ADD "merchant_id" nvarchar(255)`},
+		},
+	}
+
+	addDimensionIndexes = map[string]map[string][]string{
+		"idx_transactions_funding_source": {
+			"sqlite3":  {`CREATE INDEX idx_transactions_funding_source ON "transactions" ("funding_source", "time")`},
+			"postgres": {`CREATE INDEX "idx_transactions_funding_source" ON "transactions" ("funding_source", "time")`},
+			"mysql":    {"CREATE INDEX `idx_transactions_funding_source` ON `transactions` (`funding_source`, `time`)"},
+			"mssql":    {`CREATE INDEX "idx_transactions_funding_source" ON "transactions" ("funding_source", "time")`},
+		},
+		"idx_transactions_merchant_id": {
+			"sqlite3":  {`CREATE INDEX idx_transactions_merchant_id ON "transactions" ("merchant_id", "time")`},
+			"postgres": {`CREATE INDEX "idx_transactions_merchant_id" ON "transactions" ("merchant_id", "time")`},
+			"mysql":    {"CREATE INDEX `idx_transactions_merchant_id` ON `transactions` (`merchant_id`, `time`)"},
+			"mssql":    {`CREATE INDEX "idx_transactions_merchant_id" ON "transactions" ("merchant_id", "time")`},
+		},
+	}
+)
+
+// addDimensions adds the funding source and merchant of the transactions, and their indexes, when missing.
+func addDimensions(tx *gorm.DB) error {
+	for _, column := range []string{"funding_source", "merchant_id"} {
+		if !tx.Dialect().HasColumn("transactions", column) {
+			if err := execStatements(tx, addDimensionColumns[column]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, index := range []string{"idx_transactions_funding_source", "idx_transactions_merchant_id"} {
+		if !tx.Dialect().HasIndex("transactions", index) {
+			if err := execStatements(tx, addDimensionIndexes[index]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+var (
+	addReservationColumns = map[string]map[string][]string{
+		"state": {
+			"sqlite3":  {`ALTER TABLE "transactions" ADD COLUMN "state" varchar(16)`},
+			"postgres": {`ALTER TABLE "transactions" ADD COLUMN "state" varchar(16)`},
+			"mysql":    {"ALTER TABLE `transactions` ADD COLUMN `state` varchar(16)"},
+			"mssql":    {`ALTER TABLE "transactions" ADD "state" nvarchar(16)`},
+		},
+		"expires_at": {
+			"sqlite3":  {`ALTER TABLE "transactions" ADD COLUMN "expires_at" datetime`},
+			"postgres": {`ALTER TABLE "transactions" ADD COLUMN "expires_at" timestamp with time zone`},
+			"mysql":    {"ALTER TABLE `transactions` ADD COLUMN `expires_at` DATETIME NULL"},
+			"mssql":    {`ALTER TABLE "transactions" ADD "expires_at" datetimeoffset`},
+		},
+	}
+
+	addReservationIndex = map[string][]string{
+		"sqlite3":  {`CREATE INDEX idx_transactions_state_expires_at ON "transactions" ("state", "expires_at")`},
+		"postgres": {`CREATE INDEX "idx_transactions_state_expires_at" ON "transactions" ("state", "expires_at")`},
+		"mysql":    {"CREATE INDEX `idx_transactions_state_expires_at` ON `transactions` (`state`, `expires_at`)"},
+		"mssql":    {`CREATE INDEX "idx_transactions_state_expires_at" ON "transactions" ("state", "expires_at")`},
+	}
+)
+
+// addReservations adds the state and the reservation expiry of the transactions, and the index of the
+// reservations to expire, when missing, and settles the transactions without a state.
+func addReservations(tx *gorm.DB) error {
+	for _, column := range []string{"state", "expires_at"} {
+		if !tx.Dialect().HasColumn("transactions", column) {
+			if err := execStatements(tx, addReservationColumns[column]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !tx.Dialect().HasIndex("transactions", "idx_transactions_state_expires_at") {
+		if err := execStatements(tx, addReservationIndex); err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(&Transaction{}).Unscoped().
+		Where("state IS NULL OR state = ''").
+		UpdateColumn("state", StateSettled).Error
+}
+
+// addRequestedAmount adds the requested amount to the transactions when it is missing, and sets it to
+// the loaded amount of the transactions without one.
+func addRequestedAmount(tx *gorm.DB) error {
+	if !tx.Dialect().HasColumn("transactions", "requested_amount") {
+		if err := execStatements(tx, addRequestedAmountColumn); err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(&Transaction{}).Unscoped().
+		Where("requested_amount IS NULL OR requested_amount = 0").
+		UpdateColumn("requested_amount", gorm.Expr("load_amount")).Error
+}
+
+// MigrateUp applies the pending migrations in order and returns the ones it applied.
+func MigrateUp(database *gorm.DB) ([]Migration, error) {
+	states, err := MigrationStatus(database)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0)
+
+	for _, state := range states {
+		if state.Applied {
+			continue
+		}
+
+		migration := state.Migration
+
+		err := database.Transaction(func(tx *gorm.DB) error {
+			if err := execStatements(tx, migration.Up); err != nil {
+				return err
+			}
+
+			if migration.Data != nil {
+				if err := migration.Data(tx); err != nil {
+					return err
+				}
+			}
+
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+
+		if err != nil {
+			return applied, fmt.Errorf("migration %d %s failed: %v", migration.Version, migration.Name, err)
+		}
+
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// MigrateDown reverts the most recently applied migration and returns it, or nil if none is applied.
+func MigrateDown(database *gorm.DB) (*Migration, error) {
+	states, err := MigrationStatus(database)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(states) - 1; i >= 0; i-- {
+		if !states[i].Applied {
+			continue
+		}
+
+		migration := states[i].Migration
+
+		err := database.Transaction(func(tx *gorm.DB) error {
+			if err := execStatements(tx, migration.Down); err != nil {
+				return err
+			}
+
+			return tx.Where("version = ?", migration.Version).Delete(&SchemaMigration{}).Error
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("migration %d %s failed: %v", migration.Version, migration.Name, err)
+		}
+
+		return &migration, nil
+	}
+
+	return nil, nil
+}
+
+// MigrateDownTo reverts, from the most recent, the applied migrations above the version and returns the
+// ones it reverted. The version 0 reverts all of them.
+func MigrateDownTo(database *gorm.DB, version uint) ([]Migration, error) {
+	if version != 0 && !knownMigration(version) {
+		return nil, fmt.Errorf("unknown migration version %d", version)
+	}
+
+	reverted := make([]Migration, 0)
+
+	for {
+		states, err := MigrationStatus(database)
+		if err != nil {
+			return reverted, err
+		}
+
+		last := -1
+		for i, state := range states {
+			if state.Applied {
+				last = i
+			}
+		}
+
+		if last < 0 || states[last].Version <= version {
+			return reverted, nil
+		}
+
+		migration, err := MigrateDown(database)
+		if err != nil {
+			return reverted, err
+		}
+
+		reverted = append(reverted, *migration)
+	}
+}
+
+func knownMigration(version uint) bool {
+	for _, migration := range Migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MigrationStatus returns every known migration and whether it is applied to the database.
+func MigrationStatus(database *gorm.DB) ([]MigrationState, error) {
+	if err := execStatements(database, schemaMigrationsTable); err != nil {
+		return nil, err
+	}
+
+	var schemaMigrations []SchemaMigration
+
+	if err := database.Find(&schemaMigrations).Error; err != nil {
+		return nil, err
+	}
+
+	appliedAt := make(map[uint]time.Time)
+	for _, schemaMigration := range schemaMigrations {
+		appliedAt[schemaMigration.Version] = schemaMigration.AppliedAt
+	}
+
+	states := make([]MigrationState, 0, len(Migrations))
+
+	for _, migration := range Migrations {
+		at, applied := appliedAt[migration.Version]
+
+		states = append(states, MigrationState{
+			Migration: migration,
+			Applied:   applied,
+			AppliedAt: at,
+		})
+	}
+
+	return states, nil
+}
+
+func execStatements(database *gorm.DB, statements map[string][]string) error {
+	dialect := database.Dialect().GetName()
+
+	dialectStatements, found := statements[dialect]
+	if !found {
+		return errors.New("migrations are not available for dialect " + dialect)
+	}
+
+	for _, statement := range dialectStatements {
+		if err := database.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
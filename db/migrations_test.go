@@ -0,0 +1,124 @@
+package db
+
+import (
+	guuid "github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMigrateUp_NewDatabase_ShouldApplyAll(t *testing.T) {
+	database := openTestDatabase()
+
+	states, err := MigrationStatus(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(Migrations), len(states))
+
+	for _, state := range states {
+		assert.True(t, state.Applied)
+	}
+
+	applied, err := MigrateUp(database)
+
+	assert.Nil(t, err)
+	assert.Empty(t, applied)
+}
+
+func TestMigrateDown_Applied_ShouldRevertLast(t *testing.T) {
+	database := openTestDatabase()
+
+	assert.Nil(t, database.Save(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, RequestedAmount: 300, MerchantID: "m-1"}).Error)
+
+	assert.True(t, database.Dialect().HasIndex("transactions", "idx_transactions_customer_id_time"))
+	assert.True(t, database.Dialect().HasIndex("transactions", "idx_transactions_time"))
+
+	migration, err := MigrateDown(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Migrations[len(Migrations)-1].Version, migration.Version)
+	assert.False(t, database.HasTable(&DimensionUsage{}))
+
+	migration, err = MigrateDown(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Migrations[len(Migrations)-2].Version, migration.Version)
+	assert.False(t, database.Dialect().HasIndex("transactions", "idx_transactions_customer_id_time"))
+	assert.False(t, database.Dialect().HasIndex("transactions", "idx_transactions_time"))
+
+	migration, err = MigrateDown(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Migrations[len(Migrations)-3].Version, migration.Version)
+	assert.False(t, database.Dialect().HasColumn("transactions", "state"))
+	assert.True(t, database.Dialect().HasIndex("transactions", "idx_transactions_merchant_id"))
+
+	migration, err = MigrateDown(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Migrations[len(Migrations)-4].Version, migration.Version)
+	assert.False(t, database.HasTable(&CustomerListing{}))
+
+	migration, err = MigrateDown(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Migrations[len(Migrations)-5].Version, migration.Version)
+	assert.False(t, database.Dialect().HasColumn("transactions", "merchant_id"))
+	assert.False(t, database.Dialect().HasIndex("transactions", "idx_transactions_merchant_id"))
+
+	migration, err = MigrateDown(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Migrations[len(Migrations)-6].Version, migration.Version)
+	assert.False(t, database.Dialect().HasColumn("transactions", "requested_amount"))
+
+	migration, err = MigrateDown(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Migrations[len(Migrations)-7].Version, migration.Version)
+	assert.False(t, database.HasTable(&CustomerUsage{}))
+
+	applied, err := MigrateUp(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 7, len(applied))
+	assert.True(t, database.Dialect().HasIndex("transactions", "idx_transactions_merchant_id"))
+	assert.True(t, database.Dialect().HasIndex("transactions", "idx_transactions_customer_id_time"))
+	assert.True(t, database.HasTable(&CustomerUsage{}))
+	assert.True(t, database.HasTable(&DimensionUsage{}))
+
+	var transaction Transaction
+
+	assert.Nil(t, database.First(&transaction).Error)
+	assert.Equal(t, 100.0, transaction.LoadAmount)
+	assert.Equal(t, 100.0, transaction.RequestedAmount)
+	assert.Equal(t, StateSettled, transaction.State)
+}
+
+func TestMigrateUp_AutoMigratedDatabase_ShouldAdoptAndBackfill(t *testing.T) {
+	database, err := ConnectDatabase("sqlite3", "file:"+guuid.New().String()+"?mode=memory")
+	assert.Nil(t, err)
+
+	database.LogMode(false)
+	database.AutoMigrate(&Transaction{})
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+	assert.Nil(t, database.Save(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}).Error)
+
+	applied, err := MigrateUp(database)
+
+	assert.Nil(t, err)
+	assert.Equal(t, len(Migrations), len(applied))
+
+	usage, err := FindUsage(database, 1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 100.0, usage.Total)
+	assert.Equal(t, uint(1), usage.Count)
+
+	platform, err := FindDimensionUsage(database, DimensionPlatform, "", WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 100.0, platform.Total)
+	assert.Equal(t, uint(1), platform.Count)
+}
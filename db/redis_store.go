@@ -0,0 +1,570 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+// incrementUsage adds a load to a usage counter and sets its expiration when the counter is new.
+var incrementUsage = redis.NewScript(1, `
+redis.call('HINCRBYFLOAT', KEYS[1], 'total', ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'count', 1)
+if redis.call('TTL', KEYS[1]) < 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// decrementUsage takes a load out of a usage counter, unless the counter expired with its window.
+var decrementUsage = redis.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('HINCRBYFLOAT', KEYS[1], 'total', -tonumber(ARGV[1]))
+	redis.call('HINCRBY', KEYS[1], 'count', -1)
+end
+return 1
+`)
+
+var errConflict = errors.New("redis transaction aborted by a concurrent change")
+
+// RedisStore is a TransactionStore that keeps the usage counters in a Redis-compatible server, so that
+// every instance of velocity behind a load balancer sees the same usage.
+//
+// Transactions use optimistic locking: the counters and loads read are watched and the changes are queued
+// in a MULTI block, which the server discards if a watched key changed in the meantime. The authorized
+// loads are indexed by the expiry of their reservation in a sorted set.
+type RedisStore struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// OpenRedisStore connects to the server at the redis:// URL.
+func OpenRedisStore(url string) (*RedisStore, error) {
+	pool := &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url)
+		},
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &RedisStore{pool: pool, prefix: "velocity:"}, nil
+}
+
+func (s *RedisStore) RunInTransaction(fn func(store TransactionStore) error) (err error) {
+	for attempt := 1; attempt <= MaxTransactionAttempts; attempt++ {
+		err = s.runInTransaction(fn)
+
+		if err != errConflict {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *RedisStore) runInTransaction(fn func(store TransactionStore) error) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	tx := &redisTransaction{store: s, conn: conn}
+
+	if err := fn(tx); err != nil {
+		conn.Do("UNWATCH")
+		return err
+	}
+
+	if len(tx.inserts) == 0 && len(tx.updates) == 0 {
+		_, err := conn.Do("UNWATCH")
+		return err
+	}
+
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	for _, transaction := range tx.inserts {
+		if err := s.queueInsert(conn, transaction); err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	for _, update := range tx.updates {
+		if err := s.queueSetState(conn, update); err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil {
+		return errConflict
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, reply := range replies {
+		if replyError, ok := reply.(redis.Error); ok {
+			return replyError
+		}
+	}
+
+	return nil
+}
+
+func (s *RedisStore) SumAndCount(customerID uint, kind string, key string) (Usage, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return s.sumAndCount(conn, s.usageKey(customerID, kind, key))
+}
+
+func (s *RedisStore) SumAndCountBy(dimension string, value string, kind string, key string) (Usage, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return s.sumAndCount(conn, s.dimensionUsageKey(dimension, value, kind, key))
+}
+
+func (s *RedisStore) Insert(transaction *Transaction) error {
+	return s.RunInTransaction(func(store TransactionStore) error {
+		return store.Insert(transaction)
+	})
+}
+
+func (s *RedisStore) FindByLoadID(customerID uint, loadID uint) (*Transaction, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("GET", s.loadKey(customerID, loadID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var transaction Transaction
+
+	if err := json.Unmarshal(value, &transaction); err != nil {
+		return nil, err
+	}
+
+	return &transaction, nil
+}
+
+// Scan fails: the store keeps the usage counters, not the history of the transactions.
+func (s *RedisStore) Scan(filter TransactionFilter, fn func(transaction Transaction) error) error {
+	return errors.New("the redis store does not keep the transaction history")
+}
+
+// Prune removes nothing: the usage counters and loads expire on their own once their window ended.
+func (s *RedisStore) Prune(before time.Time, hard bool, archive PruneArchive) (int, error) {
+	return 0, nil
+}
+
+func (s *RedisStore) SetState(transaction *Transaction, state string) error {
+	return s.RunInTransaction(func(store TransactionStore) error {
+		return store.SetState(transaction, state)
+	})
+}
+
+func (s *RedisStore) ScanExpired(at time.Time, fn func(transaction Transaction) error) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	members, err := redis.Strings(conn.Do("ZRANGEBYSCORE", s.reservationsKey(), "-inf", reservationScore(at)))
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		var customerID, loadID uint
+
+		if _, err := fmt.Sscanf(member, "%d:%d", &customerID, &loadID); err != nil {
+			return err
+		}
+
+		transaction, err := s.FindByLoadID(customerID, loadID)
+		if err != nil {
+			return err
+		}
+
+		// The load expired with the longest window, so nothing is reserved anymore.
+		if transaction == nil {
+			if _, err := conn.Do("ZREM", s.reservationsKey(), member); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !transaction.ExpiredAt(at) {
+			continue
+		}
+
+		if err := fn(*transaction); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *RedisStore) FindListing(customerID uint) (*CustomerListing, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("GET", s.listingKey(customerID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var listing CustomerListing
+
+	if err := json.Unmarshal(value, &listing); err != nil {
+		return nil, err
+	}
+
+	return &listing, nil
+}
+
+func (s *RedisStore) SaveListing(listing *CustomerListing) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if listing.CreatedAt.IsZero() {
+		listing.CreatedAt = time.Now()
+	}
+
+	value, err := json.Marshal(listing)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", s.listingKey(listing.CustomerID), value)
+
+	return err
+}
+
+func (s *RedisStore) DeleteListing(customerID uint) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	deleted, err := redis.Int(conn.Do("DEL", s.listingKey(customerID)))
+
+	return deleted > 0, err
+}
+
+func (s *RedisStore) Close() error {
+	return s.pool.Close()
+}
+
+func (s *RedisStore) usageKey(customerID uint, kind string, key string) string {
+	return fmt.Sprintf("%susage:%d:%s:%s", s.prefix, customerID, kind, key)
+}
+
+func (s *RedisStore) dimensionUsageKey(dimension string, value string, kind string, key string) string {
+	return fmt.Sprintf("%susage:%s:%s:%s:%s", s.prefix, dimension, kind, key, value)
+}
+
+func (s *RedisStore) listingKey(customerID uint) string {
+	return fmt.Sprintf("%slisting:%d", s.prefix, customerID)
+}
+
+func (s *RedisStore) reservationsKey() string {
+	return s.prefix + "reservations"
+}
+
+func reservationMember(transaction *Transaction) string {
+	return fmt.Sprintf("%d:%d", transaction.CustomerID, transaction.TransactionID)
+}
+
+// reservationScore orders the reservations by expiry, to the millisecond.
+func reservationScore(expiresAt time.Time) int64 {
+	return expiresAt.UnixNano() / int64(time.Millisecond)
+}
+
+// loadExpiration returns how long the load is kept: the longest window, or until its reservation expired.
+func loadExpiration(transaction *Transaction) int64 {
+	expiration := LongestWindow()
+
+	if transaction.ExpiresAt != nil {
+		if untilExpiry := time.Until(*transaction.ExpiresAt); untilExpiry > expiration {
+			expiration = untilExpiry
+		}
+	}
+
+	return int64(expiration / time.Second)
+}
+
+func (s *RedisStore) loadKey(customerID uint, loadID uint) string {
+	return fmt.Sprintf("%sload:%d:%d", s.prefix, customerID, loadID)
+}
+
+// sumAndCount returns the usage of the counter at the usage key.
+func (s *RedisStore) sumAndCount(conn redis.Conn, usageKey string) (Usage, error) {
+	values, err := redis.Values(conn.Do("HMGET", usageKey, "total", "count"))
+	if err != nil {
+		return Usage{}, err
+	}
+
+	var total float64
+	var count uint64
+
+	if values[0] != nil {
+		if total, err = redis.Float64(values[0], nil); err != nil {
+			return Usage{}, err
+		}
+	}
+
+	if values[1] != nil {
+		if count, err = redis.Uint64(values[1], nil); err != nil {
+			return Usage{}, err
+		}
+	}
+
+	return Usage{Total: total, Count: uint(count)}, nil
+}
+
+// queueInsert sends the commands saving the transaction; they run when the MULTI block is executed.
+func (s *RedisStore) queueInsert(conn redis.Conn, transaction *Transaction) error {
+	value, err := json.Marshal(transaction)
+	if err != nil {
+		return err
+	}
+
+	// The loads expire with the longest window and the counters with their own, once no limit counts them.
+	if err := conn.Send("SET", s.loadKey(transaction.CustomerID, transaction.TransactionID), value,
+		"EX", loadExpiration(transaction)); err != nil {
+		return err
+	}
+
+	if transaction.State == StateAuthorized && transaction.ExpiresAt != nil {
+		if err := conn.Send("ZADD", s.reservationsKey(), reservationScore(*transaction.ExpiresAt), reservationMember(transaction)); err != nil {
+			return err
+		}
+	}
+
+	for _, kind := range []string{WindowDay, WindowWeek} {
+		for _, key := range s.usageKeys(transaction, kind) {
+			if err := incrementUsage.Send(conn, key, transaction.LoadAmount, int64(WindowLength(kind)/time.Second)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// usageKeys returns the keys of the counters of the customer and of the dimensions of the transaction
+// within its window of the given kind.
+func (s *RedisStore) usageKeys(transaction *Transaction, kind string) []string {
+	windowKey := WindowKey(kind, transaction.Time)
+	keys := []string{s.usageKey(transaction.CustomerID, kind, windowKey)}
+
+	for _, value := range dimensionValues(transaction) {
+		keys = append(keys, s.dimensionUsageKey(value.dimension, value.value, kind, windowKey))
+	}
+
+	return keys
+}
+
+// queueSetState sends the commands saving the new state of the transaction.
+func (s *RedisStore) queueSetState(conn redis.Conn, update redisStateUpdate) error {
+	transaction := update.transaction
+
+	value, err := json.Marshal(transaction)
+	if err != nil {
+		return err
+	}
+
+	if err := conn.Send("SET", s.loadKey(transaction.CustomerID, transaction.TransactionID), value,
+		"EX", loadExpiration(transaction)); err != nil {
+		return err
+	}
+
+	if update.previous == StateAuthorized {
+		if err := conn.Send("ZREM", s.reservationsKey(), reservationMember(transaction)); err != nil {
+			return err
+		}
+	}
+
+	if !update.released {
+		return nil
+	}
+
+	for _, kind := range []string{WindowDay, WindowWeek} {
+		for _, key := range s.usageKeys(transaction, kind) {
+			if err := decrementUsage.Send(conn, key, transaction.LoadAmount); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// redisStateUpdate is a change of the state of a transaction, queued until the store commits it.
+type redisStateUpdate struct {
+	transaction *Transaction
+	previous    string
+	released    bool
+}
+
+// redisTransaction watches the counters and loads it reads and queues the changes until the store commits them.
+type redisTransaction struct {
+	store   *RedisStore
+	conn    redis.Conn
+	inserts []*Transaction
+	updates []redisStateUpdate
+}
+
+func (t *redisTransaction) RunInTransaction(fn func(store TransactionStore) error) error {
+	return fn(t)
+}
+
+func (t *redisTransaction) SumAndCount(customerID uint, kind string, key string) (Usage, error) {
+	if _, err := t.conn.Do("WATCH", t.store.usageKey(customerID, kind, key)); err != nil {
+		return Usage{}, err
+	}
+
+	usage, err := t.store.sumAndCount(t.conn, t.store.usageKey(customerID, kind, key))
+	if err != nil {
+		return Usage{}, err
+	}
+
+	// Count the loads inserted earlier in this transaction, which are not sent to the server yet.
+	for _, transaction := range t.inserts {
+		if transaction.CustomerID == customerID && WindowKey(kind, transaction.Time) == key {
+			usage.Total += transaction.LoadAmount
+			usage.Count++
+		}
+	}
+
+	return usage, nil
+}
+
+func (t *redisTransaction) SumAndCountBy(dimension string, value string, kind string, key string) (Usage, error) {
+	usageKey := t.store.dimensionUsageKey(dimension, value, kind, key)
+
+	if _, err := t.conn.Do("WATCH", usageKey); err != nil {
+		return Usage{}, err
+	}
+
+	usage, err := t.store.sumAndCount(t.conn, usageKey)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	// Count the loads inserted earlier in this transaction, which are not sent to the server yet.
+	for _, transaction := range t.inserts {
+		if WindowKey(kind, transaction.Time) != key {
+			continue
+		}
+
+		for _, transactionValue := range dimensionValues(transaction) {
+			if transactionValue == (dimensionValue{dimension, value}) {
+				usage.Total += transaction.LoadAmount
+				usage.Count++
+			}
+		}
+	}
+
+	return usage, nil
+}
+
+func (t *redisTransaction) Insert(transaction *Transaction) error {
+	now := time.Now()
+
+	transaction.CreatedAt = now
+	transaction.UpdatedAt = now
+
+	t.inserts = append(t.inserts, transaction)
+
+	return nil
+}
+
+func (t *redisTransaction) FindByLoadID(customerID uint, loadID uint) (*Transaction, error) {
+	for _, transaction := range t.inserts {
+		if transaction.CustomerID == customerID && transaction.TransactionID == loadID {
+			return transaction, nil
+		}
+	}
+
+	if _, err := t.conn.Do("WATCH", t.store.loadKey(customerID, loadID)); err != nil {
+		return nil, err
+	}
+
+	return t.store.FindByLoadID(customerID, loadID)
+}
+
+// SetState queues the change of the state of the transaction, which should have been read by FindByLoadID
+// in this transaction so that a concurrent change aborts it.
+func (t *redisTransaction) SetState(transaction *Transaction, state string) error {
+	update := redisStateUpdate{
+		previous: transaction.State,
+		released: transaction.Counted() && !(&Transaction{State: state}).Counted(),
+	}
+
+	transaction.State = state
+	transaction.UpdatedAt = time.Now()
+
+	update.transaction = transaction
+	t.updates = append(t.updates, update)
+
+	return nil
+}
+
+func (t *redisTransaction) ScanExpired(at time.Time, fn func(transaction Transaction) error) error {
+	return t.store.ScanExpired(at, fn)
+}
+
+func (t *redisTransaction) Scan(filter TransactionFilter, fn func(transaction Transaction) error) error {
+	return t.store.Scan(filter, fn)
+}
+
+func (t *redisTransaction) Prune(before time.Time, hard bool, archive PruneArchive) (int, error) {
+	return 0, errors.New("prune inside of a transaction")
+}
+
+// FindListing watches the listing, so that the transaction is retried if the customer is listed meanwhile.
+func (t *redisTransaction) FindListing(customerID uint) (*CustomerListing, error) {
+	if _, err := t.conn.Do("WATCH", t.store.listingKey(customerID)); err != nil {
+		return nil, err
+	}
+
+	return t.store.FindListing(customerID)
+}
+
+// SaveListing saves the listing right away, outside of the MULTI block of the inserts.
+func (t *redisTransaction) SaveListing(listing *CustomerListing) error {
+	return t.store.SaveListing(listing)
+}
+
+// DeleteListing deletes the listing right away, outside of the MULTI block of the inserts.
+func (t *redisTransaction) DeleteListing(customerID uint) (bool, error) {
+	return t.store.DeleteListing(customerID)
+}
+
+func (t *redisTransaction) Close() error {
+	return nil
+}
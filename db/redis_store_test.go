@@ -0,0 +1,88 @@
+package db
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func openTestRedisStore(t *testing.T) (*miniredis.Miniredis, *RedisStore) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+
+	store, err := OpenRedisStore("redis://" + server.Addr())
+	assert.Nil(t, err)
+
+	return server, store
+}
+
+func TestRedisStore_Insert_ShouldAccumulateUsageWithExpiration(t *testing.T) {
+	server, store := openTestRedisStore(t)
+	defer server.Close()
+	defer store.Close()
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100.25, Time: startDate}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: startDate.AddDate(0, 0, 1)}))
+
+	usage, err := store.SumAndCount(1, WindowWeek, "2020-W46")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 150.25, Count: 2}, usage)
+
+	transaction, err := store.FindByLoadID(1, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 50.0, transaction.LoadAmount)
+
+	assert.Equal(t, 24*time.Hour, server.TTL("velocity:usage:1:day:2020-11-09"))
+	assert.Equal(t, 7*24*time.Hour, server.TTL("velocity:usage:1:week:2020-W46"))
+
+	server.FastForward(24 * time.Hour)
+
+	usage, err = store.SumAndCount(1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{}, usage)
+}
+
+func TestRedisStore_ConcurrentChange_ShouldRetryTransaction(t *testing.T) {
+	server, store := openTestRedisStore(t)
+	defer server.Close()
+	defer store.Close()
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+	attempts := 0
+	var seen Usage
+
+	err := store.RunInTransaction(func(tx TransactionStore) error {
+		attempts++
+
+		usage, err := tx.SumAndCount(1, WindowDay, "2020-11-09")
+		if err != nil {
+			return err
+		}
+
+		seen = usage
+
+		if attempts == 1 {
+			// Another instance accepts a load between the check and the insert.
+			if err := store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}); err != nil {
+				return err
+			}
+		}
+
+		return tx.Insert(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: startDate})
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, Usage{Total: 100, Count: 1}, seen)
+
+	usage, err := store.SumAndCount(1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 150, Count: 2}, usage)
+}
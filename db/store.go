@@ -0,0 +1,149 @@
+package db
+
+import (
+	"time"
+)
+
+// Usage is the total amount and the number of loads accepted within a window.
+type Usage struct {
+	Total float64
+	Count uint
+}
+
+// PruneArchive keeps the transactions removed by Prune.
+type PruneArchive interface {
+	// Archive keeps the transaction, which is removed once the archive is completed.
+	Archive(transaction Transaction) error
+
+	// Complete makes the archive durable, after the last transaction and before any is removed.
+	Complete() error
+}
+
+// ArchiveFunc is a PruneArchive passing the transactions to the function, with nothing to complete.
+type ArchiveFunc func(transaction Transaction) error
+
+func (f ArchiveFunc) Archive(transaction Transaction) error {
+	return f(transaction)
+}
+
+func (f ArchiveFunc) Complete() error {
+	return nil
+}
+
+// TransactionFilter selects the transactions made in [From, To), of a single customer when CustomerID is set.
+// A zero From or To leaves that end open.
+// The released reservations are never selected.
+type TransactionFilter struct {
+	From       time.Time
+	To         time.Time
+	CustomerID *uint
+}
+
+// Matches reports whether the transaction is selected by the filter.
+func (f TransactionFilter) Matches(transaction *Transaction) bool {
+	if !transaction.Counted() {
+		return false
+	}
+
+	if f.CustomerID != nil && transaction.CustomerID != *f.CustomerID {
+		return false
+	}
+
+	if !f.From.IsZero() && transaction.Time.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && !transaction.Time.Before(f.To) {
+		return false
+	}
+
+	return true
+}
+
+// TransactionStore keeps the accepted transactions and the usage of the customers, so that the limit
+// rules can be evaluated without depending on a particular database.
+type TransactionStore interface {
+	// RunInTransaction runs fn atomically: the usage read by fn cannot change until fn returns,
+	// and the transactions inserted by fn are discarded if it returns an error.
+	RunInTransaction(fn func(store TransactionStore) error) error
+
+	// SumAndCount returns the usage of the customer within the window of the given kind and key.
+	SumAndCount(customerID uint, kind string, key string) (Usage, error)
+
+	// SumAndCountBy returns the usage of the loads with the value of the dimension within the window of the
+	// given kind and key.
+	SumAndCountBy(dimension string, value string, kind string, key string) (Usage, error)
+
+	// Insert saves the transaction and adds it to the usage of the customer and of its dimensions.
+	Insert(transaction *Transaction) error
+
+	// FindByLoadID returns the transaction of the customer with the given load id, or nil if there is none.
+	FindByLoadID(customerID uint, loadID uint) (*Transaction, error)
+
+	// Scan passes the transactions selected by the filter to fn, in order of customer then time,
+	// without loading them all in memory.
+	Scan(filter TransactionFilter, fn func(transaction Transaction) error) error
+
+	// Prune removes the transactions older than the time, whatever their state, passing each one to archive
+	// first when it is not nil, together with the usage of the windows that ended before it. The archive is
+	// completed before anything is removed, and nothing is when it fails. Unless hard is set, SQL databases
+	// keep the transactions with their DeletedAt set. It returns how many were removed.
+	Prune(before time.Time, hard bool, archive PruneArchive) (int, error)
+
+	// SetState changes the state of the saved transaction, taking its amount out of the usage of the customer
+	// and of its dimensions when its reservation is released.
+	SetState(transaction *Transaction, state string) error
+
+	// ScanExpired passes the authorized transactions whose reservation expired at the time to fn.
+	ScanExpired(at time.Time, fn func(transaction Transaction) error) error
+
+	// FindListing returns the listing of the customer, expired or not, or nil if there is none.
+	FindListing(customerID uint) (*CustomerListing, error)
+
+	// SaveListing puts the customer on the list of the listing, replacing its previous listing.
+	SaveListing(listing *CustomerListing) error
+
+	// DeleteListing removes the customer from the list it is on, returning whether it was on one.
+	DeleteListing(customerID uint) (bool, error)
+
+	Close() error
+}
+
+// endedWindowKeys returns, for every window kind, the key of the window containing the time: the windows
+// with lower keys ended before it.
+func endedWindowKeys(before time.Time) map[string]string {
+	before = before.UTC()
+
+	return map[string]string{
+		WindowDay:  WindowKey(WindowDay, before),
+		WindowWeek: WindowKey(WindowWeek, before),
+	}
+}
+
+// OpenStore opens the store for the dialect: a bbolt file for bolt, a Redis-compatible server for redis,
+// a gorm database otherwise.
+func OpenStore(dialect string, connection string) (TransactionStore, error) {
+	switch dialect {
+	case "bolt":
+		store, err := OpenBoltStore(connection)
+		if err != nil {
+			return nil, err
+		}
+
+		return store, nil
+	case "redis":
+		store, err := OpenRedisStore(connection)
+		if err != nil {
+			return nil, err
+		}
+
+		return store, nil
+	}
+
+	database, err := OpenDatabase(dialect, connection)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewGormStore(database), nil
+}
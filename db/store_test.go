@@ -0,0 +1,263 @@
+package db
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testReservations checks that the store counts the reservations until they are released, and finds the
+// expired ones.
+func testReservations(t *testing.T, store TransactionStore) {
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+	expiresAt := startDate.Add(time.Hour)
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate, State: StateSettled}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 50, Time: startDate, State: StateAuthorized, ExpiresAt: &expiresAt}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 3, CustomerID: 1, LoadAmount: 20, Time: startDate, State: StateAuthorized, ExpiresAt: &expiresAt}))
+
+	usage, err := store.SumAndCount(1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 170, Count: 3}, usage)
+
+	var expired []uint
+
+	collect := func(transaction Transaction) error {
+		expired = append(expired, transaction.TransactionID)
+		return nil
+	}
+
+	assert.Nil(t, store.ScanExpired(expiresAt.Add(-time.Second), collect))
+	assert.Empty(t, expired)
+
+	assert.Nil(t, store.ScanExpired(expiresAt, collect))
+	assert.ElementsMatch(t, []uint{2, 3}, expired)
+
+	captured, err := store.FindByLoadID(1, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, store.SetState(captured, StateSettled))
+
+	voided, err := store.FindByLoadID(1, 3)
+	assert.Nil(t, err)
+	assert.Nil(t, store.SetState(voided, StateVoided))
+
+	usage, err = store.SumAndCount(1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 150, Count: 2}, usage)
+
+	expired = nil
+
+	assert.Nil(t, store.ScanExpired(expiresAt, collect))
+	assert.Empty(t, expired)
+
+	transaction, err := store.FindByLoadID(1, 3)
+
+	assert.Nil(t, err)
+	assert.Equal(t, StateVoided, transaction.State)
+}
+
+// testDimensionUsage checks that the store keeps the usage of the funding sources, the merchants and the
+// platform, until the reservations are released.
+func testDimensionUsage(t *testing.T, store TransactionStore) {
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+	expiresAt := startDate.Add(time.Hour)
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate, FundingSource: "fp-1", MerchantID: "m-1"}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 2, LoadAmount: 50, Time: startDate, FundingSource: "fp-1", State: StateAuthorized, ExpiresAt: &expiresAt}))
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 2, CustomerID: 2, LoadAmount: 20, Time: startDate.AddDate(0, 0, 1), MerchantID: "m-1"}))
+
+	usages := []struct {
+		dimension string
+		value     string
+		kind      string
+		key       string
+		usage     Usage
+	}{
+		{DimensionFundingSource, "fp-1", WindowDay, "2020-11-09", Usage{Total: 150, Count: 2}},
+		{DimensionMerchant, "m-1", WindowDay, "2020-11-09", Usage{Total: 100, Count: 1}},
+		{DimensionMerchant, "m-1", WindowWeek, "2020-W46", Usage{Total: 120, Count: 2}},
+		{DimensionPlatform, "", WindowDay, "2020-11-09", Usage{Total: 150, Count: 2}},
+		{DimensionPlatform, "", WindowWeek, "2020-W46", Usage{Total: 170, Count: 3}},
+		{DimensionMerchant, "m-2", WindowDay, "2020-11-09", Usage{}},
+	}
+
+	for _, expected := range usages {
+		usage, err := store.SumAndCountBy(expected.dimension, expected.value, expected.kind, expected.key)
+
+		assert.Nil(t, err)
+		assert.Equal(t, expected.usage, usage, expected.dimension+" "+expected.value+" "+expected.key)
+	}
+
+	reservation, err := store.FindByLoadID(2, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, store.SetState(reservation, StateVoided))
+
+	usage, err := store.SumAndCountBy(DimensionFundingSource, "fp-1", WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 100, Count: 1}, usage)
+
+	usage, err = store.SumAndCountBy(DimensionPlatform, "", WindowWeek, "2020-W46")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 120, Count: 2}, usage)
+}
+
+func TestMemoryStore_DimensionUsage_ShouldCountUntilReleased(t *testing.T) {
+	testDimensionUsage(t, NewMemoryStore())
+}
+
+func TestGormStore_DimensionUsage_ShouldCountUntilReleased(t *testing.T) {
+	testDimensionUsage(t, NewGormStore(openTestDatabase()))
+}
+
+func TestBoltStore_DimensionUsage_ShouldCountUntilReleased(t *testing.T) {
+	directory, err := ioutil.TempDir("", "velocity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := OpenBoltStore(filepath.Join(directory, "velocity.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	testDimensionUsage(t, store)
+}
+
+func TestRedisStore_DimensionUsage_ShouldCountUntilReleased(t *testing.T) {
+	server, store := openTestRedisStore(t)
+	defer server.Close()
+	defer store.Close()
+
+	testDimensionUsage(t, store)
+}
+
+// failingArchive archives every transaction but fails to complete, like an archive on a full disk.
+type failingArchive struct {
+	archived int
+}
+
+func (a *failingArchive) Archive(transaction Transaction) error {
+	a.archived++
+	return nil
+}
+
+func (a *failingArchive) Complete() error {
+	return errors.New("disk full")
+}
+
+// testPruneArchiveFails checks that the store removes nothing when the archive cannot be completed.
+func testPruneArchiveFails(t *testing.T, store TransactionStore) {
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}))
+
+	archive := &failingArchive{}
+	count, err := store.Prune(startDate.AddDate(0, 0, 30), true, archive)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, count)
+	assert.Equal(t, 1, archive.archived)
+
+	transaction, err := store.FindByLoadID(1, 1)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, transaction)
+
+	usage, err := store.SumAndCount(1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Usage{Total: 100, Count: 1}, usage)
+}
+
+func TestMemoryStore_PruneArchiveFails_ShouldRemoveNothing(t *testing.T) {
+	testPruneArchiveFails(t, NewMemoryStore())
+}
+
+func TestGormStore_PruneArchiveFails_ShouldRemoveNothing(t *testing.T) {
+	testPruneArchiveFails(t, NewGormStore(openTestDatabase()))
+}
+
+func TestBoltStore_PruneArchiveFails_ShouldRemoveNothing(t *testing.T) {
+	directory, err := ioutil.TempDir("", "velocity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := OpenBoltStore(filepath.Join(directory, "velocity.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	testPruneArchiveFails(t, store)
+}
+
+func TestMemoryStore_Reservations_ShouldCountUntilReleased(t *testing.T) {
+	testReservations(t, NewMemoryStore())
+}
+
+func TestGormStore_Reservations_ShouldCountUntilReleased(t *testing.T) {
+	testReservations(t, NewGormStore(openTestDatabase()))
+}
+
+func TestBoltStore_Reservations_ShouldCountUntilReleased(t *testing.T) {
+	directory, err := ioutil.TempDir("", "velocity")
+	assert.Nil(t, err)
+	defer os.RemoveAll(directory)
+
+	store, err := OpenBoltStore(filepath.Join(directory, "velocity.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	testReservations(t, store)
+}
+
+func TestRedisStore_Reservations_ShouldCountUntilReleased(t *testing.T) {
+	server, store := openTestRedisStore(t)
+	defer server.Close()
+	defer store.Close()
+
+	testReservations(t, store)
+}
+
+func TestGormStore_PruneWithArchive_ShouldRemoveArchivedTransactionsOnly(t *testing.T) {
+	store := NewGormStore(openTestDatabase())
+
+	before := time.Date(2020, 11, 9, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < pruneBatchSize+2; i++ {
+		assert.Nil(t, store.Insert(&Transaction{TransactionID: uint(i + 1), CustomerID: 1, LoadAmount: 10, Time: before.Add(-time.Duration(i+1) * time.Minute)}))
+	}
+
+	assert.Nil(t, store.Insert(&Transaction{TransactionID: 1000, CustomerID: 1, LoadAmount: 10, Time: before}))
+
+	// A failing archive leaves the transactions in place.
+	count, err := store.Prune(before, true, ArchiveFunc(func(transaction Transaction) error {
+		return errors.New("disk full")
+	}))
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, count)
+
+	var archived []uint
+
+	count, err = store.Prune(before, true, ArchiveFunc(func(transaction Transaction) error {
+		archived = append(archived, transaction.TransactionID)
+		return nil
+	}))
+
+	assert.Nil(t, err)
+	assert.Equal(t, pruneBatchSize+2, count)
+	assert.Len(t, archived, pruneBatchSize+2)
+
+	transaction, err := store.FindByLoadID(1, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, transaction)
+
+	transaction, err = store.FindByLoadID(1, 1000)
+	assert.Nil(t, err)
+	assert.NotNil(t, transaction)
+}
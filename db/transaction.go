@@ -6,31 +6,82 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/sirupsen/logrus"
 	"time"
 )
 
+// The states of a transaction. The loads are settled once accepted, unless they are authorized first:
+// their amount is then reserved until they are captured, which settles them, or voided, or until their
+// reservation expires.
+const (
+	StateSettled    = "settled"
+	StateAuthorized = "authorized"
+	StateVoided     = "voided"
+	StateExpired    = "expired"
+)
+
 type Transaction struct {
 	gorm.Model
 	TransactionID uint
 	CustomerID    uint
-	LoadAmount    float64
-	Time          time.Time
-	Year          uint
-	Month         uint
-	Day           uint
-	Week          uint
+	// LoadAmount is the amount loaded, which is less than the requested amount when it was partially approved.
+	LoadAmount float64
+	// RequestedAmount is the amount of the load request, zero for the loads saved before it was recorded.
+	RequestedAmount float64
+	// FundingSource is the fingerprint of the card or account the load is funded from, if known.
+	FundingSource string
+	// MerchantID is the merchant or program the load is made through, if known.
+	MerchantID string
+	// State is the state of the reservation of the load, settled for the loads accepted in one phase.
+	State string `gorm:"size:16"`
+	// ExpiresAt is when the reservation of an authorized load is released, unless it is captured before.
+	ExpiresAt *time.Time
+	Time      time.Time
+	Year      uint
+	Month     uint
+	Day       uint
+	Week      uint
+}
+
+// Counted reports whether the transaction counts toward the limits, which the released reservations do not.
+func (t *Transaction) Counted() bool {
+	return t.State != StateVoided && t.State != StateExpired
+}
+
+// ExpiredAt reports whether the transaction is an authorization whose reservation expired at the time.
+func (t *Transaction) ExpiredAt(at time.Time) bool {
+	return t.State == StateAuthorized && t.ExpiresAt != nil && !at.Before(*t.ExpiresAt)
 }
 
+// OpenDatabase connects to the database and applies the pending migrations.
 func OpenDatabase(databaseDialect string, databaseConnection string) (database *gorm.DB, err error) {
-	database, err = gorm.Open(databaseDialect, databaseConnection)
+	database, err = ConnectDatabase(databaseDialect, databaseConnection)
 	if err != nil {
 		return
 	}
 
-	database.LogMode(true)
-
 	// Migrate the schema
-	database.AutoMigrate(&Transaction{})
+	if _, err = MigrateUp(database); err != nil {
+		database.Close()
+		database = nil
+	}
+
+	return
+}
+
+// ConnectDatabase connects to the database without touching its schema.
+func ConnectDatabase(databaseDialect string, databaseConnection string) (database *gorm.DB, err error) {
+	if databaseDialect == "sqlite3" {
+		databaseConnection = sqliteConnection(databaseConnection)
+	}
+
+	database, err = gorm.Open(databaseDialect, databaseConnection)
+	if err != nil {
+		return
+	}
+
+	database.SetLogger(gormLogger{logger: logger})
+	database.LogMode(logger.IsLevelEnabled(logrus.DebugLevel))
 
 	return
 }
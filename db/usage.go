@@ -0,0 +1,362 @@
+package db
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	WindowDay  = "day"
+	WindowWeek = "week"
+)
+
+var windowLengths = map[string]time.Duration{
+	WindowDay:  24 * time.Hour,
+	WindowWeek: 7 * 24 * time.Hour,
+}
+
+// WindowLength returns the duration of the windows of the given kind.
+func WindowLength(kind string) time.Duration {
+	return windowLengths[kind]
+}
+
+// LongestWindow returns the duration of the longest window kind.
+func LongestWindow() time.Duration {
+	longest := time.Duration(0)
+
+	for _, length := range windowLengths {
+		if length > longest {
+			longest = length
+		}
+	}
+
+	return longest
+}
+
+// The dimensions the usage of the loads is kept by, besides their customer. The platform has a single
+// value, empty, shared by every load.
+const (
+	DimensionFundingSource = "funding_source"
+	DimensionMerchant      = "merchant"
+	DimensionPlatform      = "platform"
+)
+
+// dimensionValue is the value of a dimension of a transaction.
+type dimensionValue struct {
+	dimension string
+	value     string
+}
+
+// dimensionValues returns the values of the dimensions of the transaction, without the ones it does not have.
+func dimensionValues(transaction *Transaction) []dimensionValue {
+	values := []dimensionValue{{DimensionPlatform, ""}}
+
+	if transaction.FundingSource != "" {
+		values = append(values, dimensionValue{DimensionFundingSource, transaction.FundingSource})
+	}
+
+	if transaction.MerchantID != "" {
+		values = append(values, dimensionValue{DimensionMerchant, transaction.MerchantID})
+	}
+
+	return values
+}
+
+// CustomerUsage holds the running total and count of accepted loads of a customer within a window,
+// so that limit checks do not have to aggregate the whole transaction history.
+type CustomerUsage struct {
+	CustomerID uint   `gorm:"primary_key;auto_increment:false"`
+	WindowKind string `gorm:"primary_key;size:16"`
+	WindowKey  string `gorm:"primary_key;size:16"`
+	Total      float64
+	Count      uint
+}
+
+func (CustomerUsage) TableName() string {
+	return "customer_usage"
+}
+
+// DimensionUsage holds the running total and count of the accepted loads with a value of a dimension within
+// a window, such as the loads of a merchant in a day.
+type DimensionUsage struct {
+	Dimension      string `gorm:"primary_key;size:16"`
+	DimensionValue string `gorm:"primary_key;size:255"`
+	WindowKind     string `gorm:"primary_key;size:16"`
+	WindowKey      string `gorm:"primary_key;size:16"`
+	Total          float64
+	Count          uint
+}
+
+func (DimensionUsage) TableName() string {
+	return "dimension_usage"
+}
+
+// WindowKey returns the key of the window of the given kind the time falls into.
+func WindowKey(kind string, time time.Time) string {
+	switch kind {
+	case WindowDay:
+		return time.Format("2006-01-02")
+	case WindowWeek:
+		year, week := time.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week)
+	}
+
+	return ""
+}
+
+// FindUsage returns the usage of the customer within a window, or an empty usage if there is none yet.
+func FindUsage(database *gorm.DB, customerID uint, kind string, key string) (usage CustomerUsage, err error) {
+	err = database.Where("customer_id = ? and window_kind = ? and window_key = ?", customerID, kind, key).
+		First(&usage).Error
+
+	if gorm.IsRecordNotFoundError(err) {
+		usage = CustomerUsage{CustomerID: customerID, WindowKind: kind, WindowKey: key}
+		err = nil
+	}
+
+	return
+}
+
+// FindDimensionUsage returns the usage of the value of the dimension within a window, or an empty usage if there
+// is none yet.
+func FindDimensionUsage(database *gorm.DB, dimension string, value string, kind string, key string) (usage DimensionUsage, err error) {
+	err = database.Where("dimension = ? and dimension_value = ? and window_kind = ? and window_key = ?", dimension, value, kind, key).
+		First(&usage).Error
+
+	if gorm.IsRecordNotFoundError(err) {
+		usage = DimensionUsage{Dimension: dimension, DimensionValue: value, WindowKind: kind, WindowKey: key}
+		err = nil
+	}
+
+	return
+}
+
+// InsertTransaction saves the transaction and adds it to the customer and dimension usage within the same
+// database transaction.
+func InsertTransaction(database *gorm.DB, transaction *Transaction) error {
+	return database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(transaction).Error; err != nil {
+			return err
+		}
+
+		return addUsage(tx, transaction)
+	})
+}
+
+func addUsage(database *gorm.DB, transaction *Transaction) error {
+	for _, kind := range []string{WindowDay, WindowWeek} {
+		key := WindowKey(kind, transaction.Time)
+
+		if err := addCustomerUsage(database, transaction.CustomerID, kind, key, transaction.LoadAmount); err != nil {
+			return err
+		}
+
+		for _, value := range dimensionValues(transaction) {
+			if err := addDimensionUsage(database, value, kind, key, transaction.LoadAmount); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func addCustomerUsage(database *gorm.DB, customerID uint, kind string, key string, amount float64) error {
+	result := database.Model(&CustomerUsage{}).
+		Where("customer_id = ? and window_kind = ? and window_key = ?", customerID, kind, key).
+		UpdateColumns(map[string]interface{}{
+			"total": gorm.Expr("total + ?", amount),
+			"count": gorm.Expr("count + ?", 1),
+		})
+
+	if result.Error != nil || result.RowsAffected > 0 {
+		return result.Error
+	}
+
+	usage := CustomerUsage{
+		CustomerID: customerID,
+		WindowKind: kind,
+		WindowKey:  key,
+		Total:      amount,
+		Count:      1,
+	}
+
+	return database.Create(&usage).Error
+}
+
+func addDimensionUsage(database *gorm.DB, value dimensionValue, kind string, key string, amount float64) error {
+	result := database.Model(&DimensionUsage{}).
+		Where("dimension = ? and dimension_value = ? and window_kind = ? and window_key = ?", value.dimension, value.value, kind, key).
+		UpdateColumns(map[string]interface{}{
+			"total": gorm.Expr("total + ?", amount),
+			"count": gorm.Expr("count + ?", 1),
+		})
+
+	if result.Error != nil || result.RowsAffected > 0 {
+		return result.Error
+	}
+
+	usage := DimensionUsage{
+		Dimension:      value.dimension,
+		DimensionValue: value.value,
+		WindowKind:     kind,
+		WindowKey:      key,
+		Total:          amount,
+		Count:          1,
+	}
+
+	return database.Create(&usage).Error
+}
+
+// removeUsage takes the transaction out of the customer and dimension usage, leaving the usage of the
+// windows that were pruned alone.
+func removeUsage(database *gorm.DB, transaction *Transaction) error {
+	taken := map[string]interface{}{
+		"total": gorm.Expr("total - ?", transaction.LoadAmount),
+		"count": gorm.Expr("count - ?", 1),
+	}
+
+	for _, kind := range []string{WindowDay, WindowWeek} {
+		key := WindowKey(kind, transaction.Time)
+
+		err := database.Model(&CustomerUsage{}).
+			Where("customer_id = ? and window_kind = ? and window_key = ?", transaction.CustomerID, kind, key).
+			UpdateColumns(taken).Error
+
+		if err != nil {
+			return err
+		}
+
+		for _, value := range dimensionValues(transaction) {
+			err := database.Model(&DimensionUsage{}).
+				Where("dimension = ? and dimension_value = ? and window_kind = ? and window_key = ?", value.dimension, value.value, kind, key).
+				UpdateColumns(taken).Error
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rebuildUsage recomputes the customer usage from the transactions table.
+func rebuildUsage(database *gorm.DB) error {
+	return database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&CustomerUsage{}).Error; err != nil {
+			return err
+		}
+
+		rows, err := tx.Model(&Transaction{}).Rows()
+		if err != nil {
+			return err
+		}
+
+		usages := make(map[CustomerUsage]*CustomerUsage)
+		order := make([]*CustomerUsage, 0)
+
+		for rows.Next() {
+			var transaction Transaction
+
+			if err := tx.ScanRows(rows, &transaction); err != nil {
+				rows.Close()
+				return err
+			}
+
+			for _, kind := range []string{WindowDay, WindowWeek} {
+				id := CustomerUsage{
+					CustomerID: transaction.CustomerID,
+					WindowKind: kind,
+					WindowKey:  WindowKey(kind, transaction.Time),
+				}
+
+				usage, found := usages[id]
+				if !found {
+					usage = &CustomerUsage{CustomerID: id.CustomerID, WindowKind: id.WindowKind, WindowKey: id.WindowKey}
+					usages[id] = usage
+					order = append(order, usage)
+				}
+
+				usage.Total += transaction.LoadAmount
+				usage.Count++
+			}
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, usage := range order {
+			if err := tx.Create(usage).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// rebuildDimensionUsage recomputes the dimension usage from the transactions counting toward the limits.
+func rebuildDimensionUsage(database *gorm.DB) error {
+	return database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&DimensionUsage{}).Error; err != nil {
+			return err
+		}
+
+		rows, err := tx.Model(&Transaction{}).Where("state IS NULL OR state NOT IN (?)", []string{StateVoided, StateExpired}).Rows()
+		if err != nil {
+			return err
+		}
+
+		usages := make(map[DimensionUsage]*DimensionUsage)
+		order := make([]*DimensionUsage, 0)
+
+		for rows.Next() {
+			var transaction Transaction
+
+			if err := tx.ScanRows(rows, &transaction); err != nil {
+				rows.Close()
+				return err
+			}
+
+			for _, kind := range []string{WindowDay, WindowWeek} {
+				for _, value := range dimensionValues(&transaction) {
+					id := DimensionUsage{
+						Dimension:      value.dimension,
+						DimensionValue: value.value,
+						WindowKind:     kind,
+						WindowKey:      WindowKey(kind, transaction.Time),
+					}
+
+					usage, found := usages[id]
+					if !found {
+						usage = &DimensionUsage{Dimension: id.Dimension, DimensionValue: id.DimensionValue, WindowKind: id.WindowKind, WindowKey: id.WindowKey}
+						usages[id] = usage
+						order = append(order, usage)
+					}
+
+					usage.Total += transaction.LoadAmount
+					usage.Count++
+				}
+			}
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, usage := range order {
+			if err := tx.Create(usage).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	guuid "github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func openTestDatabase() *gorm.DB {
+	database, err := OpenDatabase("sqlite3", "file:"+guuid.New().String()+"?mode=memory")
+	if err != nil {
+		panic("failed to connect database")
+	}
+
+	database.LogMode(false)
+
+	return database
+}
+
+func TestInsertTransaction_SameDay_ShouldAccumulateUsage(t *testing.T) {
+	database := openTestDatabase()
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	assert.Nil(t, InsertTransaction(database, &Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}))
+	assert.Nil(t, InsertTransaction(database, &Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 250, Time: startDate.Add(time.Hour)}))
+	assert.Nil(t, InsertTransaction(database, &Transaction{TransactionID: 3, CustomerID: 1, LoadAmount: 50, Time: startDate.AddDate(0, 0, 1)}))
+
+	daily, err := FindUsage(database, 1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 350.0, daily.Total)
+	assert.Equal(t, uint(2), daily.Count)
+
+	weekly, err := FindUsage(database, 1, WindowWeek, "2020-W46")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 400.0, weekly.Total)
+	assert.Equal(t, uint(3), weekly.Count)
+}
+
+func TestFindUsage_NoTransactions_ShouldReturnEmptyUsage(t *testing.T) {
+	database := openTestDatabase()
+
+	usage, err := FindUsage(database, 1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, usage.Total)
+	assert.Equal(t, uint(0), usage.Count)
+}
+
+func TestRebuildUsage_ExistingTransactions_ShouldMatchInsertedUsage(t *testing.T) {
+	database := openTestDatabase()
+
+	startDate := time.Date(2020, 11, 9, 3, 51, 48, 0, time.UTC)
+
+	assert.Nil(t, database.Save(&Transaction{TransactionID: 1, CustomerID: 1, LoadAmount: 100, Time: startDate}).Error)
+	assert.Nil(t, database.Save(&Transaction{TransactionID: 2, CustomerID: 1, LoadAmount: 200, Time: startDate}).Error)
+	assert.Nil(t, database.Save(&Transaction{TransactionID: 3, CustomerID: 2, LoadAmount: 300, Time: startDate}).Error)
+
+	assert.Nil(t, rebuildUsage(database))
+
+	usage, err := FindUsage(database, 1, WindowDay, "2020-11-09")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 300.0, usage.Total)
+	assert.Equal(t, uint(2), usage.Count)
+
+	usage, err = FindUsage(database, 2, WindowWeek, "2020-W46")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 300.0, usage.Total)
+	assert.Equal(t, uint(1), usage.Count)
+}